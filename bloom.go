@@ -0,0 +1,143 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"unsafe"
+)
+
+// bloomFilter is an immutable bloom filter over the keys of a snapshot
+type bloomFilter struct {
+	bits   []uint64
+	nbits  uint32
+	hashes uint32
+}
+
+func newBloomFilter(nkeys int64, bitsPerKey int) *bloomFilter {
+	nbits := uint32(nkeys * int64(bitsPerKey))
+	if nbits < 64 {
+		nbits = 64
+	}
+
+	// Optimal number of hash functions is bitsPerKey * ln(2)
+	hashes := uint32(bitsPerKey * 69 / 100)
+	if hashes < 1 {
+		hashes = 1
+	}
+
+	return &bloomFilter{
+		bits:   make([]uint64, (nbits+63)/64),
+		nbits:  nbits,
+		hashes: hashes,
+	}
+}
+
+func bloomHash(bs []byte) (h1, h2 uint32) {
+	h := fnv.New64a()
+	h.Write(bs)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func (f *bloomFilter) add(bs []byte) {
+	h1, h2 := bloomHash(bs)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % f.nbits
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *bloomFilter) mightContain(bs []byte) bool {
+	h1, h2 := bloomHash(bs)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % f.nbits
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// UseBloomFilter enables bloom filters for snapshots with the given number of
+// bits per item. A filter is built over the items of a snapshot on the first
+// call to MightContain() or Snapshot.Get() for the snapshot and it is
+// released along with the snapshot. Snapshot.Get() consults the filter before
+// searching the store. A filter uses bitsPerKey bits for every item in the
+// snapshot and 10 bits per item result in about 1% false positives.
+// The filter hashes the item data. If a custom key comparator is set, items
+// with different data may compare equal and the filter is not used unless a
+// key function is provided by SetBloomFilterKey().
+func (cfg *Config) UseBloomFilter(bitsPerKey int) {
+	cfg.checkMutable()
+	cfg.bloomBitsPerKey = bitsPerKey
+}
+
+// SetBloomFilterKey sets the function which extracts the part of the item
+// data hashed by the bloom filter. It is required to use bloom filters along
+// with a custom key comparator. The function should return identical bytes
+// for all the items which the key comparator considers equal, such as the
+// key of a key value item. It is invoked both for the stored items and for
+// the data passed to MightContain() and Snapshot.Get().
+func (cfg *Config) SetBloomFilterKey(key func([]byte) []byte) {
+	cfg.checkMutable()
+	cfg.bloomKey = key
+}
+
+func (m *Nitro) bloomFilterKey(bs []byte) []byte {
+	if m.bloomKey != nil {
+		return m.bloomKey(bs)
+	}
+	return bs
+}
+
+// MightContain returns false if the snapshot definitely does not contain an
+// item with the given data. It can be used to avoid lookups in the store for
+// missing items. A true result means that the item may be present and the
+// store should be consulted. If bloom filters are not enabled, the filter
+// cannot be used with the key comparator or the snapshot has already been
+// destroyed, it always returns true.
+func (m *Nitro) MightContain(snap *Snapshot, bs []byte) bool {
+	if m.bloomBitsPerKey <= 0 || (m.customKeyCmp && m.bloomKey == nil) {
+		return true
+	}
+
+	f := (*bloomFilter)(atomic.LoadPointer(&snap.bloom))
+	if f == nil {
+		if f = m.buildBloomFilter(snap); f == nil {
+			return true
+		}
+	}
+
+	return f.mightContain(m.bloomFilterKey(bs))
+}
+
+// buildBloomFilter builds the bloom filter of a snapshot. If multiple callers
+// build the filter concurrently, all of them use the first published filter.
+func (m *Nitro) buildBloomFilter(snap *Snapshot) *bloomFilter {
+	itr := snap.NewIterator()
+	if itr == nil {
+		return nil
+	}
+	defer itr.Close()
+
+	f := newBloomFilter(snap.Count(), m.bloomBitsPerKey)
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		f.add(m.bloomFilterKey(itr.Get()))
+	}
+
+	if !atomic.CompareAndSwapPointer(&snap.bloom, nil, unsafe.Pointer(f)) {
+		f = (*bloomFilter)(atomic.LoadPointer(&snap.bloom))
+	}
+
+	return f
+}
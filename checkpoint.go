@@ -0,0 +1,233 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// checkpointPrefix is the name prefix of the backups created by
+	// ScheduledCheckpoint()
+	checkpointPrefix = "checkpoint-"
+	// checkpointTimeFormat has a fixed width, so that the names of the
+	// backups are ordered by their creation time
+	checkpointTimeFormat = "20060102T150405.000000000Z"
+)
+
+// fsyncPath flushes a file or a directory to stable storage
+func fsyncPath(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	err = fd.Sync()
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// syncTree flushes all the files and directories under dir to stable storage
+// The files of a directory are flushed before the directory itself.
+func (m *Nitro) syncTree(dir string) error {
+	var dirs []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+
+		return m.syncPath(path)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := m.syncPath(dirs[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncBackupFiles flushes the files of a backup directory along with its
+// manifest, the directory itself and its parent directory to stable storage.
+func (m *Nitro) syncBackupFiles(dir string, files []string) error {
+	for _, file := range append(files, "files.json") {
+		if err := m.syncPath(filepath.Join(dir, file)); err != nil {
+			return err
+		}
+	}
+
+	if err := m.syncPath(dir); err != nil {
+		return err
+	}
+
+	return m.syncPath(filepath.Dir(dir))
+}
+
+// Checkpoint creates a new snapshot and durably stores it to dir using
+// StoreToDisk(). The backup is written to a temporary directory, all of its
+// files and directories are flushed to stable storage and it is renamed to
+// dir afterwards. An existing backup in dir is replaced. It is renamed to a
+// backup directory with the ".old" suffix before the rename and removed
+// afterwards, so that a complete backup is available at any point in case of
+// a crash. The snapshot is returned on success and it should be closed by the
+// caller once it is no longer needed.
+// The same restrictions on concurrent writers as NewSnapshot() apply.
+func (m *Nitro) Checkpoint(dir string, concurr int) (*Snapshot, error) {
+	snap, err := m.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.checkpoint(dir, snap, concurr); err != nil {
+		snap.Close()
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+func (m *Nitro) checkpoint(dir string, snap *Snapshot, concurr int) error {
+	dir = filepath.Clean(dir)
+	tmpdir, olddir := dir+".tmp", dir+".old"
+	if err := os.RemoveAll(tmpdir); err != nil {
+		return err
+	}
+
+	// StoreToDisk consumes a reference of the snapshot
+	if err := snap.Acquire(); err != nil {
+		return err
+	}
+
+	if err := m.StoreToDisk(tmpdir, snap, concurr, nil); err != nil {
+		return err
+	}
+
+	if err := m.syncTree(tmpdir); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dir); err == nil {
+		if err := os.RemoveAll(olddir); err != nil {
+			return err
+		}
+
+		if err := os.Rename(dir, olddir); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmpdir, dir); err != nil {
+		return err
+	}
+
+	if err := m.syncPath(filepath.Dir(dir)); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(olddir)
+}
+
+// ScheduledCheckpoint creates a new snapshot and stores it using Checkpoint()
+// to a new subdirectory of dir, named after the current UTC time. Once the
+// backup is complete, the oldest backups in dir are removed so that only the
+// latest keep backups are retained. A keep less than 1 is treated as 1. The
+// path of the new backup is returned.
+// Checkpoint() renames a backup to its final name only once it is complete.
+// Hence, the leftovers of failed backups are never counted as backups and
+// they are removed along with the old backups. If the clock has moved back
+// since the latest backup, the new backup is named right after the latest
+// one, so that the new backup always sorts last and it is never removed.
+// Concurrent calls on the same directory are not supported.
+func (m *Nitro) ScheduledCheckpoint(dir string, keep int, concurr int) (string, error) {
+	if keep < 1 {
+		keep = 1
+	}
+
+	if err := os.MkdirAll(dir, m.backupDirPerm()); err != nil {
+		return "", err
+	}
+
+	backups, stale, err := listCheckpoints(dir)
+	if err != nil {
+		return "", err
+	}
+
+	t := time.Now().UTC()
+	if len(backups) > 0 {
+		latest, _ := time.Parse(checkpointTimeFormat, strings.TrimPrefix(backups[len(backups)-1], checkpointPrefix))
+		if !t.After(latest) {
+			t = latest.Add(time.Nanosecond)
+		}
+	}
+
+	path := filepath.Join(dir, checkpointPrefix+t.Format(checkpointTimeFormat))
+	snap, err := m.Checkpoint(path, concurr)
+	if err != nil {
+		return "", err
+	}
+	snap.Close()
+
+	if len(backups) >= keep {
+		stale = append(stale, backups[:len(backups)+1-keep]...)
+	}
+
+	for _, name := range stale {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return path, err
+		}
+	}
+
+	return path, nil
+}
+
+// listCheckpoints returns the names of the complete backups in dir created by
+// ScheduledCheckpoint() in the order of creation and the names of the
+// leftovers of the backups which have failed
+func listCheckpoints(dir string) (backups []string, stale []string, err error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, fi := range fis {
+		name := fi.Name()
+		if !fi.IsDir() || !strings.HasPrefix(name, checkpointPrefix) {
+			continue
+		}
+
+		ts := strings.TrimPrefix(name, checkpointPrefix)
+		if _, err := time.Parse(checkpointTimeFormat, ts); err == nil {
+			backups = append(backups, name)
+		} else if strings.HasSuffix(ts, ".tmp") || strings.HasSuffix(ts, ".old") {
+			stale = append(stale, name)
+		}
+	}
+
+	sort.Strings(backups)
+	return backups, stale, nil
+}
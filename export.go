@@ -0,0 +1,69 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// ExportEntry is the representation of an item used by snapshot exports
+type ExportEntry struct {
+	Key []byte `json:"key"`
+	Sn  uint32 `json:"sn"`
+}
+
+// ExportJSON writes all items in the snapshot as JSON objects, one per line.
+// Item data is base64 encoded. Items are read concurrently and they are not
+// written in sorted order.
+func (m *Nitro) ExportJSON(snap *Snapshot, w io.Writer) error {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+
+	callb := func(itm *Item, shard int) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return enc.Encode(&ExportEntry{Key: itm.Bytes(), Sn: itm.bornSn})
+	}
+
+	shards := runtime.NumCPU()
+	return m.Visitor(snap, callb, shards, shards)
+}
+
+// ExportCSV writes all items in the snapshot as records of base64 encoded item
+// data and the item sequence number separated by sep.
+// Items are read concurrently and they are not written in sorted order.
+func (m *Nitro) ExportCSV(snap *Snapshot, w io.Writer, sep rune) error {
+	var mu sync.Mutex
+	cw := csv.NewWriter(w)
+	cw.Comma = sep
+
+	callb := func(itm *Item, shard int) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return cw.Write([]string{
+			base64.StdEncoding.EncodeToString(itm.Bytes()),
+			fmt.Sprint(itm.bornSn),
+		})
+	}
+
+	shards := runtime.NumCPU()
+	if err := m.Visitor(snap, callb, shards, shards); err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -11,24 +11,89 @@ package nitro
 
 import "os"
 import "bufio"
+import "bytes"
+import "encoding/json"
 import "errors"
+import "io"
+import "io/ioutil"
+import "path/filepath"
 
 var (
 	// DiskBlockSize - backup file reader and writer
-	DiskBlockSize     = 512 * 1024
-	errNotEnoughSpace = errors.New("Not enough space in the buffer")
+	DiskBlockSize = 512 * 1024
+	// ErrNotEnoughSpace means a buffer provided for encoding or decoding an
+	// item or a snapshot is too small
+	ErrNotEnoughSpace = errors.New("Not enough space in the buffer")
+	// ErrUnknownFileType means a backup records a file type which is not
+	// supported by the reader
+	ErrUnknownFileType = errors.New("Unknown backup file type")
+	// ErrInvalidFileType means the configured backup file type is not
+	// supported
+	ErrInvalidFileType = errors.New("Invalid backup file type")
+	// ErrUnsupportedFormatVersion means the format version header of a backup
+	// file does not match the file type recorded in the backup
+	ErrUnsupportedFormatVersion = errors.New("Unsupported backup file format version")
+	// ErrItemTooLarge means an item exceeds MaxEncodedItemLen bytes
+	ErrItemTooLarge = errors.New("Item is too large to be encoded")
+	// ErrComparatorMismatch means a backup was created with a different key
+	// comparator
+	ErrComparatorMismatch = errors.New("Backup key comparator does not match")
 )
 
 // FileType describes backup file format
+// The file type acts as the format version of a backup. It is recorded in
+// files.json of the data and delta directories and in manifest.json, and the
+// shard files are always decoded using the recorded file type irrespective of
+// the configured one. Hence, a change to the item encoding requires a new file
+// type while older backups remain readable. A backup can be migrated to the
+// configured file type by loading it and storing the snapshot again. Loading a
+// backup with a file type unknown to the reader fails with ErrUnknownFileType.
+// Every shard file also starts with a format version header holding its file
+// type, unless a custom item codec is set. Loading a file whose header does
+// not match the recorded file type fails with ErrUnsupportedFormatVersion.
+// Files written before the header was introduced are read without it.
 type FileType int
 
+// fileHeaderMagic starts the format version header of the shard files. Files
+// without the header start with the length of the first item and an empty
+// item ends them. Hence, the magic, which starts with an empty item length,
+// cannot be confused with the start of such a file.
+var fileHeaderMagic = []byte{0, 0, 'n', 'i', 't', 'r', 'o'}
+
+// fileHeaderSize is the size of the magic followed by the file type
+var fileHeaderSize = len(fileHeaderMagic) + 1
+
+// encodeBufSize is the buffer size for the item length header
+const encodeBufSize = 4
+
+// The file types are recorded in backups and their values should not change
 const (
-	encodeBufSize = 4
-	readerBufSize = 10000
 	// RawdbFile - backup file storage format
-	RawdbFile FileType = iota
+	RawdbFile FileType = 2
+	// RawdbFileV2 - backup file storage format which includes item flags
+	RawdbFileV2 FileType = 3
 )
 
+func validFileType(t FileType) bool {
+	return t == RawdbFile || t == RawdbFileV2
+}
+
+// ItemEncoder implements custom encoding of an item into a backup file
+type ItemEncoder func(*Item, io.Writer) error
+
+// ItemDecoder implements custom decoding of item data from a backup file
+// It should return io.EOF once all the items have been read.
+type ItemDecoder func(io.Reader) ([]byte, error)
+
+// SetItemCodec configures a custom item encoding for backup files
+// When a codec is set, backup files contain only the items encoded by the
+// encoder and no end of file marker is written.
+func (cfg *Config) SetItemCodec(enc ItemEncoder, dec ItemDecoder) {
+	cfg.checkMutable()
+	cfg.itemEncoder = enc
+	cfg.itemDecoder = dec
+}
+
 // FileWriter represents backup file writer
 type FileWriter interface {
 	Open(path string) error
@@ -43,61 +108,218 @@ type FileReader interface {
 	Close() error
 }
 
+// fileManifest describes the files in a backup directory and their format
+type fileManifest struct {
+	FileType   FileType `json:"fileType"`
+	Files      []string `json:"files"`
+	Comparator string   `json:"comparator,omitempty"`
+}
+
+func (m *Nitro) encodeManifest(files []string) []byte {
+	bs, _ := json.Marshal(fileManifest{FileType: m.fileType, Files: files, Comparator: m.keyCmpName})
+	return bs
+}
+
+func (m *Nitro) decodeManifest(bs []byte) (fileManifest, error) {
+	var mf fileManifest
+
+	// Older backups only record the list of files and always use the
+	// original file format irrespective of the configured file type
+	if err := json.Unmarshal(bs, &mf.Files); err == nil {
+		mf.FileType = RawdbFile
+		return mf, nil
+	}
+
+	if err := json.Unmarshal(bs, &mf); err != nil {
+		return mf, err
+	}
+
+	if m.newFileReader(mf.FileType) == nil {
+		return mf, ErrUnknownFileType
+	}
+
+	// Backups and instances without a comparator name are not checked
+	if mf.Comparator != "" && m.keyCmpName != "" && mf.Comparator != m.keyCmpName {
+		return mf, ErrComparatorMismatch
+	}
+
+	return mf, nil
+}
+
+// nonEmptyFiles filters out the backup files which do not hold any items
+// Older backups list the empty shard files in the manifest as well.
+func (m *Nitro) nonEmptyFiles(dir string, files []string, t FileType) []string {
+	var nonEmpty []string
+	for _, file := range files {
+		if !m.isEmptyFile(filepath.Join(dir, file), t) {
+			nonEmpty = append(nonEmpty, file)
+		}
+	}
+
+	return nonEmpty
+}
+
+// isEmptyFile returns true if a backup file holds only the terminator, which
+// may be preceded by the format version header
+func (m *Nitro) isEmptyFile(path string, t FileType) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	if m.itemEncoder != nil {
+		return fi.Size() == 0
+	}
+
+	termSize := m.terminatorSize(t)
+	switch fi.Size() {
+	case termSize:
+		return true
+	case int64(fileHeaderSize) + termSize:
+		// A file without the header may hold an item of the same size
+		hdr := make([]byte, len(fileHeaderMagic))
+		fd, err := os.Open(path)
+		if err != nil {
+			return false
+		}
+		defer fd.Close()
+
+		_, err = io.ReadFull(fd, hdr)
+		return err == nil && bytes.Equal(hdr, fileHeaderMagic)
+	}
+
+	return false
+}
+
+// terminatorSize returns the size of the terminator which ends the files of
+// a file type
+func (m *Nitro) terminatorSize(t FileType) int64 {
+	buf := make([]byte, encodeBufSize)
+	cw := &countingWriter{w: ioutil.Discard}
+	m.encodeItem(&Item{}, buf, cw, t == RawdbFileV2)
+	return cw.n
+}
+
+func ioBufSize(sz int) int {
+	if sz <= 0 {
+		return DiskBlockSize
+	}
+	return sz
+}
+
 func (m *Nitro) newFileWriter(t FileType) FileWriter {
 	var w FileWriter
-	if t == RawdbFile {
-		w = &rawFileWriter{db: m}
+	if validFileType(t) {
+		w = &rawFileWriter{db: m, fileType: t, withFlags: t == RawdbFileV2}
 	}
 	return w
 }
 
 func (m *Nitro) newFileReader(t FileType) FileReader {
 	var r FileReader
-	if t == RawdbFile {
-		r = &rawFileReader{db: m}
+	if validFileType(t) {
+		r = &rawFileReader{db: m, fileType: t, withFlags: t == RawdbFileV2}
 	}
 	return r
 }
 
+// byteCounter is implemented by file writers and readers which track the
+// number of bytes written to or read from the file
+type byteCounter interface {
+	byteCount() int64
+}
+
+func fileByteCount(f interface{}) int64 {
+	if c, ok := f.(byteCounter); ok {
+		return c.byteCount()
+	}
+	return 0
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// rawFileWriter counts the bytes encoded into the buffered writer. Hence, the
+// count includes the buffered bytes which are yet to be written to the file.
 type rawFileWriter struct {
-	db   *Nitro
-	fd   *os.File
-	w    *bufio.Writer
-	buf  []byte
-	path string
+	db        *Nitro
+	fd        *os.File
+	cw        *countingWriter
+	w         *bufio.Writer
+	buf       []byte
+	path      string
+	fileType  FileType
+	withFlags bool
 }
 
 func (f *rawFileWriter) Open(path string) error {
 	var err error
-	f.fd, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0755)
+	f.fd, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.db.shardFilePerm())
 	if err == nil {
 		f.buf = make([]byte, encodeBufSize)
-		f.w = bufio.NewWriterSize(f.fd, DiskBlockSize)
+		f.w = bufio.NewWriterSize(f.fd, ioBufSize(f.db.writerBufSize))
+		f.cw = &countingWriter{w: f.w}
+
+		// The custom item codecs define the format of their files
+		if f.db.itemEncoder == nil {
+			f.cw.Write(fileHeaderMagic)
+			f.cw.Write([]byte{byte(f.fileType)})
+		}
 	}
 	return err
 }
 
 func (f *rawFileWriter) WriteItem(itm *Item) error {
-	return f.db.EncodeItem(itm, f.buf, f.w)
+	if f.db.itemEncoder != nil {
+		return f.db.itemEncoder(itm, f.cw)
+	}
+	return f.db.encodeItem(itm, f.buf, f.cw, f.withFlags)
 }
 
 func (f *rawFileWriter) Close() error {
-	terminator := &Item{}
-
-	if err := f.WriteItem(terminator); err != nil {
-		return err
+	if f.db.itemEncoder == nil {
+		terminator := &Item{}
+		if err := f.WriteItem(terminator); err != nil {
+			return err
+		}
 	}
 
 	f.w.Flush()
 	return f.fd.Close()
 }
 
+func (f *rawFileWriter) byteCount() int64 {
+	return f.cw.n
+}
+
 type rawFileReader struct {
-	db   *Nitro
-	fd   *os.File
-	r    *bufio.Reader
-	buf  []byte
-	path string
+	db        *Nitro
+	fd        *os.File
+	cr        *countingReader
+	r         *bufio.Reader
+	buf       []byte
+	path      string
+	fileType  FileType
+	withFlags bool
 }
 
 func (f *rawFileReader) Open(path string) error {
@@ -105,13 +327,54 @@ func (f *rawFileReader) Open(path string) error {
 	f.fd, err = os.Open(path)
 	if err == nil {
 		f.buf = make([]byte, encodeBufSize)
-		f.r = bufio.NewReaderSize(f.fd, DiskBlockSize)
+		f.cr = &countingReader{r: f.fd}
+		f.r = bufio.NewReaderSize(f.cr, ioBufSize(f.db.readerBufSize))
+		if err = f.readHeader(); err != nil {
+			f.fd.Close()
+		}
+	}
+	return err
+}
+
+// readHeader checks the format version header of the file against the file
+// type recorded in the backup. Files written before the header was introduced
+// are read without it.
+func (f *rawFileReader) readHeader() error {
+	if f.db.itemDecoder != nil {
+		return nil
+	}
+
+	hdr, err := f.r.Peek(fileHeaderSize)
+	if err != nil || !bytes.Equal(hdr[:len(fileHeaderMagic)], fileHeaderMagic) {
+		return nil
+	}
+
+	if FileType(hdr[len(fileHeaderMagic)]) != f.fileType {
+		return ErrUnsupportedFormatVersion
 	}
+
+	_, err = f.r.Discard(fileHeaderSize)
 	return err
 }
 
 func (f *rawFileReader) ReadItem() (*Item, error) {
-	return f.db.DecodeItem(f.buf, f.r)
+	if f.db.itemDecoder != nil {
+		bs, err := f.db.itemDecoder(f.r)
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(bs) > MaxItemLen {
+			return nil, ErrMaxItemSizeExceeded
+		}
+		return f.db.newItem(bs, f.db.useMemoryMgmt), nil
+	}
+	return f.db.decodeItem(f.buf, f.r, f.withFlags)
+}
+
+func (f *rawFileReader) byteCount() int64 {
+	return f.cr.n
 }
 
 func (f *rawFileReader) Close() error {
@@ -0,0 +1,296 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// ErrIndexNotFound means that a secondary index has not been configured
+var ErrIndexNotFound = fmt.Errorf("Index not found")
+
+// IndexExtractor returns the index key of an item for a secondary index
+// A nil index key excludes the item from the index. The index keys are
+// ordered by bytes.Compare().
+type IndexExtractor func(itm *Item) []byte
+
+type indexDef struct {
+	name    string
+	extract IndexExtractor
+}
+
+// index is a secondary index which maps index keys to the keys of the items
+// The index entries are the items of an internal Nitro instance. Every
+// snapshot of the store has a snapshot of the index, which is created and
+// closed along with it. Hence, the index entries are versioned and garbage
+// collected by the internal instance in lockstep with the items.
+type index struct {
+	indexDef
+	db *Nitro
+}
+
+// AddIndex configures a secondary index, which is maintained by the writers
+// The extractor is invoked for every item added or removed by a writer and
+// an index entry mapping the index key to the item is added or removed along
+// with the item. The index can be queried using IndexScan().
+// Indexes are not maintained for the items loaded using LoadFromDisk(),
+// Loader and SwapStore() and they are not stored in backups.
+// An error wrapping ErrInvalidConfig is returned if an index with the same
+// name has already been configured.
+func (cfg *Config) AddIndex(name string, extract IndexExtractor) error {
+	cfg.checkMutable()
+	for _, def := range cfg.indexDefs {
+		if def.name == name {
+			return fmt.Errorf("%w: index %s already exists", ErrInvalidConfig, name)
+		}
+	}
+
+	// Avoid sharing the definitions with copies of the config
+	defs := make([]indexDef, len(cfg.indexDefs), len(cfg.indexDefs)+1)
+	copy(defs, cfg.indexDefs)
+	cfg.indexDefs = append(defs, indexDef{name: name, extract: extract})
+	return nil
+}
+
+// encodeIndexEntry encodes an index entry as
+// [uvarint index key len][index key][item key]
+func encodeIndexEntry(ikey, key []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+len(ikey)+len(key))
+	l := binary.PutUvarint(buf, uint64(len(ikey)))
+	l += copy(buf[l:], ikey)
+	l += copy(buf[l:], key)
+	return buf[:l]
+}
+
+func decodeIndexEntry(bs []byte) (ikey, key []byte) {
+	ilen, l := binary.Uvarint(bs)
+	return bs[l : l+int(ilen)], bs[l+int(ilen):]
+}
+
+// newIndexCompare orders index entries by the index keys and the entries
+// with the same index key by the item keys. An empty item key is the
+// smallest one, so that it can be used to seek to an index key.
+func newIndexCompare(keyCmp KeyCompare) KeyCompare {
+	return func(a, b []byte) int {
+		ai, ak := decodeIndexEntry(a)
+		bi, bk := decodeIndexEntry(b)
+		if v := bytes.Compare(ai, bi); v != 0 {
+			return v
+		}
+
+		switch {
+		case len(ak) == 0 && len(bk) == 0:
+			return 0
+		case len(ak) == 0:
+			return -1
+		case len(bk) == 0:
+			return 1
+		}
+
+		return keyCmp(ak, bk)
+	}
+}
+
+func (m *Nitro) initIndexes() {
+	for _, def := range m.indexDefs {
+		cfg := DefaultConfig()
+		cfg.SetKeyComparator(newIndexCompare(m.keyCmp))
+		cfg.SetName(m.name + "/" + def.name)
+		m.indexes = append(m.indexes, &index{indexDef: def, db: NewWithConfig(cfg)})
+	}
+}
+
+func (m *Nitro) closeIndexes() {
+	for _, idx := range m.indexes {
+		idx.db.Close()
+	}
+}
+
+// newIndexSnapshots creates the snapshots of the indexes for a new snapshot
+func (m *Nitro) newIndexSnapshots() ([]*Snapshot, error) {
+	var snaps []*Snapshot
+	for _, idx := range m.indexes {
+		snap, err := idx.db.NewSnapshot()
+		if err != nil {
+			for _, snap := range snaps {
+				snap.Close()
+			}
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+
+	return snaps, nil
+}
+
+// indexWriters returns the writers of the indexes used by the writer
+func (w *Writer) indexWriters() []*Writer {
+	if w.idxWriters == nil {
+		for _, idx := range w.indexes {
+			w.idxWriters = append(w.idxWriters, idx.db.NewWriter())
+		}
+	}
+
+	return w.idxWriters
+}
+
+// indexPut adds the index entries of an item added by the writer
+func (w *Writer) indexPut(itm *Item) {
+	for i, iw := range w.indexWriters() {
+		if ikey := w.indexes[i].extract(itm); ikey != nil {
+			iw.Put(encodeIndexEntry(ikey, itm.Bytes()))
+		}
+	}
+}
+
+// indexDelete removes the index entries of an item removed by the writer
+func (w *Writer) indexDelete(itm *Item) {
+	for i, iw := range w.indexWriters() {
+		if ikey := w.indexes[i].extract(itm); ikey != nil {
+			iw.Delete(encodeIndexEntry(ikey, itm.Bytes()))
+		}
+	}
+}
+
+// IndexScan invokes the callback with the index key and the item data of the
+// entries of a secondary index in the snapshot whose index keys are in the
+// range [start, end), in the order of index keys. A nil start or end leaves
+// the range unbounded. The scan stops once the callback returns false.
+// ErrIndexNotFound is returned if the index has not been configured and
+// ErrSnapshotClosed is returned if the snapshot has already been destroyed.
+func (m *Nitro) IndexScan(snap *Snapshot, name string, start, end []byte,
+	fn func(ikey, data []byte) bool) error {
+
+	for i, idx := range m.indexes {
+		if idx.name != name {
+			continue
+		}
+
+		if snap.RefCount() == 0 {
+			return ErrSnapshotClosed
+		}
+
+		return snap.indexSnaps[i].WithIterator(func(itr *Iterator) error {
+			if start == nil {
+				itr.SeekFirst()
+			} else {
+				itr.Seek(encodeIndexEntry(start, nil))
+			}
+
+			for ; itr.Valid(); itr.Next() {
+				ikey, data := decodeIndexEntry(itr.Get())
+				if end != nil && bytes.Compare(ikey, end) >= 0 {
+					break
+				}
+
+				if !fn(ikey, data) {
+					break
+				}
+			}
+
+			return nil
+		})
+	}
+
+	return ErrIndexNotFound
+}
+
+// SortedIterator iterates over the items of a snapshot in the order of the
+// keys extracted from them
+type SortedIterator struct {
+	snap    *Snapshot
+	entries []sortedEntry
+	pos     int
+	closed  bool
+}
+
+type sortedEntry struct {
+	key []byte
+	itm *Item
+}
+
+// SortedByValueIterator returns an iterator over the items of the snapshot
+// ordered by the keys returned by the extractor, such as a value or a derived
+// key, instead of the item keys. Items with equal extracted keys are ordered
+// by their item keys and items with a nil extracted key are excluded.
+// The store is not ordered by the extracted keys. Hence, all the items of the
+// snapshot are visited and sorted in memory when the iterator is created,
+// which takes O(n log n) time and memory for n entries proportional to the
+// number of items. It is meant for one-off scans such as reports. Use
+// AddIndex() for queries which are repeated.
+// The iterator holds a reference to the snapshot until it is closed.
+// ErrSnapshotClosed is returned if the snapshot has already been destroyed.
+func (m *Nitro) SortedByValueIterator(snap *Snapshot, extract IndexExtractor) (*SortedIterator, error) {
+	if !snap.Open() {
+		return nil, ErrSnapshotClosed
+	}
+
+	it := &SortedIterator{snap: snap}
+	itr := snap.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		itm := itr.GetItem()
+		if key := extract(itm); key != nil {
+			it.entries = append(it.entries, sortedEntry{key: key, itm: itm})
+		}
+	}
+	itr.Close()
+
+	// The items are visited in the order of item keys
+	sort.SliceStable(it.entries, func(i, j int) bool {
+		return bytes.Compare(it.entries[i].key, it.entries[j].key) < 0
+	})
+
+	return it, nil
+}
+
+// SeekFirst moves cursor to the item with the smallest extracted key
+func (it *SortedIterator) SeekFirst() {
+	it.pos = 0
+}
+
+// Valid returns false when the iterator has reached the end
+func (it *SortedIterator) Valid() bool {
+	return !it.closed && it.pos < len(it.entries)
+}
+
+// Next moves cursor to the next item
+func (it *SortedIterator) Next() {
+	it.pos++
+}
+
+// Key returns the extracted key of the current item
+func (it *SortedIterator) Key() []byte {
+	return it.entries[it.pos].key
+}
+
+// Get returns the data of the current item
+func (it *SortedIterator) Get() []byte {
+	return it.entries[it.pos].itm.Bytes()
+}
+
+// GetItem returns the current item
+func (it *SortedIterator) GetItem() *Item {
+	return it.entries[it.pos].itm
+}
+
+// Close releases the snapshot reference held by the iterator
+// Calling Close more than once has no effect.
+func (it *SortedIterator) Close() {
+	if it.closed {
+		return
+	}
+
+	it.closed = true
+	it.entries = nil
+	it.snap.Close()
+}
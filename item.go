@@ -12,19 +12,40 @@ package nitro
 import (
 	"encoding/binary"
 	"io"
+	"math"
 	"reflect"
+	"sync/atomic"
 	"unsafe"
 )
 
 var itemHeaderSize = unsafe.Sizeof(Item{})
 
+const (
+	// ItemHeaderEncodeSize is the size of the encoded item length header
+	ItemHeaderEncodeSize = 2
+	// MaxEncodedItemLen is the maximum length of an item which can be encoded
+	MaxEncodedItemLen = math.MaxUint16
+	// MaxItemLen is the maximum length of an item. Longer items are rejected
+	// by the writers and the loaders without being allocated.
+	MaxItemLen = itemLenMask
+)
+
+// The item flags are kept in the top bits of the item length word, so that
+// they do not grow the item header
+const (
+	itemFlagsShift = 24
+	itemLenMask    = 1<<itemFlagsShift - 1
+)
+
 // Item represents nitro item header
 // The item data is followed by the header.
 // Item data is a block of bytes. The user can store key and value into a
 // block of bytes and provide custom key comparator.
+// The items are limited to MaxItemLen bytes.
 type Item struct {
-	bornSn  uint32
-	deadSn  uint32
+	bornSn uint32
+	deadSn uint32
+	// Item length and flags
 	dataLen uint32
 }
 
@@ -42,6 +63,7 @@ func (m *Nitro) freeItem(itm *Item) {
 }
 
 func (m *Nitro) allocItem(l int, useMM bool) (itm *Item) {
+	checkItemLen(l)
 	blockSize := itemHeaderSize + uintptr(l)
 	if useMM {
 		itm = (*Item)(m.mallocFun(int(blockSize)))
@@ -56,15 +78,87 @@ func (m *Nitro) allocItem(l int, useMM bool) (itm *Item) {
 	return
 }
 
+// checkItemLen guards the item length header. The items are validated by the
+// callers before they are allocated, such as by Writer.tooLarge().
+func checkItemLen(l int) {
+	if l > MaxItemLen {
+		panic("nitro: item exceeds the maximum item length")
+	}
+}
+
+const (
+	maxSlabItems = 4096
+	maxSlabSize  = 1 << 20
+)
+
+// newStoreItem allocates an item to be added to the store by the writer. The
+// items are carved out of a slab if the expected item count is configured.
+func (w *Writer) newStoreItem(data []byte) *Item {
+	if w.useMemoryMgmt || w.expectedItems <= 0 {
+		return w.newItem(data, w.useMemoryMgmt)
+	}
+
+	checkItemLen(len(data))
+	// Items are 8 byte aligned to keep the header fields aligned
+	blockSize := (int(itemHeaderSize) + len(data) + 7) &^ 7
+	if len(w.slab) < blockSize {
+		n := w.expectedItems
+		if n > maxSlabItems {
+			n = maxSlabItems
+		}
+
+		size := n * blockSize
+		if size > maxSlabSize {
+			size = maxSlabSize
+		}
+
+		if size < blockSize {
+			size = blockSize
+		}
+		w.slab = make([]byte, size)
+	}
+
+	itm := (*Item)(unsafe.Pointer(&w.slab[0]))
+	w.slab = w.slab[blockSize:]
+	itm.dataLen = uint32(len(data))
+	copy(itm.Bytes(), data)
+	return itm
+}
+
 // EncodeItem encodes in [2 byte len][item_bytes] format.
+// The buffer is used for the length header and it should have at least
+// ItemHeaderEncodeSize bytes, otherwise ErrNotEnoughSpace is returned. Items
+// larger than MaxEncodedItemLen bytes cannot be encoded and ErrItemTooLarge is
+// returned for them.
 func (m *Nitro) EncodeItem(itm *Item, buf []byte, w io.Writer) error {
-	l := 2
+	return m.encodeItem(itm, buf, w, false)
+}
+
+// encodeItem encodes in [2 byte len][1 byte flags][item_bytes] format if
+// withFlags is true. The flags are not encoded for an empty item.
+func (m *Nitro) encodeItem(itm *Item, buf []byte, w io.Writer, withFlags bool) error {
+	l := ItemHeaderEncodeSize
+	if withFlags {
+		l++
+	}
+
 	if len(buf) < l {
-		return errNotEnoughSpace
+		return ErrNotEnoughSpace
+	}
+
+	dataLen := itm.len()
+	if dataLen > MaxEncodedItemLen {
+		return ErrItemTooLarge
+	}
+
+	binary.BigEndian.PutUint16(buf[0:2], uint16(dataLen))
+	if !withFlags || dataLen == 0 {
+		l = ItemHeaderEncodeSize
+	} else {
+		buf[2] = itm.Flags()
 	}
 
-	binary.BigEndian.PutUint16(buf[0:2], uint16(itm.dataLen))
-	if _, err := w.Write(buf[0:2]); err != nil {
+	if _, err := w.Write(buf[0:l]); err != nil {
 		return err
 	}
 	if _, err := w.Write(itm.Bytes()); err != nil {
@@ -74,15 +168,48 @@ func (m *Nitro) EncodeItem(itm *Item, buf []byte, w io.Writer) error {
 	return nil
 }
 
+// EncodedItemSize returns the number of bytes written by EncodeItem() for
+// the item.
+func EncodedItemSize(itm *Item) int64 {
+	return int64(ItemHeaderEncodeSize) + int64(itm.len())
+}
+
 // DecodeItem decodes encoded [2 byte len][item_bytes] format.
+// The buffer is used for the length header and it should have at least
+// ItemHeaderEncodeSize bytes, otherwise ErrNotEnoughSpace is returned.
 func (m *Nitro) DecodeItem(buf []byte, r io.Reader) (*Item, error) {
+	return m.decodeItem(buf, r, false)
+}
+
+// decodeItem decodes [2 byte len][1 byte flags][item_bytes] format if
+// withFlags is true.
+func (m *Nitro) decodeItem(buf []byte, r io.Reader, withFlags bool) (*Item, error) {
+	l := ItemHeaderEncodeSize
+	if withFlags {
+		l++
+	}
+
+	if len(buf) < l {
+		return nil, ErrNotEnoughSpace
+	}
+
 	if _, err := io.ReadFull(r, buf[0:2]); err != nil {
 		return nil, err
 	}
 
-	l := binary.BigEndian.Uint16(buf[0:2])
-	if l > 0 {
-		itm := m.allocItem(int(l), m.useMemoryMgmt)
+	dataLen := binary.BigEndian.Uint16(buf[0:2])
+	if dataLen > 0 {
+		if withFlags {
+			if _, err := io.ReadFull(r, buf[2:3]); err != nil {
+				return nil, err
+			}
+		}
+
+		itm := m.allocItem(int(dataLen), m.useMemoryMgmt)
+		if withFlags {
+			itm.SetFlags(buf[2])
+		}
+
 		data := itm.Bytes()
 		_, err := io.ReadFull(r, data)
 		return itm, err
@@ -93,7 +220,7 @@ func (m *Nitro) DecodeItem(buf []byte, r io.Reader) (*Item, error) {
 
 // Bytes return item data bytes
 func (itm *Item) Bytes() (bs []byte) {
-	l := itm.dataLen
+	l := itm.len()
 	dataOffset := uintptr(unsafe.Pointer(itm)) + itemHeaderSize
 
 	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&bs))
@@ -103,8 +230,49 @@ func (itm *Item) Bytes() (bs []byte) {
 	return
 }
 
+// BornSn returns the snapshot number at which the item was inserted
+func (itm *Item) BornSn() uint32 {
+	return itm.bornSn
+}
+
+// DeadSn returns the snapshot number at which the item was deleted
+// It returns zero if the item has not been deleted.
+func (itm *Item) DeadSn() uint32 {
+	return atomic.LoadUint32(&itm.deadSn)
+}
+
+// Flags returns the application defined flags of the item
+// The flags do not affect the ordering of items.
+func (itm *Item) Flags() uint8 {
+	return uint8(atomic.LoadUint32(&itm.dataLen) >> itemFlagsShift)
+}
+
+// SetFlags sets the application defined flags of the item
+// The flags are persisted in backups which use the RawdbFileV2 file type.
+// An item inserted by a writer is not visible to any snapshot until the next
+// snapshot is created. Setting the flags of the node returned by Put2()
+// before that is not observed by snapshot readers.
+func (itm *Item) SetFlags(flags uint8) {
+	for {
+		old := atomic.LoadUint32(&itm.dataLen)
+		v := old&itemLenMask | uint32(flags)<<itemFlagsShift
+		if atomic.CompareAndSwapUint32(&itm.dataLen, old, v) {
+			return
+		}
+	}
+}
+
+func (itm *Item) len() uint32 {
+	return atomic.LoadUint32(&itm.dataLen) & itemLenMask
+}
+
+// IsDeleted returns true if the item has been deleted
+func (itm *Item) IsDeleted() bool {
+	return itm.DeadSn() != 0
+}
+
 // ItemSize returns total bytes consumed by item representation
 func ItemSize(p unsafe.Pointer) int {
 	itm := (*Item)(p)
-	return int(itemHeaderSize + uintptr(itm.dataLen))
+	return int(itemHeaderSize + uintptr(itm.len()))
 }
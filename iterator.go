@@ -11,32 +11,138 @@ package nitro
 
 import (
 	"github.com/t3rm1n4l/nitro/skiplist"
+	"math"
+	"sync"
 	"unsafe"
 )
 
+// skipSeekThreshold is the number of consecutive invisible items skipped one
+// by one before the iterator seeks over the remaining versions of a key
+const skipSeekThreshold = 16
+
 // Iterator implements Nitro snapshot iterator
+// Every key is yielded at most once, as the version visible to the snapshot.
+// Superseded versions are skipped, seeking past them once a run of invisible
+// versions exceeds skipSeekThreshold.
 type Iterator struct {
 	count       int
 	refreshRate int
 
-	snap *Snapshot
-	iter *skiplist.Iterator
+	snap   *Snapshot
+	iter   *skiplist.Iterator
+	state  *iterState
+	closed bool
+	raw    bool
+}
+
+// iterState holds the store iterator and the action buffer of an Iterator
+// The states of the closed iterators are recycled through iterPool. The
+// Iterator itself is not recycled, since Close() may be called again on a
+// closed iterator after its state has been handed to another iterator.
+type iterState struct {
+	iter skiplist.Iterator
 	buf  *skiplist.ActionBuffer
 }
 
+// poolIterators can be turned off by benchmarks to compare the pool against
+// allocating the state of every iterator
+var poolIterators = true
+
+var iterPool = sync.Pool{
+	New: func() interface{} {
+		return new(iterState)
+	},
+}
+
+func newIterState(store *skiplist.Skiplist) *iterState {
+	if !poolIterators {
+		return &iterState{buf: store.MakeBuf()}
+	}
+
+	st := iterPool.Get().(*iterState)
+	if st.buf == nil {
+		st.buf = store.MakeBuf()
+	}
+	return st
+}
+
+// open positions the store iterator of the state on a store
+func (st *iterState) open(store *skiplist.Skiplist, cmp skiplist.CompareFn) *skiplist.Iterator {
+	st.iter = *store.NewIterator(cmp, st.buf)
+	return &st.iter
+}
+
+// free resets the state, so that no node or barrier session of the closed
+// iterator leaks into the next iterator, and recycles it
+func (st *iterState) free(store *skiplist.Skiplist) {
+	st.iter = skiplist.Iterator{}
+	if !poolIterators {
+		store.FreeBuf(st.buf)
+		return
+	}
+
+	st.buf.Reset()
+	iterPool.Put(st)
+}
+
+// visible returns true if the item is visible to the snapshot
+func (it *Iterator) visible(itm *Item) bool {
+	return it.raw || (itm.bornSn <= it.snap.sn && (itm.deadSn == 0 || itm.deadSn > it.snap.sn))
+}
+
+// skipUnwanted moves the iterator to the next item visible to the snapshot
+// Items added after the snapshot and items deleted before the snapshot, which
+// have not been garbage collected yet, are skipped. Hence, the cost of moving
+// the iterator is linear in the number of invisible items in the way. A long
+// run of invisible versions of a single key, as left behind by frequent
+// updates of the key, is skipped using lookups in the store. But a long run
+// of distinct invisible keys, such as a deleted key range held by an old
+// snapshot or keys added after the snapshot, is still skipped one by one.
 func (it *Iterator) skipUnwanted() {
+	var skipped int
 loop:
-	if !it.iter.Valid() {
+	if it.raw || !it.iter.Valid() {
 		return
 	}
 	itm := (*Item)(it.iter.Get())
-	if itm.bornSn > it.snap.sn || (itm.deadSn > 0 && itm.deadSn <= it.snap.sn) {
-		it.iter.Next()
+	if !it.visible(itm) {
+		if skipped++; skipped < skipSeekThreshold {
+			it.iter.Next()
+		} else {
+			it.skipVersions(itm)
+			skipped = 0
+		}
 		it.count++
 		goto loop
 	}
 }
 
+// skipVersions moves the iterator from an invisible version of a key to the
+// version of the key visible to the snapshot or to the next key
+// The versions of a key are ordered by bornSn and they have non-overlapping
+// lifetimes. Hence, only the latest version born before the snapshot can be
+// visible and no version after it is visible.
+func (it *Iterator) skipVersions(itm *Item) {
+	db := it.snap.db
+	target := db.newItem(itm.Bytes(), false)
+	if itm.bornSn <= it.snap.sn {
+		target.bornSn = it.snap.sn + 1
+		if it.iter.SeekPrevWithCmp(unsafe.Pointer(target), db.insCmp) {
+			curr := (*Item)(it.iter.Get())
+			if db.keyCmp(curr.Bytes(), target.Bytes()) == 0 && it.visible(curr) {
+				return
+			}
+		}
+	}
+
+	target.bornSn = math.MaxUint32
+	if it.iter.SeekPrevWithCmp(unsafe.Pointer(target), db.insCmp) {
+		it.iter.Next()
+	} else {
+		it.iter.SeekFirst()
+	}
+}
+
 // SeekFirst moves cursor to the beginning
 func (it *Iterator) SeekFirst() {
 	it.iter.SeekFirst()
@@ -46,21 +152,118 @@ func (it *Iterator) SeekFirst() {
 // Seek to a specified key or the next bigger one if an item with key does not
 // exist.
 func (it *Iterator) Seek(bs []byte) {
-	itm := it.snap.db.newItem(bs, false)
-	it.iter.Seek(unsafe.Pointer(itm))
+	it.snap.db.seekKey(it.iter, bs)
 	it.skipUnwanted()
 }
 
+// SeekGT moves cursor to the first item whose key is strictly greater than
+// the specified key. It is useful for exclusive range starts and for resuming
+// a scan after the last key seen.
+func (it *Iterator) SeekGT(bs []byte) {
+	if it.SeekExact(bs) {
+		// Only one version of a key is visible. Next skips the remaining
+		// versions of the key.
+		it.Next()
+	}
+}
+
+// SeekExact is same as Seek(). Additionally it returns true only if the
+// iterator is positioned at an item whose key is equal to the specified key.
+// Otherwise, the iterator is positioned at the next bigger item, if any.
+func (it *Iterator) SeekExact(bs []byte) bool {
+	it.Seek(bs)
+	return it.Valid() && it.snap.db.keyCmp(it.Get(), bs) == 0
+}
+
+// SeekForPrev moves cursor to the item with the specified key or the largest
+// item with a smaller key if an item with the key does not exist. The
+// iterator becomes invalid if there is no such item.
+// Since the store has no backward links, every invisible version skipped
+// while moving backwards costs a lookup in the store.
+func (it *Iterator) SeekForPrev(bs []byte) {
+	if it.SeekExact(bs) {
+		return
+	}
+
+	// The versions of a key are ordered by bornSn. A target with zero bornSn
+	// is smaller than all the versions of the key.
+	target := it.prevTarget(bs)
+	for target != nil && it.iter.SeekPrevWithCmp(unsafe.Pointer(target), it.snap.db.insCmp) {
+		itm := (*Item)(it.iter.Get())
+		if it.visible(itm) {
+			return
+		}
+		target = itm
+	}
+}
+
+// prevTarget returns a lookup item which is ordered after all the items
+// smaller than the key and before the remaining items. A lookup item cannot
+// hold a key longer than MaxItemLen. The first stored key equal to or bigger
+// than such a key is used instead, or the last stored key if there is no bigger key.
+// It returns nil if the store is empty.
+func (it *Iterator) prevTarget(bs []byte) *Item {
+	db := it.snap.db
+	if len(bs) <= MaxItemLen {
+		return db.newItem(bs, false)
+	}
+
+	var last *Item
+	for it.iter.SeekFirst(); it.iter.Valid(); it.iter.Next() {
+		itm := (*Item)(it.iter.Get())
+		if db.keyCmp(itm.Bytes(), bs) >= 0 {
+			return db.newItem(itm.Bytes(), false)
+		}
+		last = itm
+	}
+
+	if last == nil {
+		return nil
+	}
+
+	target := db.newItem(last.Bytes(), false)
+	target.bornSn = math.MaxUint32
+	return target
+}
+
 // Valid eturns false when the iterator has reached the end.
+// A closed iterator is never valid, as its state is returned to the pool.
 func (it *Iterator) Valid() bool {
-	return it.iter.Valid()
+	return !it.closed && it.iter.Valid()
 }
 
 // Get eturns the current item data from the iterator.
+// The returned slice aliases the item stored in the snapshot. It is the same
+// as GetValueUnsafe().
 func (it *Iterator) Get() []byte {
 	return (*Item)(it.iter.Get()).Bytes()
 }
 
+// GetValueUnsafe returns the current item data from the iterator without
+// copying it. The returned slice aliases the bytes stored in Nitro.
+//
+// The caller must not modify the slice, as the item is shared with all the
+// snapshots and the other readers, and a modification can break the sort
+// order of the store. The slice must not be used after the iterator has been
+// closed, since the item may be freed by the garbage collector once the
+// snapshots which can see it are closed. With memory management enabled, the
+// item memory is reused for other items. Use GetValue() to retain the data.
+func (it *Iterator) GetValueUnsafe() []byte {
+	return (*Item)(it.iter.Get()).Bytes()
+}
+
+// GetValue returns a copy of the current item data from the iterator
+// The copy can be modified and retained after the iterator is closed.
+func (it *Iterator) GetValue() []byte {
+	bs := (*Item)(it.iter.Get()).Bytes()
+	return append(make([]byte, 0, len(bs)), bs...)
+}
+
+// GetItem returns the current item from the iterator.
+func (it *Iterator) GetItem() *Item {
+	return (*Item)(it.iter.Get())
+}
+
 // GetNode eturns the current skiplist node which holds current item.
 func (it *Iterator) GetNode() *skiplist.Node {
 	return it.iter.GetNode()
@@ -80,12 +283,22 @@ func (it *Iterator) Next() {
 // Refresh is a helper API to call refresh accessor tokens manually
 // This would enable SMR to reclaim objects faster if an iterator is
 // alive for a longer duration of time.
+//
+// The cursor is restored to the exact version it was positioned on. Seeking
+// by key alone would land on the oldest version of the key and the iterator
+// would yield the key a second time once it moved past it.
 func (it *Iterator) Refresh() {
 	if it.Valid() {
-		itm := it.snap.db.ptrToItem(it.GetNode().Item())
+		db := it.snap.db
+		itm := db.ptrToItem(it.GetNode().Item())
 		it.iter.Close()
-		it.iter = it.snap.db.store.NewIterator(it.snap.db.iterCmp, it.buf)
-		it.iter.Seek(unsafe.Pointer(itm))
+		it.iter = it.state.open(it.snap.store, db.iterCmp)
+		if it.iter.SeekPrevWithCmp(unsafe.Pointer(itm), db.insCmp) {
+			it.iter.Next()
+		} else {
+			it.iter.SeekFirst()
+		}
+		it.skipUnwanted()
 	}
 }
 
@@ -97,21 +310,46 @@ func (it *Iterator) SetRefreshRate(rate int) {
 }
 
 // Close executes destructor for iterator
+// Calling Close more than once has no effect.
 func (it *Iterator) Close() {
+	if it.closed {
+		return
+	}
+
+	it.closed = true
 	it.snap.Close()
-	it.snap.db.store.FreeBuf(it.buf)
 	it.iter.Close()
+	it.state.free(it.snap.store)
+	it.iter = nil
+	it.state = nil
 }
 
 // NewIterator creates an iterator for a Nitro snapshot
+// It returns nil if the snapshot has already been destroyed.
 func (m *Nitro) NewIterator(snap *Snapshot) *Iterator {
 	if !snap.Open() {
 		return nil
 	}
-	buf := snap.db.store.MakeBuf()
+	st := newIterState(snap.store)
 	return &Iterator{
-		snap: snap,
-		iter: m.store.NewIterator(m.iterCmp, buf),
-		buf:  buf,
+		snap:  snap,
+		iter:  st.open(snap.store, m.iterCmp),
+		state: st,
 	}
 }
+
+// NewRawIterator creates a diagnostic iterator for a Nitro snapshot which
+// yields every item in the store, including the items which are not visible
+// to the snapshot such as deleted items and items added after the snapshot.
+// The version metadata of the items can be inspected using GetItem().
+// Items are removed from the store by the garbage collector only after all
+// the snapshots which can see them have been closed.
+// It returns nil if the snapshot has already been destroyed.
+func (m *Nitro) NewRawIterator(snap *Snapshot) *Iterator {
+	it := m.NewIterator(snap)
+	if it != nil {
+		it.raw = true
+	}
+
+	return it
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"github.com/t3rm1n4l/nitro/skiplist"
+	"unsafe"
+)
+
+// Loader builds a Nitro store bottom-up from multiple sorted segments
+// without any comparisons with items in the store.
+// The items in each segment should be sorted by the key comparator and the
+// segments should hold non-overlapping key ranges in the order they were
+// added to the loader. Segments can be filled concurrently, but a segment
+// should be used by only one goroutine at a time.
+type Loader struct {
+	db       *Nitro
+	builder  *skiplist.Builder
+	segments []*LoaderSegment
+	// The items have been freed or handed over to a store
+	done bool
+}
+
+// LoaderSegment is a sorted segment of items of a Loader
+type LoaderSegment struct {
+	db          *Nitro
+	seg         *skiplist.Segment
+	first, last *Item
+	count       int64
+	err         error
+}
+
+// NewLoader creates a bulk loader for the Nitro instance
+func (m *Nitro) NewLoader() *Loader {
+	b := skiplist.NewBuilderWithConfig(m.newStoreConfig())
+	b.SetItemSizeFunc(ItemSize)
+	return &Loader{db: m, builder: b}
+}
+
+// AddSegment adds a new segment after all the existing segments
+// The segment should hold keys bigger than the keys in the previous segments.
+func (l *Loader) AddSegment() *LoaderSegment {
+	s := &LoaderSegment{db: l.db, seg: l.builder.NewSegment()}
+	l.segments = append(l.segments, s)
+	return s
+}
+
+// AddSortedItems appends items to the segment
+// ErrNotSorted is returned if an item is not bigger than the previous item
+// in the segment. Once an error has been returned, the segment does not
+// accept any more items and the loader can only be aborted.
+func (s *LoaderSegment) AddSortedItems(items ...[]byte) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	for _, bs := range items {
+		if len(bs) > MaxItemLen {
+			s.err = ErrMaxItemSizeExceeded
+			return s.err
+		}
+
+		itm := s.db.newItem(bs, s.db.useMemoryMgmt)
+		if s.last != nil && s.db.keyCmp(s.last.Bytes(), itm.Bytes()) >= 0 {
+			s.db.freeItem(itm)
+			s.err = ErrNotSorted
+			return s.err
+		}
+
+		if s.first == nil {
+			s.first = itm
+		}
+		s.last = itm
+		s.count++
+		s.seg.Add(unsafe.Pointer(itm))
+	}
+
+	return nil
+}
+
+// Assemble links all the segments and returns the resulting store with the
+// number of items in it. The store can be installed into the Nitro instance
+// using SwapStore(). ErrNotSorted is returned if the segments are not sorted
+// or overlap, in which case the loader is aborted.
+func (l *Loader) Assemble() (*skiplist.Skiplist, int64, error) {
+	var prev *LoaderSegment
+	var count int64
+
+	for _, s := range l.segments {
+		if s.err != nil {
+			l.Abort()
+			return nil, 0, s.err
+		}
+
+		if s.first == nil {
+			continue
+		}
+
+		if prev != nil && l.db.keyCmp(prev.last.Bytes(), s.first.Bytes()) >= 0 {
+			l.Abort()
+			return nil, 0, ErrNotSorted
+		}
+
+		prev = s
+		count += s.count
+	}
+
+	l.done = true
+	return l.builder.Assemble(l.segmentList()...), count, nil
+}
+
+// Finish replaces the existing contents of the Nitro store with the items
+// of the loader and returns a snapshot of the new store.
+// If the segments are not sorted, ErrNotSorted is returned and the store
+// remains unchanged. ErrPendingWrites is returned and the loader is aborted if
+// a writer has modified the store after the latest snapshot.
+// The store is installed using SwapStore(). Hence, the existing snapshots
+// continue to read the old store until they are closed.
+// This is a thread-unsafe API and no writers should be active.
+func (l *Loader) Finish() (*Snapshot, error) {
+	m := l.db
+	if err := m.checkPendingWrites(); err != nil {
+		l.Abort()
+		return nil, err
+	}
+
+	store, count, err := l.Assemble()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.SwapStore(store, count)
+}
+
+// Abort frees all the items added to the loader
+// Once the loader has been assembled or aborted, it has no effect. Hence, it
+// can be deferred right after creating the loader.
+func (l *Loader) Abort() {
+	if l.done {
+		return
+	}
+
+	l.done = true
+	l.db.freeStore(l.builder.Assemble(l.segmentList()...))
+}
+
+func (l *Loader) segmentList() []*skiplist.Segment {
+	segments := make([]*skiplist.Segment, len(l.segments))
+	for i, s := range l.segments {
+		segments[i] = s.seg
+	}
+
+	return segments
+}
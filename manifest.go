@@ -0,0 +1,180 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const manifestFile = "manifest.json"
+
+// ErrInvalidManifest means a backup manifest is corrupted or it does not
+// match the files of the backup
+var ErrInvalidManifest = errors.New("Invalid backup manifest")
+
+// ShardInfo describes a file of a backup
+type ShardInfo struct {
+	// Path of the file relative to the backup directory
+	File     string `json:"file"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"`
+}
+
+// Manifest describes a backup created by StoreToDisk() from a snapshot
+// Readers in other processes can poll the manifest of a backup directory to
+// detect a new backup by comparing the snapshot numbers. The checksums of
+// the files are CRC32 (Castagnoli) checksums of their contents.
+type Manifest struct {
+	Sn         uint32      `json:"sn"`
+	ItemsCount int64       `json:"itemsCount"`
+	FileType   FileType    `json:"fileType"`
+	Shards     []ShardInfo `json:"shards"`
+	// Checksum of the manifest fields above
+	Checksum uint32 `json:"checksum"`
+}
+
+var crc32Table = crc32.MakeTable(crc32.Castagnoli)
+
+func (mf *Manifest) checksum() uint32 {
+	c := *mf
+	c.Checksum = 0
+	bs, _ := json.Marshal(c)
+	return crc32.Checksum(bs, crc32Table)
+}
+
+func fileChecksum(path string) (ShardInfo, error) {
+	var info ShardInfo
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return info, err
+	}
+	defer fd.Close()
+
+	h := crc32.New(crc32Table)
+	if info.Size, err = io.Copy(h, fd); err != nil {
+		return info, err
+	}
+	info.Checksum = h.Sum32()
+
+	return info, nil
+}
+
+// WriteManifest writes a manifest for the backup of the snapshot stored in
+// dir by StoreToDisk(). The data and delta files of the backup are listed in
+// the manifest along with their sizes and checksums. The snapshot may have
+// been closed already. The manifest is written to a temporary file, which is
+// renamed afterwards, so that readers never observe a partially written
+// manifest. The manifest is flushed to stable storage if UseFsync() is set.
+func (m *Nitro) WriteManifest(dir string, snap *Snapshot) error {
+	mf := Manifest{Sn: snap.sn, ItemsCount: snap.count, FileType: m.fileType}
+	for _, sub := range []string{"data", "delta"} {
+		subdir := filepath.Join(dir, sub)
+		bs, err := ioutil.ReadFile(filepath.Join(subdir, "files.json"))
+		if err != nil {
+			if sub == "delta" && os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		fm, err := m.decodeManifest(bs)
+		if err != nil {
+			return err
+		}
+
+		if sub == "data" {
+			mf.FileType = fm.FileType
+		}
+
+		for _, file := range fm.Files {
+			info, err := fileChecksum(filepath.Join(subdir, file))
+			if err != nil {
+				return err
+			}
+
+			info.File = filepath.Join(sub, file)
+			mf.Shards = append(mf.Shards, info)
+		}
+	}
+
+	mf.Checksum = mf.checksum()
+	bs, err := json.Marshal(mf)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, manifestFile)
+	if err := ioutil.WriteFile(path+".tmp", bs, m.manifestPerm()); err != nil {
+		return err
+	}
+
+	if m.useFsync {
+		if err := m.syncPath(path + ".tmp"); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	if m.useFsync {
+		return m.syncPath(dir)
+	}
+
+	return nil
+}
+
+// ReadManifest reads the manifest of a backup directory written by
+// WriteManifest(). ErrInvalidManifest is returned if the manifest does not
+// match its checksum.
+func ReadManifest(dir string) (Manifest, error) {
+	var mf Manifest
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return mf, err
+	}
+
+	if err := json.Unmarshal(bs, &mf); err != nil {
+		return mf, err
+	}
+
+	if mf.Checksum != mf.checksum() {
+		return mf, ErrInvalidManifest
+	}
+
+	return mf, nil
+}
+
+// Verify checks that the files of the backup in dir match the sizes and the
+// checksums recorded in the manifest. ErrInvalidManifest is returned on a
+// mismatch.
+func (mf *Manifest) Verify(dir string) error {
+	for _, shard := range mf.Shards {
+		info, err := fileChecksum(filepath.Join(dir, shard.File))
+		if err != nil {
+			return err
+		}
+
+		if info.Size != shard.Size || info.Checksum != shard.Checksum {
+			return ErrInvalidManifest
+		}
+	}
+
+	return nil
+}
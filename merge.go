@@ -0,0 +1,370 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"container/heap"
+	"github.com/t3rm1n4l/nitro/skiplist"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// mergeStream is a sorted stream of items from a backup
+type mergeStream struct {
+	prio int
+	next func() (*Item, error)
+	curr *Item
+}
+
+type mergeHeap struct {
+	streams []*mergeStream
+	keyCmp  KeyCompare
+}
+
+func (h *mergeHeap) Len() int { return len(h.streams) }
+
+// Less orders streams by the current key. For equal keys, the stream with
+// the highest priority comes first.
+func (h *mergeHeap) Less(i, j int) bool {
+	x, y := h.streams[i], h.streams[j]
+	if v := h.keyCmp(x.curr.Bytes(), y.curr.Bytes()); v != 0 {
+		return v < 0
+	}
+	return x.prio > y.prio
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.streams[i], h.streams[j] = h.streams[j], h.streams[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	h.streams = append(h.streams, x.(*mergeStream))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	n := len(h.streams)
+	s := h.streams[n-1]
+	h.streams = h.streams[:n-1]
+	return s
+}
+
+// openBackupStreams returns the item streams of a backup directory
+// The data files of a backup form a single sorted stream. Delta files are
+// not sorted and they are sorted in memory.
+func (m *Nitro) openBackupStreams(dir string, prio int) ([]*mergeStream, []FileReader, error) {
+	var readers []FileReader
+
+	datadir := filepath.Join(dir, "data")
+	bs, err := ioutil.ReadFile(filepath.Join(datadir, "files.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mf, err := m.decodeManifest(bs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, file := range mf.Files {
+		r := m.newFileReader(mf.FileType)
+		if err := r.Open(filepath.Join(datadir, file)); err != nil {
+			return nil, readers, err
+		}
+		readers = append(readers, r)
+	}
+
+	dataReaders := readers
+	streams := []*mergeStream{{
+		prio: prio,
+		next: func() (*Item, error) {
+			for len(dataReaders) > 0 {
+				itm, err := dataReaders[0].ReadItem()
+				if err != nil || itm != nil {
+					return itm, err
+				}
+				dataReaders = dataReaders[1:]
+			}
+			return nil, nil
+		},
+	}}
+
+	deltadir := filepath.Join(dir, "delta")
+	if bs, err := ioutil.ReadFile(filepath.Join(deltadir, "files.json")); err == nil {
+		mf, err := m.decodeManifest(bs)
+		if err != nil {
+			return nil, readers, err
+		}
+
+		var items []*Item
+		for _, file := range mf.Files {
+			r := m.newFileReader(mf.FileType)
+			if err := r.Open(filepath.Join(deltadir, file)); err != nil {
+				return nil, readers, err
+			}
+			readers = append(readers, r)
+
+			for {
+				itm, err := r.ReadItem()
+				if err != nil {
+					return nil, readers, err
+				}
+
+				if itm == nil {
+					break
+				}
+				items = append(items, itm)
+			}
+		}
+
+		sort.Slice(items, func(i, j int) bool {
+			return m.keyCmp(items[i].Bytes(), items[j].Bytes()) < 0
+		})
+
+		streams = append(streams, &mergeStream{
+			prio: prio,
+			next: func() (*Item, error) {
+				if len(items) == 0 {
+					return nil, nil
+				}
+				itm := items[0]
+				items = items[1:]
+				return itm, nil
+			},
+		})
+	}
+
+	return streams, readers, nil
+}
+
+// MergeBackups combines multiple backups created by StoreToDisk() into a
+// single backup in the out directory, which can be restored using
+// LoadFromDisk(). The backups are merged by streaming their sorted data files
+// without loading them into memory. Only the delta files of the backups are
+// held in memory.
+// Backups do not record snapshot numbers of items. When multiple backups hold
+// an item with the same key, the item from the backup which appears last in
+// dirs is retained. Hence, dirs should be ordered from the oldest to the
+// latest backup.
+// The backups should have been created using the default item encoding.
+func MergeBackups(dirs []string, out string, keyCmp KeyCompare) error {
+	cfg := DefaultConfig()
+	cfg.SetKeyComparator(keyCmp)
+
+	// The items are streamed from the backups into the output file. Hence,
+	// only the config is required to decode and encode the backup files, and
+	// the instance does not create a store or start any workers.
+	m := &Nitro{Config: cfg}
+
+	var readers []FileReader
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+
+	h := &mergeHeap{keyCmp: keyCmp}
+	for i, dir := range dirs {
+		streams, rs, err := m.openBackupStreams(dir, i)
+		readers = append(readers, rs...)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range streams {
+			if s.curr, err = s.next(); err != nil {
+				return err
+			}
+
+			if s.curr != nil {
+				h.streams = append(h.streams, s)
+			}
+		}
+	}
+	heap.Init(h)
+
+	datadir := filepath.Join(out, "data")
+	if err := os.MkdirAll(datadir, m.backupDirPerm()); err != nil {
+		return err
+	}
+
+	file := "shard-0"
+	w := m.newFileWriter(m.fileType)
+	if err := w.Open(filepath.Join(datadir, file)); err != nil {
+		return err
+	}
+
+	err := func() error {
+		var last *Item
+		for h.Len() > 0 {
+			s := h.streams[0]
+			if last == nil || keyCmp(last.Bytes(), s.curr.Bytes()) != 0 {
+				if err := w.WriteItem(s.curr); err != nil {
+					return err
+				}
+				last = s.curr
+			}
+
+			var err error
+			if s.curr, err = s.next(); err != nil {
+				return err
+			}
+
+			if s.curr == nil {
+				heap.Pop(h)
+			} else {
+				heap.Fix(h, 0)
+			}
+		}
+
+		return nil
+	}()
+
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	bs := m.encodeManifest([]string{file})
+	return ioutil.WriteFile(filepath.Join(datadir, "files.json"), bs, m.manifestPerm())
+}
+
+// putOverlay adds an item and replaces an existing item with the same key
+// An existing identical item is retained if identical puts are skipped.
+func (w *Writer) putOverlay(bs []byte) *skiplist.Node {
+	inserted, n, err := w.PutStatus(bs)
+	if !inserted && n == nil && err == nil {
+		w.Delete(bs)
+		_, n, _ = w.PutStatus(bs)
+	}
+
+	return n
+}
+
+// mergeItem adds an item loaded from a backup along with its flags
+// An identical item retained by putOverlay() may be visible to the existing
+// snapshots. Its flags are not modified and a new version of the item is
+// inserted instead if the flags differ.
+func (w *Writer) mergeItem(itm *Item) *skiplist.Node {
+	bs := itm.Bytes()
+	n := w.putOverlay(bs)
+	if n == nil {
+		return nil
+	}
+
+	if x := (*Item)(n.Item()); x.Flags() != itm.Flags() && x.bornSn != w.getCurrSn() {
+		w.Delete(bs)
+		_, n, _ = w.PutStatus(bs)
+		if n == nil {
+			return nil
+		}
+	}
+
+	(*Item)(n.Item()).SetFlags(itm.Flags())
+	return n
+}
+
+// MergeFromDisk loads a backup created by StoreToDisk() into the existing
+// store instead of replacing it. The items of the backup are added using
+// Put() and they replace the existing items with the same keys, as the
+// loaded items are the latest writes. The replaced items remain visible to
+// the existing snapshots. The data and delta files are loaded concurrently
+// using concurr workers and a snapshot including the loaded items is
+// returned. It is slower than LoadFromDisk(), as the items are not assembled
+// from sorted data files.
+// This is a thread-unsafe API and no writers should be active, as required by
+// NewSnapshot().
+func (m *Nitro) MergeFromDisk(dir string, concurr int, callb ItemCallback) (*Snapshot, error) {
+	var paths []string
+	var types []FileType
+
+	for _, sub := range []string{"data", "delta"} {
+		subdir := filepath.Join(dir, sub)
+		bs, err := ioutil.ReadFile(filepath.Join(subdir, "files.json"))
+		if err != nil {
+			if sub == "delta" && os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		mf, err := m.decodeManifest(bs)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range m.nonEmptyFiles(subdir, mf.Files, mf.FileType) {
+			paths = append(paths, filepath.Join(subdir, file))
+			types = append(types, mf.FileType)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wchan := make(chan int)
+	errors := make([]error, len(paths))
+	for i := 0; i < concurr; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			w := m.newWriter()
+			defer w.store.FreeBuf(w.buf)
+			for id := range wchan {
+				errors[id] = func() (err error) {
+					defer func() {
+						if r := recover(); r != nil {
+							err = panicError(r)
+						}
+					}()
+
+					r := m.newFileReader(types[id])
+					if err := r.Open(paths[id]); err != nil {
+						return err
+					}
+					defer r.Close()
+
+					for {
+						itm, err := r.ReadItem()
+						if err != nil || itm == nil {
+							return err
+						}
+
+						n := w.mergeItem(itm)
+						if n != nil {
+							if callb != nil {
+								callb(&ItemEntry{itm: (*Item)(n.Item()), n: n})
+							}
+						}
+						m.freeItem(itm)
+					}
+				}()
+			}
+		}()
+	}
+
+	for id := range paths {
+		wchan <- id
+	}
+	close(wchan)
+	wg.Wait()
+
+	for _, err := range errors {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m.NewSnapshot()
+}
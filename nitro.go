@@ -7,22 +7,32 @@
 // either express or implied. See the License for the specific language governing permissions
 // and limitations under the License.
 
+// Package nitro implements a lock-free in-memory key-value item storage engine.
+//
+// Concurrency model:
+// A Writer must only be used by a single goroutine at a time. Concurrent use of
+// a Writer is detected and results in a panic. Any number of writers may be
+// created, from any goroutine, and used in parallel.
+// Snapshots and iterators are safe to use concurrently with writers. Each
+// goroutine sharing a snapshot should Open() it and create its own iterator.
+// NewSnapshot() must not be called concurrently with Put*() and Delete*().
 package nitro
 
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"github.com/t3rm1n4l/nitro/mm"
 	"github.com/t3rm1n4l/nitro/skiplist"
 	"io"
 	"io/ioutil"
+	"log"
 	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -34,11 +44,41 @@ var (
 	ErrMaxSnapshotsLimitReached = fmt.Errorf("Maximum snapshots limit reached")
 	// ErrShutdown means an operation on a shutdown Nitro instance
 	ErrShutdown = fmt.Errorf("Nitro instance has been shutdown")
+	// ErrDBClosed is the same as ErrShutdown
+	ErrDBClosed = ErrShutdown
+	// ErrSnapshotClosed means an operation on a snapshot which has been destroyed
+	ErrSnapshotClosed = fmt.Errorf("Snapshot has been closed")
+	// ErrNotSorted means that items were not provided in sorted order
+	ErrNotSorted = fmt.Errorf("Items are not in sorted order")
+	// ErrInvalidConfig means that a Nitro instance cannot be created with a config
+	ErrInvalidConfig = fmt.Errorf("Invalid configuration")
+	// ErrSnapshotInUse means that a snapshot is still open
+	ErrSnapshotInUse = fmt.Errorf("Snapshot is in use")
+	// ErrPendingWrites means that writers have changes which are not captured by a snapshot
+	ErrPendingWrites = fmt.Errorf("Writers have changes not captured by a snapshot")
+	// ErrMaxItemSizeExceeded means that an item is larger than the configured max item size
+	ErrMaxItemSizeExceeded = fmt.Errorf("Item exceeds the maximum item size")
+	// ErrNewerSnapshotOpen means that a snapshot newer than a snapshot is still open
+	ErrNewerSnapshotOpen = fmt.Errorf("A newer snapshot is open")
+	// ErrOlderSnapshotOpen means that a snapshot older than a snapshot is still open
+	ErrOlderSnapshotOpen = fmt.Errorf("An older snapshot is open")
+	// ErrStoreReplaced means that a snapshot belongs to a store which has been replaced
+	ErrStoreReplaced = fmt.Errorf("Snapshot belongs to a replaced store")
+	// ErrInvalidPivot means that a pivot item for the snapshot visitor is nil
+	ErrInvalidPivot = fmt.Errorf("Invalid pivot item")
+	// ErrQuotaExceeded means that an item does not fit in the memory quota
+	ErrQuotaExceeded = fmt.Errorf("Memory quota exceeded")
 )
 
+// ItemCompare implements comparator for Nitro items
+type ItemCompare func(this, that *Item) int
+
 // KeyCompare implements item data key comparator
 type KeyCompare func([]byte, []byte) int
 
+// ItemEqual reports whether two items with the same key hold the same value
+type ItemEqual func(this, that *Item) bool
+
 // VisitorCallback implements  Nitro snapshot visitor callback
 type VisitorCallback func(*Item, int) error
 
@@ -61,14 +101,43 @@ func (e *ItemEntry) Node() *skiplist.Node {
 // ItemCallback implements callback used for backup file to Nitro restore API
 type ItemCallback func(*ItemEntry)
 
+// StoreProgressCallback implements callback used for reporting StoreToDisk progress
+// It receives the number of items and bytes written so far across all shards.
+type StoreProgressCallback func(itemsWritten, bytesWritten int64)
+
+// LoadProgressCallback implements callback used for reporting LoadFromDisk
+// progress. It receives the number of items loaded and the number of data
+// files completed so far.
+type LoadProgressCallback func(itemsLoaded int64, shardsLoaded int)
+
+// SnapshotClosedCallback is invoked with the snapshot number of a snapshot
+// once it is no longer referenced.
+type SnapshotClosedCallback func(sn uint32)
+
+// MemoryPressureCallback is invoked with the memory used by the Nitro instance
+// when it crosses the high watermark (high is true) and when it drops below
+// the low watermark afterwards (high is false).
+type MemoryPressureCallback func(high bool, memInUse int64)
+
 const (
-	defaultRefreshRate = 10000
-	gcchanBufSize      = 256
+	defaultRefreshRate    = 10000
+	defaultProgressPeriod = 10000
+	gcchanBufSize         = 256
+	memSamplePeriod       = 100 * time.Millisecond
+
+	defaultDirPerm      os.FileMode = 0755
+	defaultShardPerm    os.FileMode = 0755
+	defaultManifestPerm os.FileMode = 0660
 )
 
+// SnapshotEncodeSize is the size of the encoded snapshot metadata
+const SnapshotEncodeSize = 4
+
 var (
 	dbInstances      *skiplist.Skiplist
 	dbInstancesCount int64
+	// Prevents the instances from being closed while their stats are read
+	dbInstancesLock sync.RWMutex
 )
 
 func init() {
@@ -87,19 +156,29 @@ func CompareNitro(this unsafe.Pointer, that unsafe.Pointer) int {
 func DefaultConfig() Config {
 	var cfg Config
 	cfg.SetKeyComparator(defaultKeyCmp)
+	cfg.customKeyCmp = false
 	cfg.fileType = RawdbFile
 	cfg.useMemoryMgmt = false
 	cfg.refreshRate = defaultRefreshRate
+	cfg.gcChanSize = gcchanBufSize
 	return cfg
 }
 
+// newInsertCompare orders items by key and the versions of a key by
+// ascending bornSn. The version ordering does not depend on the direction of
+// the key comparator and GetNode() relies on it to find the latest version.
 func newInsertCompare(keyCmp KeyCompare) skiplist.CompareFn {
 	return func(this, that unsafe.Pointer) int {
 		var v int
 		thisItem := (*Item)(this)
 		thatItem := (*Item)(that)
 		if v = keyCmp(thisItem.Bytes(), thatItem.Bytes()); v == 0 {
-			v = int(thisItem.bornSn) - int(thatItem.bornSn)
+			switch {
+			case thisItem.bornSn < thatItem.bornSn:
+				v = -1
+			case thisItem.bornSn > thatItem.bornSn:
+				v = 1
+			}
 		}
 
 		return v
@@ -114,6 +193,11 @@ func newIterCompare(keyCmp KeyCompare) skiplist.CompareFn {
 	}
 }
 
+// newExistCompare is the default comparator used to check whether an item
+// with the same key exists during Put(). Deleted items never compare equal to
+// any item, even if their keys are equal. Hence, a deleted key does not occupy
+// its slot and a Put() after a Delete() inserts a new version of the key. The
+// deleted version remains visible to older snapshots until it is collected.
 func newExistCompare(keyCmp KeyCompare) skiplist.CompareFn {
 	return func(this, that unsafe.Pointer) int {
 		thisItem := (*Item)(this)
@@ -154,18 +238,32 @@ func (ctx *deltaWrContext) Init() {
 // Writer provides a handle for concurrent access
 // Nitro writer is thread-unsafe and should initialize separate Nitro writers
 // to perform concurrent writes from multiple threads.
+// Using a writer from multiple goroutines at the same time causes a panic.
 type Writer struct {
 	dwrCtx deltaWrContext // Used for cooperative disk snapshotting
+	busy   int32
 
 	rand   *rand.Rand
 	buf    *skiplist.ActionBuffer
 	gchead *skiplist.Node
 	gctail *skiplist.Node
 	next   *Writer
+	// Writers modified since the latest snapshot are linked in m.dirtyWriters
+	dirty     bool
+	nextDirty *Writer
 	// Local skiplist stats for writer, gcworker and freeworker
 	slSts1, slSts2, slSts3 skiplist.Stats
 	resSts                 restoreStats
-	count                  int64
+	// Items added minus items deleted by the writer since the latest snapshot
+	// It is updated without atomics and NewSnapshot() publishes it to the
+	// instance. Hence, writers do not contend on a shared counter.
+	count int64
+	// Writers of the secondary indexes
+	idxWriters []*Writer
+	// Memory for the items added by the writer
+	slab []byte
+	// The writer is idle in the writer pool
+	pooled bool
 
 	*Nitro
 }
@@ -194,25 +292,178 @@ func (w *Writer) doDeltaWrite(itm *Item) {
 	}
 }
 
+func (w *Writer) acquire() {
+	if !atomic.CompareAndSwapInt32(&w.busy, 0, 1) {
+		panic("nitro: concurrent use of a writer")
+	}
+}
+
+func (w *Writer) release() {
+	atomic.StoreInt32(&w.busy, 0)
+}
+
+// markDirty adds the writer to the list of writers whose gclist and stats
+// are to be collected by the next snapshot. A writer is added only once
+// between snapshots.
+func (w *Writer) markDirty() {
+	if w.dirty {
+		return
+	}
+
+	w.dirty = true
+	for {
+		head := atomic.LoadPointer(&w.dirtyWriters)
+		w.nextDirty = (*Writer)(head)
+		if atomic.CompareAndSwapPointer(&w.dirtyWriters, head, unsafe.Pointer(w)) {
+			return
+		}
+	}
+}
+
 // Put implements insert of an item into Intro
-// Put fails if an item already exists
-func (w *Writer) Put(bs []byte) {
-	w.Put2(bs)
+// Put fails if an item already exists, unless the existing item was added
+// after the latest snapshot. Such an item is not visible to any snapshot and
+// it is replaced. ErrMaxItemSizeExceeded is returned without modifying the
+// store if the item is longer than the max item size set using
+// Config.SetMaxItemSize() or MaxItemLen.
+func (w *Writer) Put(bs []byte) error {
+	_, _, err := w.PutStatus(bs)
+	return err
+}
+
+// PutChecked is same as Put()
+func (w *Writer) PutChecked(bs []byte) error {
+	return w.Put(bs)
+}
+
+// TryPut is same as PutStatus(), except that it does not block or grow the
+// memory beyond the memory quota set by Config.SetMemoryQuota(). If adding
+// the item could increase MemoryInUse() beyond the quota, the store is not
+// modified and ErrQuotaExceeded is returned. The memory of the item is
+// estimated using the largest skiplist node, since the level of the node is
+// chosen during the insert. The check uses the running memory counters and
+// writers which insert concurrently may exceed the quota by an item each.
+// ErrMaxItemSizeExceeded is returned if the item is longer than the max item
+// size. Otherwise, it returns whether the item has been inserted.
+func (w *Writer) TryPut(bs []byte) (bool, error) {
+	if w.tooLarge(bs) {
+		return false, ErrMaxItemSizeExceeded
+	}
+
+	if w.memQuota > 0 {
+		sz := int64(itemHeaderSize) + int64(len(bs)) + int64(skiplist.NodeSize(w.store.MaxLevel))
+		if w.MemoryInUse()+sz > w.memQuota {
+			return false, ErrQuotaExceeded
+		}
+	}
+
+	inserted, _, err := w.PutStatus(bs)
+	return inserted, err
+}
+
+func (w *Writer) tooLarge(bs []byte) bool {
+	return len(bs) > MaxItemLen || (w.maxItemSize > 0 && len(bs) > w.maxItemSize)
+}
+
+// sameValue returns true if the item data holds the same value as the
+// existing item with the same key
+func (m *Nitro) sameValue(itm *Item, bs []byte) bool {
+	if m.valueEqual == nil {
+		return bytes.Equal(itm.Bytes(), bs)
+	}
+
+	return m.valueEqual(itm, m.newItem(bs, false))
 }
 
 // Put2 returns the skiplist node of the item if Put() succeeds
+// It returns nil if the item is rejected.
 func (w *Writer) Put2(bs []byte) (n *skiplist.Node) {
-	var success bool
-	x := w.newItem(bs, w.useMemoryMgmt)
+	_, n, _ = w.PutStatus(bs)
+	return
+}
+
+// PutStatus is same as Put(). Additionally it reports whether the item was
+// inserted along with its skiplist node.
+// If a live item with the same key was added in the current snapshot number,
+// it is replaced by the new item and inserted is true. If a live item with
+// the same key was added in an earlier snapshot number, the store is not
+// modified and inserted is false with a nil node. To replace such an item,
+// it should be deleted before calling PutStatus(). An item longer than the
+// max item size is not inserted and ErrMaxItemSizeExceeded is returned. If
+// identical puts are skipped, inserted is false with the node of the existing
+// item for an item identical to it.
+func (w *Writer) PutStatus(bs []byte) (inserted bool, n *skiplist.Node, err error) {
+	if w.tooLarge(bs) {
+		return false, nil, ErrMaxItemSizeExceeded
+	}
+
+	w.acquire()
+	defer w.release()
+
+	// The nodes found by lookups are accessed in a barrier session, since
+	// other writers may delete and free them concurrently
+	barrier := w.store.GetAccesBarrier()
+	if w.skipIdenticalPuts {
+		token := barrier.Acquire()
+		old := w.getNode(bs)
+		identical := old != nil && w.sameValue((*Item)(old.Item()), bs)
+		barrier.Release(token)
+		if identical {
+			return false, old, nil
+		}
+	}
+
+	w.markDirty()
+	x := w.newStoreItem(bs)
 	x.bornSn = w.getCurrSn()
-	n, success = w.store.Insert2(unsafe.Pointer(x), w.insCmp, w.existCmp, w.buf,
-		w.rand.Float32, &w.slSts1)
-	if success {
-		w.count++
-	} else {
+	for {
+		n, inserted = w.store.Insert2(unsafe.Pointer(x), w.insCmp, w.existCmp, w.buf,
+			w.rand.Float32, &w.slSts1)
+		if inserted {
+			w.count++
+			if len(w.indexes) > 0 {
+				w.indexPut(x)
+			}
+			return
+		}
+
+		token := barrier.Acquire()
+		old := w.getNode(bs)
+		replaced := old != nil && (*Item)(old.Item()).bornSn == x.bornSn && w.deleteNode(old)
+		barrier.Release(token)
+		if replaced {
+			continue
+		}
+
 		w.freeItem(x)
+		return
 	}
-	return
+}
+
+// PutInPlace is same as Put(). If a live item with the same key was added
+// in the current snapshot number and it has the same length as the new item,
+// its data is overwritten in place without inserting a new skiplist node.
+// Such an item is not visible to any snapshot. Hence, repeated overwrites of
+// a key between snapshots do not grow the store. Otherwise, it falls back to
+// Put(). Other writers should not concurrently access the same key, as they
+// may observe a partially updated item. Items are never overwritten in place
+// if secondary indexes are configured.
+func (w *Writer) PutInPlace(bs []byte) (n *skiplist.Node) {
+	w.acquire()
+	barrier := w.store.GetAccesBarrier()
+	token := barrier.Acquire()
+	if n = w.getNode(bs); n != nil && len(w.indexes) == 0 {
+		if itm := (*Item)(n.Item()); itm.bornSn == w.getCurrSn() && int(itm.len()) == len(bs) {
+			copy(itm.Bytes(), bs)
+			barrier.Release(token)
+			w.release()
+			return n
+		}
+	}
+	barrier.Release(token)
+	w.release()
+
+	return w.Put2(bs)
 }
 
 // Delete an item
@@ -224,8 +475,16 @@ func (w *Writer) Delete(bs []byte) (success bool) {
 
 // Delete2 is same as Delete(). Additionally returns the deleted item's node
 func (w *Writer) Delete2(bs []byte) (n *skiplist.Node, success bool) {
-	if n := w.GetNode(bs); n != nil {
-		return n, w.DeleteNode(n)
+	w.acquire()
+	defer w.release()
+
+	// Another writer may delete and free the node concurrently
+	barrier := w.store.GetAccesBarrier()
+	token := barrier.Acquire()
+	defer barrier.Release(token)
+
+	if n := w.getNode(bs); n != nil {
+		return n, w.deleteNode(n)
 	}
 
 	return nil, false
@@ -234,25 +493,45 @@ func (w *Writer) Delete2(bs []byte) (n *skiplist.Node, success bool) {
 // DeleteNode deletes an item by specifying its skiplist Node.
 // Using this API can avoid a O(logn) lookup during Delete().
 func (w *Writer) DeleteNode(x *skiplist.Node) (success bool) {
+	w.acquire()
+	defer w.release()
+
+	return w.deleteNode(x)
+}
+
+func (w *Writer) deleteNode(x *skiplist.Node) (success bool) {
 	defer func() {
 		if success {
 			w.count--
 		}
 	}()
 
-	x.GClink = nil
+	w.markDirty()
 	sn := w.getCurrSn()
 	gotItem := (*Item)(x.Item())
+	// Only the writer which succeeds in deleting the node owns its GClink.
+	// The node may be deleted by another writer concurrently.
 	if gotItem.bornSn == sn {
-		success = w.store.DeleteNode(x, w.insCmp, w.buf, &w.slSts1)
+		if success = w.store.DeleteNode(x, w.insCmp, w.buf, &w.slSts1); success {
+			if len(w.indexes) > 0 {
+				w.indexDelete(gotItem)
+			}
 
-		barrier := w.store.GetAccesBarrier()
-		barrier.FlushSession(unsafe.Pointer(x))
+			x.GClink = nil
+			barrier := w.store.GetAccesBarrier()
+			barrier.FlushSession(unsafe.Pointer(x))
+		}
 		return
 	}
 
 	success = atomic.CompareAndSwapUint32(&gotItem.deadSn, 0, sn)
 	if success {
+		if len(w.indexes) > 0 {
+			w.indexDelete(gotItem)
+		}
+
+		x.GClink = nil
+
 		if w.gctail == nil {
 			w.gctail = x
 			w.gchead = w.gctail
@@ -264,15 +543,97 @@ func (w *Writer) DeleteNode(x *skiplist.Node) (success bool) {
 	return
 }
 
+// DeleteCurrent deletes the item at which the iterator is positioned and
+// moves the iterator to the next item. It avoids a lookup by key when items
+// are deleted while scanning a snapshot. The deleted item remains visible to
+// the snapshots created before the delete, but the iterator does not return
+// to it. It returns false if the iterator is not valid or the item has
+// already been deleted.
+func (w *Writer) DeleteCurrent(it *Iterator) (success bool) {
+	if !it.Valid() {
+		return false
+	}
+
+	w.acquire()
+	success = w.deleteNode(it.GetNode())
+	w.release()
+
+	it.Next()
+	return
+}
+
+// PurgeRange deletes all the live items with keys in the range [start, end)
+// and returns the number of items deleted. A nil start or end leaves the
+// range unbounded on that side. The items are found using a single scan of
+// the store instead of a lookup per key and the deleted items form a single
+// contiguous batch in the gclist of the next snapshot.
+// Snapshots created before the purge continue to see the items until they
+// are closed. The items are reclaimed by the garbage collector afterwards.
+func (w *Writer) PurgeRange(start, end []byte) (count int) {
+	w.acquire()
+	defer w.release()
+
+	buf := w.store.MakeBuf()
+	defer w.store.FreeBuf(buf)
+	iter := w.store.NewIterator(w.iterCmp, buf)
+	defer iter.Close()
+
+	if start == nil {
+		iter.SeekFirst()
+	} else {
+		w.seekKey(iter, start)
+	}
+
+	for ; iter.Valid(); iter.Next() {
+		itm := (*Item)(iter.Get())
+		if end != nil && w.keyCmp(itm.Bytes(), end) >= 0 {
+			break
+		}
+
+		if atomic.LoadUint32(&itm.deadSn) == 0 && w.deleteNode(iter.GetNode()) {
+			count++
+		}
+	}
+
+	return
+}
+
 // GetNode implements lookup of an item and return its skiplist Node
 // This API enables to lookup an item without using a snapshot handle.
+// The lookup lands on the latest version of the key directly. Hence, its
+// cost does not depend on the number of versions of the key retained for
+// the snapshots.
 func (w *Writer) GetNode(bs []byte) *skiplist.Node {
+	w.acquire()
+	defer w.release()
+
+	return w.getNode(bs)
+}
+
+func (w *Writer) getNode(bs []byte) *skiplist.Node {
 	iter := w.store.NewIterator(w.iterCmp, w.buf)
 	defer iter.Close()
 
+	if len(bs) > MaxItemLen {
+		// Only the latest version of the key can be live
+		var n *skiplist.Node
+		for w.seekKey(iter, bs); iter.Valid() && w.keyCmp((*Item)(iter.Get()).Bytes(), bs) == 0; iter.Next() {
+			n = iter.GetNode()
+		}
+
+		if n != nil && atomic.LoadUint32(&(*Item)(n.Item()).deadSn) == 0 {
+			return n
+		}
+		return nil
+	}
+
 	x := w.newItem(bs, false)
 	x.bornSn = w.getCurrSn()
 
+	// The versions of a key are ordered by bornSn and no version is born
+	// after the current snapshot number. Hence, the latest version is either
+	// born in the current snapshot number and matches the target or it is
+	// the predecessor of the target. Only a live version matches existCmp.
 	if found := iter.SeekWithCmp(unsafe.Pointer(x), w.insCmp, w.existCmp); found {
 		return iter.GetNode()
 	}
@@ -280,32 +641,238 @@ func (w *Writer) GetNode(bs []byte) *skiplist.Node {
 	return nil
 }
 
+// seekKey moves the store iterator to the first version of the smallest key
+// which is equal to or bigger than bs. A lookup item cannot hold a key longer
+// than MaxItemLen. The store is scanned from the beginning for such a key, as
+// the key comparator may consider it equal to a shorter key.
+func (m *Nitro) seekKey(iter *skiplist.Iterator, bs []byte) {
+	if len(bs) <= MaxItemLen {
+		iter.Seek(unsafe.Pointer(m.newItem(bs, false)))
+		return
+	}
+
+	for iter.SeekFirst(); iter.Valid(); iter.Next() {
+		if m.keyCmp((*Item)(iter.Get()).Bytes(), bs) >= 0 {
+			return
+		}
+	}
+}
+
 // Config - Nitro instance configuration
 type Config struct {
-	keyCmp   KeyCompare
-	insCmp   skiplist.CompareFn
-	iterCmp  skiplist.CompareFn
-	existCmp skiplist.CompareFn
+	keyCmp     KeyCompare
+	insCmp     skiplist.CompareFn
+	iterCmp    skiplist.CompareFn
+	existCmp   skiplist.CompareFn
+	keyCmpName string
+	// customKeyCmp is set if the default key comparator is replaced
+	customKeyCmp bool
 
 	refreshRate int
 	fileType    FileType
+	dirPerm     os.FileMode
+	filePerm    os.FileMode
+
+	readerBufSize int
+	writerBufSize int
 
 	useMemoryMgmt bool
 	useDeltaFiles bool
-	mallocFun     skiplist.MallocFn
-	freeFun       skiplist.FreeFn
+	useSyncGC     bool
+
+	useLoadValidation bool
+	useFsync          bool
+	loadRetries       int
+	loadProgressCallb LoadProgressCallback
+	gcWorkers         int
+	gcChanSize        int
+	mallocFun         skiplist.MallocFn
+	freeFun           skiplist.FreeFn
+
+	progressCallb  StoreProgressCallback
+	progressPeriod int
+
+	maxBackupConcurr int
+	leakThreshold    time.Duration
+	deadSnapsLimit   int64
+	snapClosedCallb  SnapshotClosedCallback
+	memLowWatermark  int64
+	memHighWatermark int64
+	memPressureCallb MemoryPressureCallback
+	memQuota         int64
+	bloomBitsPerKey  int
+	bloomKey         func([]byte) []byte
+
+	itemEncoder ItemEncoder
+	itemDecoder ItemDecoder
+
+	slMaxLevel    int
+	slProbability float32
+
+	maxItemSize       int
+	skipIdenticalPuts bool
+	valueEqual        ItemEqual
+	expectedItems     int
+
+	name      string
+	indexDefs []indexDef
+
+	frozen bool
+}
+
+// checkMutable panics if the config belongs to a Nitro instance.
+// NewWithConfig() copies the config. Modifying the original config afterwards
+// does not affect the instance and the config of the instance cannot be
+// modified once it has been created.
+func (cfg *Config) checkMutable() {
+	if cfg.frozen {
+		panic("nitro: config cannot be modified after the instance is created")
+	}
+}
+
+// SetFileType configures the file format used for backups
+// ErrInvalidFileType is returned for an unsupported file type. RawdbFileV2
+// should be used to persist the item flags. A backup is always restored using
+// the file format recorded in the backup.
+func (cfg *Config) SetFileType(t FileType) error {
+	cfg.checkMutable()
+	if !validFileType(t) {
+		return ErrInvalidFileType
+	}
+
+	cfg.fileType = t
+	return nil
+}
+
+// SetMaxItemSize limits the length of the items added by writers
+// Items longer than size bytes are rejected by Put() and its variants without
+// modifying the store. PutChecked() reports the rejection as an error. Zero
+// means that the item length is only limited by MaxItemLen, which is the
+// default. Items longer than MaxItemLen are always rejected.
+func (cfg *Config) SetMaxItemSize(size int) {
+	cfg.checkMutable()
+	cfg.maxItemSize = size
+}
+
+// SetSkipIdenticalPuts makes Put() and its variants skip an item which is
+// identical to the live item with the same key. Items are identical if their
+// data is byte-identical, unless SetValueEqual() overrides the check. The
+// existing node is returned and no new version or gclist entry is created. Hence, replaying
+// idempotent writes does not cause version churn, at the cost of a lookup
+// and a comparison per Put(). MergeFromDisk() skips identical items as well,
+// instead of replacing them.
+func (cfg *Config) SetSkipIdenticalPuts(skip bool) {
+	cfg.checkMutable()
+	cfg.skipIdenticalPuts = skip
+}
+
+// SetValueEqual overrides the check whether an item holds the same value as
+// the existing item with the same key. It is invoked only for items with
+// equal keys, for example to skip identical puts. By default, items are
+// identical only if their data is byte-identical. A custom check may ignore
+// parts of the item data such as a timestamp.
+func (cfg *Config) SetValueEqual(eq ItemEqual) {
+	cfg.checkMutable()
+	cfg.valueEqual = eq
+}
+
+// SetExpectedItemCount hints the number of items which are going to be added
+// to the store, such as by a bulk insert. If memory management is not used,
+// writers allocate the items from slabs which hold up to n items instead of
+// allocating every item separately, which reduces the allocations and the
+// garbage collection work of the Go runtime. A slab is freed only after all
+// its items have been garbage collected. Hence, a workload which deletes a
+// large fraction of the items while retaining a few may hold more memory.
+// Zero disables slab allocation, which is the default.
+func (cfg *Config) SetExpectedItemCount(n int) {
+	cfg.checkMutable()
+	cfg.expectedItems = n
+}
+
+// SetSkiplistMaxLevel limits the number of levels of the skiplist nodes of
+// the store. The default is skiplist.MaxLevel, which is also the upper limit.
+// A store with n items needs about log(n) levels with base 1/probability.
+// ErrInvalidConfig is returned if the level is not between 1 and
+// skiplist.MaxLevel.
+func (cfg *Config) SetSkiplistMaxLevel(level int) error {
+	cfg.checkMutable()
+	if level < 1 || level > skiplist.MaxLevel {
+		return fmt.Errorf("%w: skiplist max level %d is not between 1 and %d",
+			ErrInvalidConfig, level, skiplist.MaxLevel)
+	}
+
+	cfg.slMaxLevel = level
+	return nil
+}
+
+// SetSkiplistProbability configures the probability of a skiplist node of the
+// store to be promoted to the next level. The default is 0.25. A smaller
+// probability uses less memory for the node pointers at the cost of longer
+// searches. ErrInvalidConfig is returned if the probability is not between
+// 0.01 and 0.9.
+func (cfg *Config) SetSkiplistProbability(prob float32) error {
+	cfg.checkMutable()
+	if prob < 0.01 || prob > 0.9 {
+		return fmt.Errorf("%w: skiplist probability %v is not between 0.01 and 0.9",
+			ErrInvalidConfig, prob)
+	}
+
+	cfg.slProbability = prob
+	return nil
 }
 
 // SetKeyComparator provides key comparator for the Nitro item data
 func (cfg *Config) SetKeyComparator(cmp KeyCompare) {
+	cfg.checkMutable()
 	cfg.keyCmp = cmp
+	cfg.customKeyCmp = true
 	cfg.insCmp = newInsertCompare(cmp)
 	cfg.iterCmp = newIterCompare(cmp)
 	cfg.existCmp = newExistCompare(cmp)
 }
 
+// SetKeyComparatorName names the key comparator set by SetKeyComparator()
+// The name is recorded in the backups created by StoreToDisk(). The items of
+// a backup are ordered by the comparator of the instance which created it.
+// Hence, loading a backup into an instance whose comparator orders the items
+// differently results in a store in which lookups silently fail. Loading a
+// backup fails with ErrComparatorMismatch if both the backup and the instance
+// have a comparator name and the names differ. The names should identify the
+// ordering, such as by including a version if the comparator is changed.
+func (cfg *Config) SetKeyComparatorName(name string) {
+	cfg.checkMutable()
+	cfg.keyCmpName = name
+}
+
+// SetExistComparator overrides the comparator used to check whether an item
+// with the same key already exists during Put(). The comparator should return
+// 0 if the items occupy the same slot and it should be consistent with the
+// key comparator otherwise. By default, deleted items never compare equal, so
+// a deleted key can be added again. For example, a comparator which ignores
+// the deletion state treats a deleted key as still occupying its slot and a
+// Put() of the key fails until the deleted item is garbage collected.
+// SetKeyComparator() resets the exist comparator to the default. Hence, it
+// should be called after SetKeyComparator().
+func (cfg *Config) SetExistComparator(cmp ItemCompare) {
+	cfg.checkMutable()
+	cfg.existCmp = func(this, that unsafe.Pointer) int {
+		return cmp((*Item)(this), (*Item)(that))
+	}
+}
+
 // UseMemoryMgmt provides custom memory allocator for Nitro items storage
+// The allocator is used for the items and the skiplist nodes of the store,
+// which are kept out of the Go heap and freed explicitly once they have been
+// garbage collected. The functions are invoked concurrently by writers,
+// snapshot Close() and the collection workers. Hence, they should be thread
+// safe. The memory returned by malloc need not be zeroed, but it should be
+// 8-byte aligned and it should not be managed by the Go garbage collector.
+// The allocator should outlive the instance, since Close() frees all the
+// remaining items and nodes, including the ones of the stores replaced by
+// SwapStore() whose snapshots have not been collected yet. The option is
+// ignored on platforms other than amd64.
 func (cfg *Config) UseMemoryMgmt(malloc skiplist.MallocFn, free skiplist.FreeFn) {
+	cfg.checkMutable()
 	if runtime.GOARCH == "amd64" {
 		cfg.useMemoryMgmt = true
 		cfg.mallocFun = malloc
@@ -318,9 +885,266 @@ func (cfg *Config) UseMemoryMgmt(malloc skiplist.MallocFn, free skiplist.FreeFn)
 // eliminates the need for locking garbage collectable old snapshots. But, it may
 // use additional amount of disk space for backup.
 func (cfg *Config) UseDeltaInterleaving() {
+	cfg.checkMutable()
 	cfg.useDeltaFiles = true
 }
 
+// SetStoreProgressCallback enables progress reporting for StoreToDisk.
+// Each backup shard reports its progress once every `period` items and the
+// callback is invoked a final time after all items have been written.
+// The callback may be called concurrently from multiple shards. The period
+// also applies to the progress of backups and restores reported by
+// OperationStatus().
+func (cfg *Config) SetStoreProgressCallback(fn StoreProgressCallback, period int) {
+	cfg.checkMutable()
+	if period <= 0 {
+		period = defaultProgressPeriod
+	}
+
+	cfg.progressCallb = fn
+	cfg.progressPeriod = period
+}
+
+// progressBatch returns the number of items after which a backup shard or a
+// restored file publishes its progress
+func (cfg *Config) progressBatch() int64 {
+	if cfg.progressPeriod <= 0 {
+		return defaultProgressPeriod
+	}
+
+	return int64(cfg.progressPeriod)
+}
+
+// SetSnapshotClosedCallback configures a callback which is invoked when the
+// reference count of a snapshot drops to zero, before the snapshot is queued
+// for garbage collection. It is invoked exactly once for every snapshot from
+// the goroutine calling the final Close(). The callback receives only the
+// snapshot number and it does not delay the garbage collection beyond its
+// own execution.
+func (cfg *Config) SetSnapshotClosedCallback(fn SnapshotClosedCallback) {
+	cfg.checkMutable()
+	cfg.snapClosedCallb = fn
+}
+
+// SetGCWorkers configures the number of dedicated garbage collection workers
+// and the size of the queue of dead snapshots waiting for collection.
+// Every writer runs a collection worker and the dedicated workers are started
+// in addition to them when the Nitro instance is created. The workers collect
+// the snapshots from the queue concurrently, which improves reclamation
+// throughput for workloads with a large number of deletes. The dedicated
+// workers do not write delta files and they are paused while a backup with
+// delta interleaving is in progress. ErrInvalidConfig is returned if either
+// of the arguments is negative.
+func (cfg *Config) SetGCWorkers(workers int, queueSize int) error {
+	cfg.checkMutable()
+	if workers < 0 || queueSize < 0 {
+		return fmt.Errorf("%w: gc workers %d and queue size %d should not be negative",
+			ErrInvalidConfig, workers, queueSize)
+	}
+
+	cfg.gcWorkers = workers
+	cfg.gcChanSize = queueSize
+	return nil
+}
+
+// SetMaxBackupConcurrency limits the total number of concurrent backup
+// workers used by all StoreToDisk calls on the Nitro instance.
+// By default, each StoreToDisk call uses the requested concurrency.
+func (cfg *Config) SetMaxBackupConcurrency(n int) {
+	cfg.checkMutable()
+	cfg.maxBackupConcurr = n
+}
+
+// SetIOBufferSizes configures the buffer sizes of backup file readers and
+// writers. A size which is not positive selects DiskBlockSize, which is the
+// default. Items larger than the buffers are supported and larger buffers
+// reduce the number of system calls for backups with large items.
+func (cfg *Config) SetIOBufferSizes(readerSize, writerSize int) {
+	cfg.checkMutable()
+	cfg.readerBufSize = readerSize
+	cfg.writerBufSize = writerSize
+}
+
+// SetSnapshotLeakThreshold enables detection of leaked snapshots
+// A warning with the stack trace of snapshot creation is logged when a
+// snapshot has not been closed within the threshold duration. The snapshots
+// are checked every half of the threshold, but at most once a millisecond.
+func (cfg *Config) SetSnapshotLeakThreshold(d time.Duration) {
+	cfg.checkMutable()
+	cfg.leakThreshold = d
+}
+
+// SetDeadSnapshotsLimit enables a warning about closed snapshots piling up
+// A closed snapshot is garbage collected only after all the older snapshots
+// have been closed. Hence, a long-lived snapshot prevents the collection of
+// all the newer snapshots and the items they have replaced. Once more than
+// limit closed snapshots are awaiting garbage collection, a warning
+// identifying the oldest live snapshot, which blocks the collection, is
+// logged. Each blocking snapshot is reported only once.
+func (cfg *Config) SetDeadSnapshotsLimit(limit int) {
+	cfg.checkMutable()
+	cfg.deadSnapsLimit = int64(limit)
+}
+
+// SetName sets a label to identify the Nitro instance in instance listings
+// The name does not have to be unique.
+func (cfg *Config) SetName(name string) {
+	cfg.checkMutable()
+	cfg.name = name
+}
+
+// SetMemoryWatermarks configures a callback to be notified about memory
+// pressure. The memory used by the Nitro instance is sampled every 100ms in
+// the background. The callback is invoked once the memory in use reaches the
+// high watermark and it is not invoked again until the memory in use drops
+// to the low watermark or below. Hence, the transitions are always reported
+// in alternating order, starting with the high watermark. Memory changes
+// within a sampling period may not be observed.
+func (cfg *Config) SetMemoryWatermarks(low, high int64, fn MemoryPressureCallback) {
+	cfg.checkMutable()
+	cfg.memLowWatermark = low
+	cfg.memHighWatermark = high
+	cfg.memPressureCallb = fn
+}
+
+// SetMemoryQuota limits the memory in use for the items added by
+// Writer.TryPut(). Other writes are not limited by the quota. Zero means that
+// the memory is not limited, which is the default.
+func (cfg *Config) SetMemoryQuota(quota int64) {
+	cfg.checkMutable()
+	cfg.memQuota = quota
+}
+
+// SetLoadProgressCallback configures a callback to report LoadFromDisk
+// progress. The callback is invoked every time a data file has been loaded
+// completely. It may be called concurrently from multiple shards.
+func (cfg *Config) SetLoadProgressCallback(fn LoadProgressCallback) {
+	cfg.checkMutable()
+	cfg.loadProgressCallb = fn
+}
+
+// SetLoadRetries configures the number of times LoadFromDisk retries reading
+// a data file after a read error. The file is reopened and the load resumes
+// from the item at which the error occurred, without reading the other data
+// files again. Once the retries have been exhausted, a ShardLoadError is
+// returned. By default, read errors are not retried.
+func (cfg *Config) SetLoadRetries(n int) {
+	cfg.checkMutable()
+	cfg.loadRetries = n
+}
+
+// UseFsync enables flushing of the backup files to stable storage by
+// StoreToDisk. Each shard file, the manifest and the backup directories are
+// flushed once they have been written, so that a backup survives a crash.
+// By default, the files are left in the OS page cache and the backup is
+// faster.
+func (cfg *Config) UseFsync() {
+	cfg.checkMutable()
+	cfg.useFsync = true
+}
+
+// SetFilePerms configures the permissions used by StoreToDisk for the backup
+// directories and the files created inside them. The effective permissions
+// are subject to the process umask. By default, the directories and the
+// shard files are created with 0755 and the manifests with 0660. Zero keeps
+// the default permissions.
+func (cfg *Config) SetFilePerms(dirPerm, filePerm os.FileMode) {
+	cfg.checkMutable()
+	cfg.dirPerm = dirPerm
+	cfg.filePerm = filePerm
+}
+
+// backupDirPerm returns the permissions of the backup directories
+func (cfg *Config) backupDirPerm() os.FileMode {
+	if cfg.dirPerm != 0 {
+		return cfg.dirPerm
+	}
+
+	return defaultDirPerm
+}
+
+// shardFilePerm returns the permissions of the shard and delta files
+func (cfg *Config) shardFilePerm() os.FileMode {
+	if cfg.filePerm != 0 {
+		return cfg.filePerm
+	}
+
+	return defaultShardPerm
+}
+
+// manifestPerm returns the permissions of the backup manifests
+func (cfg *Config) manifestPerm() os.FileMode {
+	if cfg.filePerm != 0 {
+		return cfg.filePerm
+	}
+
+	return defaultManifestPerm
+}
+
+// UseSyncGC option disables the background collection workers. Dead items
+// are removed from the store and freed by the goroutine which runs the GC,
+// ie. during snapshot Close() or an explicit GC() call.
+// Delta interleaving requires collection workers and is not used with this
+// option.
+func (cfg *Config) UseSyncGC() {
+	cfg.checkMutable()
+	cfg.useSyncGC = true
+}
+
+// UseLoadValidation option enables LoadFromDisk to verify that the items
+// in the backup files are in sorted order. A backup with out of order items
+// would otherwise result in a corrupted store.
+func (cfg *Config) UseLoadValidation() {
+	cfg.checkMutable()
+	cfg.useLoadValidation = true
+}
+
+// ShardLoadError describes a failure to read a backup data file during
+// LoadFromDisk. ItemsLoaded is the number of items read from the file
+// before the failure.
+type ShardLoadError struct {
+	File        string
+	ItemsLoaded int64
+	Err         error
+}
+
+func (e *ShardLoadError) Error() string {
+	return fmt.Sprintf("Failed to read backup file %s after %d items: %v", e.File, e.ItemsLoaded, e.Err)
+}
+
+// Unwrap returns the underlying read error
+func (e *ShardLoadError) Unwrap() error {
+	return e.Err
+}
+
+// SortOrderError describes an out of order item found in a backup file
+type SortOrderError struct {
+	File     string
+	Position int
+}
+
+func (e *SortOrderError) Error() string {
+	return fmt.Sprintf("Item %d in backup file %s is out of order", e.Position, e.File)
+}
+
+// BackupStats describes the data files written by StoreToDisk2()
+// Delta files are not included.
+type BackupStats struct {
+	ItemsWritten int64
+	BytesWritten int64
+	ShardCount   int
+	Duration     time.Duration
+}
+
+// LoadStats describes the data files read by LoadFromDisk2()
+// Delta files are not included.
+type LoadStats struct {
+	ItemsRead  int64
+	BytesRead  int64
+	ShardCount int
+	Duration   time.Duration
+}
+
 type restoreStats struct {
 	DeltaRestored      uint64
 	DeltaRestoreFailed uint64
@@ -336,34 +1160,140 @@ type Nitro struct {
 	isGCRunning  int32
 	lastGCSn     uint32
 	leastUnrefSn uint32
+	deadSnaps    int64
 	itemsCount   int64
-
-	wlist    *Writer
-	gcchan   chan *skiplist.Node
-	freechan chan *skiplist.Node
-
+	// Item count changes of the writers returned to the writer pool since the
+	// latest snapshot
+	pooledCount int64
+	storeRef    *storeRef // Tracks GC of snapshots of the current store
+
+	wlist unsafe.Pointer // *Writer
+	// Writers modified since the latest snapshot
+	dirtyWriters unsafe.Pointer // *Writer
+	lastSnapshot unsafe.Pointer // *Snapshot
+	gcchan       chan *Snapshot
+	freechan     chan *skiplist.Node
+
+	backupSem chan struct{} // Limits concurrent StoreToDisk workers
+	leakStop  chan struct{}
+	memStop   chan struct{}
+	memDone   chan struct{}
+
+	// Flushes a file or a directory to stable storage
+	syncPath func(path string) error
+
+	closed      int32
 	hasShutdown bool
 	shutdownWg1 sync.WaitGroup // GC workers and StoreToDisk task
 	shutdownWg2 sync.WaitGroup // Free workers
 
+	// Held by the backups with delta files to pause the dedicated GC workers
+	gcPauseMu sync.RWMutex
+
+	// Snapshots whose gclists are being collected
+	gcPending map[uint32]struct{}
+	gcMu      sync.Mutex
+	gcCond    sync.Cond
+
+	indexes []*index
+
+	// Long running operations in progress
+	ops   []*operation
+	opsMu sync.Mutex
+
+	// Idle writers of the writer pool
+	idleWriters []*Writer
+	poolMu      sync.Mutex
+
+	// Stores replaced by SwapStore() which have not been freed yet
+	retiredStores []*storeRef
+	retireMu      sync.Mutex
+
 	Config
 	restoreStats
 }
 
+// validate checks whether the config can be used to create an instance
+func (cfg *Config) validate() error {
+	switch {
+	case cfg.keyCmp == nil:
+		return fmt.Errorf("%w: key comparator is not set", ErrInvalidConfig)
+	case cfg.insCmp == nil:
+		return fmt.Errorf("%w: insert comparator is not set", ErrInvalidConfig)
+	case cfg.iterCmp == nil:
+		return fmt.Errorf("%w: iterator comparator is not set", ErrInvalidConfig)
+	case cfg.existCmp == nil:
+		return fmt.Errorf("%w: exist comparator is not set", ErrInvalidConfig)
+	}
+
+	if !validFileType(cfg.fileType) {
+		return ErrInvalidFileType
+	}
+
+	return nil
+}
+
+// NewWithConfigChecked creates a new Nitro instance based on provided
+// configuration. An error wrapping ErrInvalidConfig is returned if the
+// comparators are not set and ErrInvalidFileType is returned for an
+// unsupported backup file type.
+func NewWithConfigChecked(cfg Config) (*Nitro, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return NewWithConfig(cfg), nil
+}
+
 // NewWithConfig creates a new Nitro instance based on provided configuration.
+// The configuration is not validated, NewWithConfigChecked() should be used
+// for a configuration which may be invalid.
 func NewWithConfig(cfg Config) *Nitro {
+	cfg.frozen = true
 	m := &Nitro{
 		snapshots:   skiplist.New(),
 		gcsnapshots: skiplist.New(),
 		currSn:      1,
 		Config:      cfg,
-		gcchan:      make(chan *skiplist.Node, gcchanBufSize),
+		gcchan:      make(chan *Snapshot, cfg.gcChanSize),
+		storeRef:    new(storeRef),
+		syncPath:    fsyncPath,
 		id:          int(atomic.AddInt64(&dbInstancesCount, 1)),
+		gcPending:   make(map[uint32]struct{}),
 	}
+	m.gcCond.L = &m.gcMu
 
 	m.freechan = make(chan *skiplist.Node, gcchanBufSize)
+	if cfg.maxBackupConcurr > 0 {
+		m.backupSem = make(chan struct{}, cfg.maxBackupConcurr)
+	}
 	m.store = skiplist.NewWithConfig(m.newStoreConfig())
 	m.initSizeFuns()
+	m.initIndexes()
+
+	if cfg.leakThreshold > 0 {
+		m.leakStop = make(chan struct{})
+		go m.leakDetector()
+	}
+
+	if cfg.memPressureCallb != nil {
+		m.memStop = make(chan struct{})
+		m.memDone = make(chan struct{})
+		go m.memoryMonitor()
+	}
+
+	if !cfg.useSyncGC {
+		for i := 0; i < cfg.gcWorkers; i++ {
+			m.shutdownWg1.Add(1)
+			go m.gcWorker()
+			if m.useMemoryMgmt {
+				var sts skiplist.Stats
+				sts.IsLocal(true)
+				m.shutdownWg2.Add(1)
+				go m.freeWorker(&sts)
+			}
+		}
+	}
 
 	buf := dbInstances.MakeBuf()
 	defer dbInstances.FreeBuf(buf)
@@ -375,6 +1305,14 @@ func NewWithConfig(cfg Config) *Nitro {
 
 func (m *Nitro) newStoreConfig() skiplist.Config {
 	slCfg := skiplist.DefaultConfig()
+	if m.slMaxLevel > 0 {
+		slCfg.MaxLevel = m.slMaxLevel
+	}
+
+	if m.slProbability > 0 {
+		slCfg.Probability = m.slProbability
+	}
+
 	if m.useMemoryMgmt {
 		slCfg.UseMemoryMgmt = true
 		slCfg.Malloc = m.mallocFun
@@ -390,7 +1328,13 @@ func (m *Nitro) newBSDestructor() skiplist.BarrierSessionDestructor {
 		// If gclist is not empty
 		if ref != nil {
 			freelist := (*skiplist.Node)(ref)
-			m.freechan <- freelist
+			if m.useSyncGC {
+				var sts skiplist.Stats
+				sts.IsLocal(true)
+				m.freeNodeList(freelist, &sts)
+			} else {
+				m.freechan <- freelist
+			}
 		}
 	}
 }
@@ -406,20 +1350,71 @@ func New() *Nitro {
 	return NewWithConfig(DefaultConfig())
 }
 
-// MemoryInUse returns total memory used by the Nitro instance.
-func (m *Nitro) MemoryInUse() int64 {
-	storeStats := m.aggrStoreStats()
-	return storeStats.Memory + m.snapshots.MemoryInUse() + m.gcsnapshots.MemoryInUse()
+// ID returns the id of the Nitro instance, which is unique in the current
+// process. The ids are assigned in the order of creation of the instances.
+func (m *Nitro) ID() int {
+	return m.id
 }
 
-// Close shuts down the nitro instance
-func (m *Nitro) Close() {
-	// Wait until all snapshot iterators have finished
-	for s := m.snapshots.GetStats(); int(s.NodeCount) != 0; s = m.snapshots.GetStats() {
-		time.Sleep(time.Millisecond)
+// Name returns the name of the Nitro instance set using Config.SetName()
+func (m *Nitro) Name() string {
+	return m.name
+}
+
+// Store returns the skiplist which holds all the versions of the items
+// It is an escape hatch for advanced read-only operations which are not
+// provided by Nitro, such as custom traversals and range splits. The
+// skiplist nodes hold *Item values, including the versions which are not
+// visible to any snapshot. Their visibility should be checked using
+// BornSn() and DeadSn().
+// The skiplist must not be modified directly. Such changes bypass the item
+// counts, the snapshot isolation and the garbage collection of Nitro and can
+// corrupt the store. An item should not be accessed after the snapshots which
+// can see it have been closed, as it may have been freed. LoadFromDisk(),
+// Loader and SwapStore() replace the store and the returned skiplist should
+// not be used afterwards.
+func (m *Nitro) Store() *skiplist.Skiplist {
+	return m.store
+}
+
+// IterCompare returns the skiplist comparator which orders the items of the
+// store by key
+func (m *Nitro) IterCompare() skiplist.CompareFn {
+	return m.iterCmp
+}
+
+// InsertCompare returns the skiplist comparator which orders the items of the
+// store by key and the versions of a key by ascending BornSn()
+func (m *Nitro) InsertCompare() skiplist.CompareFn {
+	return m.insCmp
+}
+
+// MemoryInUse returns total memory used by the Nitro instance.
+func (m *Nitro) MemoryInUse() int64 {
+	return m.store.MemoryInUse() + m.snapshots.MemoryInUse() + m.gcsnapshots.MemoryInUse()
+}
+
+// Close shuts down the nitro instance
+// Calling Close more than once has no effect.
+func (m *Nitro) Close() {
+	if !atomic.CompareAndSwapInt32(&m.closed, 0, 1) {
+		return
+	}
+
+	// Wait until all snapshot iterators have finished
+	for s := m.snapshots.GetStats(); int(s.NodeCount) != 0; s = m.snapshots.GetStats() {
+		time.Sleep(time.Millisecond)
 	}
 
 	m.hasShutdown = true
+	if m.leakStop != nil {
+		close(m.leakStop)
+	}
+
+	if m.memStop != nil {
+		close(m.memStop)
+		<-m.memDone
+	}
 
 	// Acquire gc chan ownership
 	// This will make sure that no other goroutine will write to gcchan
@@ -428,40 +1423,69 @@ func (m *Nitro) Close() {
 	}
 	close(m.gcchan)
 
+	dbInstancesLock.Lock()
 	buf := dbInstances.MakeBuf()
-	defer dbInstances.FreeBuf(buf)
 	dbInstances.Delete(unsafe.Pointer(m), CompareNitro, buf, &dbInstances.Stats)
+	dbInstances.FreeBuf(buf)
+	dbInstancesLock.Unlock()
 
 	if m.useMemoryMgmt {
-		buf := m.snapshots.MakeBuf()
-		defer m.snapshots.FreeBuf(buf)
-
 		m.shutdownWg1.Wait()
 		close(m.freechan)
 		m.shutdownWg2.Wait()
 
 		// Manually free up all nodes
-		iter := m.store.NewIterator(m.iterCmp, buf)
-		defer iter.Close()
-		var lastNode *skiplist.Node
+		m.freeStore(m.store)
+		for _, ref := range m.retiredStores {
+			m.freeStore(ref.store)
+		}
+		m.retiredStores = nil
+	}
+
+	m.closeIndexes()
+}
+
+// freeStore deallocates all the items and nodes of a store
+func (m *Nitro) freeStore(store *skiplist.Skiplist) {
+	buf := store.MakeBuf()
+	defer store.FreeBuf(buf)
+
+	iter := store.NewIterator(m.iterCmp, buf)
+	defer iter.Close()
+	var lastNode *skiplist.Node
+
+	iter.SeekFirst()
+	if iter.Valid() {
+		lastNode = iter.GetNode()
+		iter.Next()
+	}
+
+	for lastNode != nil {
+		m.freeItem((*Item)(lastNode.Item()))
+		store.FreeNode(lastNode, &store.Stats)
+		lastNode = nil
 
-		iter.SeekFirst()
 		if iter.Valid() {
 			lastNode = iter.GetNode()
 			iter.Next()
 		}
+	}
+}
 
-		for lastNode != nil {
-			m.freeItem((*Item)(lastNode.Item()))
-			m.store.FreeNode(lastNode, &m.store.Stats)
-			lastNode = nil
+// getWriters returns the head of the list of writers
+// Writers are only ever prepended to the list and it can be safely traversed
+// while new writers are being created.
+func (m *Nitro) getWriters() *Writer {
+	return (*Writer)(atomic.LoadPointer(&m.wlist))
+}
 
-			if iter.Valid() {
-				lastNode = iter.GetNode()
-				iter.Next()
-			}
-		}
-	}
+// CurrentSn returns the current snapshot number
+// The items written after the latest snapshot are born at the current
+// snapshot number. NewSnapshot() creates a snapshot with the current number
+// and increments it by one. Hence, GetAsOf() with the current number returns
+// the latest writes, including the ones not captured by a snapshot yet.
+func (m *Nitro) CurrentSn() uint32 {
+	return m.getCurrSn()
 }
 
 func (m *Nitro) getCurrSn() uint32 {
@@ -484,20 +1508,94 @@ func (m *Nitro) newWriter() *Writer {
 // NewWriter creates a Nitro writer
 func (m *Nitro) NewWriter() *Writer {
 	w := m.newWriter()
-	w.next = m.wlist
-	m.wlist = w
 	w.dwrCtx.Init()
+	for {
+		head := atomic.LoadPointer(&m.wlist)
+		w.next = (*Writer)(head)
+		if atomic.CompareAndSwapPointer(&m.wlist, head, unsafe.Pointer(w)) {
+			break
+		}
+	}
 
-	m.shutdownWg1.Add(1)
-	go m.collectionWorker(w)
-	if m.useMemoryMgmt {
-		m.shutdownWg2.Add(1)
-		go m.freeWorker(w)
+	if !m.useSyncGC {
+		m.shutdownWg1.Add(1)
+		go m.collectionWorker(w)
+		if m.useMemoryMgmt {
+			m.shutdownWg2.Add(1)
+			go m.freeWorker(&w.slSts3)
+		}
 	}
 
 	return w
 }
 
+// GetWriter borrows a writer from the writer pool of the instance
+// A writer is created if the pool does not have an idle writer. Writers are
+// never destroyed until the instance is closed. Hence, borrowing writers for
+// short lived tasks, such as requests, avoids creating a writer per task. The
+// writer should be returned to the pool using PutWriter() once the task is
+// done and it should not be used afterwards.
+func (m *Nitro) GetWriter() *Writer {
+	m.poolMu.Lock()
+	defer m.poolMu.Unlock()
+
+	if n := len(m.idleWriters); n > 0 {
+		w := m.idleWriters[n-1]
+		m.idleWriters[n-1] = nil
+		m.idleWriters = m.idleWriters[:n-1]
+		w.pooled = false
+		return w
+	}
+
+	return m.NewWriter()
+}
+
+// PutWriter returns a writer borrowed using GetWriter() to the pool
+// The writer should not be in use by any goroutine. Its skiplist stats and
+// item count are published to the instance and its buffers are reset, so
+// that the next borrower starts with a clean writer. The item count and the
+// deleted items of the writer are captured by the next snapshot, as for any
+// idle writer. Hence, the writer does not have to be flushed and a writer
+// created using NewWriter() may be added to the pool as well. Like the other
+// writer operations, it should not run concurrently with NewSnapshot().
+// It panics if the writer belongs to another instance, if it is still in use
+// or if it is already in the pool.
+func (m *Nitro) PutWriter(w *Writer) {
+	if w.Nitro != m {
+		panic("nitro: writer belongs to another instance")
+	}
+
+	m.poolMu.Lock()
+	defer m.poolMu.Unlock()
+
+	if w.pooled {
+		panic("nitro: writer returned to the pool twice")
+	}
+
+	if !atomic.CompareAndSwapInt32(&w.busy, 0, 1) {
+		panic("nitro: writer returned to the pool while in use")
+	}
+	w.resetPooled()
+	w.release()
+
+	w.pooled = true
+	m.idleWriters = append(m.idleWriters, w)
+}
+
+// resetPooled publishes the stats and the item count of a writer returned to
+// the pool and drops the node references held by its buffers. The gclist of
+// the writer remains pending until the next snapshot captures it.
+func (w *Writer) resetPooled() {
+	w.store.Stats.Merge(&w.slSts1)
+	atomic.AddInt64(&w.pooledCount, w.count)
+	w.count = 0
+	w.buf.Reset()
+
+	for _, iw := range w.idxWriters {
+		iw.resetPooled()
+	}
+}
+
 // Snapshot describes Nitro immutable snapshot
 type Snapshot struct {
 	sn       uint32
@@ -505,7 +1603,21 @@ type Snapshot struct {
 	db       *Nitro
 	count    int64
 
-	gclist *skiplist.Node
+	store    *skiplist.Skiplist
+	gclist   *skiplist.Node
+	storeRef *storeRef
+	bloom    unsafe.Pointer // *bloomFilter
+
+	created time.Time
+
+	// Used for leak detection
+	stack        []byte
+	leakReported bool
+
+	blockReported int32
+
+	// Snapshots of the secondary indexes
+	indexSnaps []*Snapshot
 }
 
 // SnapshotSize returns the memory used by Nitro snapshot metadata
@@ -516,15 +1628,51 @@ func SnapshotSize(p unsafe.Pointer) int {
 }
 
 // Count returns the number of items in the Nitro snapshot
+// The count is captured from the item count of the Nitro instance when the
+// snapshot is created and it is not affected by later mutations. It is exact
+// only if NewSnapshot() is not called concurrently with writers, as required
+// by NewSnapshot(). Otherwise it should be treated as approximate.
 func (s Snapshot) Count() int64 {
 	return s.count
 }
 
+// ApproxCount returns the number of items visible to a snapshot without
+// scanning it, such as to show the total for a paginated scan. The count of
+// the snapshot is maintained using the per-writer counts of added and deleted
+// items, which are published to the instance when a snapshot is created, so
+// no traversal of the store is required. It is exact if NewSnapshot() is not
+// called concurrently with writers. Otherwise, it is off by at most the
+// number of Put() and Delete() calls which were running concurrently with
+// NewSnapshot(). Scan the snapshot using an iterator for an exact count.
+func (m *Nitro) ApproxCount(snap *Snapshot) int64 {
+	return snap.Count()
+}
+
+// Created returns the time at which the snapshot was created
+func (s *Snapshot) Created() time.Time {
+	return s.created
+}
+
+// RefCount returns the number of references held on the snapshot
+// It returns zero once the snapshot has been destroyed.
+func (s *Snapshot) RefCount() int {
+	return int(atomic.LoadInt32(&s.refCount))
+}
+
+// IsLive returns true if the snapshot has not been destroyed yet
+// The result may be stale as soon as it is returned since another goroutine
+// may close the last reference concurrently. It is meant for best effort
+// decisions. Use Open to hold a reference that keeps the snapshot alive.
+func (s *Snapshot) IsLive() bool {
+	return atomic.LoadInt32(&s.refCount) > 0
+}
+
 // Encode implements Binary encoder for snapshot metadata
+// The buffer should have at least SnapshotEncodeSize bytes and
+// ErrNotEnoughSpace is returned otherwise.
 func (s *Snapshot) Encode(buf []byte, w io.Writer) error {
-	l := 4
-	if len(buf) < l {
-		return errNotEnoughSpace
+	if len(buf) < SnapshotEncodeSize {
+		return ErrNotEnoughSpace
 	}
 
 	binary.BigEndian.PutUint32(buf[0:4], s.sn)
@@ -533,11 +1681,16 @@ func (s *Snapshot) Encode(buf []byte, w io.Writer) error {
 	}
 
 	return nil
-
 }
 
 // Decode implements binary decoder for snapshot metadata
+// The buffer should have at least SnapshotEncodeSize bytes and
+// ErrNotEnoughSpace is returned otherwise.
 func (s *Snapshot) Decode(buf []byte, r io.Reader) error {
+	if len(buf) < SnapshotEncodeSize {
+		return ErrNotEnoughSpace
+	}
+
 	if _, err := io.ReadFull(r, buf[0:4]); err != nil {
 		return err
 	}
@@ -549,34 +1702,120 @@ func (s *Snapshot) Decode(buf []byte, r io.Reader) error {
 // When snapshots are shared by multiple threads, each thread should Open the
 // snapshot. This API internally tracks the reference count for the snapshot.
 func (s *Snapshot) Open() bool {
-	if atomic.LoadInt32(&s.refCount) == 0 {
-		return false
+	for {
+		refCount := atomic.LoadInt32(&s.refCount)
+		if refCount <= 0 {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt32(&s.refCount, refCount, refCount+1) {
+			return true
+		}
 	}
-	atomic.AddInt32(&s.refCount, 1)
-	return true
+}
+
+// Acquire is same as Open(). It returns ErrSnapshotClosed if the snapshot
+// has already been destroyed.
+func (s *Snapshot) Acquire() error {
+	if !s.Open() {
+		return ErrSnapshotClosed
+	}
+
+	return nil
 }
 
 // Close is the snapshot descructor
 // Once a thread has finished using a snapshot, it can be destroyed by calling
 // Close(). Internal garbage collector takes care of freeing the items.
+// Closing a snapshot which has already been destroyed has no effect.
 func (s *Snapshot) Close() {
-	newRefcount := atomic.AddInt32(&s.refCount, -1)
+	var newRefcount int32
+	for {
+		refCount := atomic.LoadInt32(&s.refCount)
+		if refCount <= 0 {
+			return
+		}
+
+		newRefcount = refCount - 1
+		if atomic.CompareAndSwapInt32(&s.refCount, refCount, newRefcount) {
+			break
+		}
+	}
+
 	if newRefcount == 0 {
+		if s.db.snapClosedCallb != nil {
+			s.db.snapClosedCallb(s.sn)
+		}
+
+		for _, isnap := range s.indexSnaps {
+			isnap.Close()
+		}
+
 		buf := s.db.snapshots.MakeBuf()
 		defer s.db.snapshots.FreeBuf(buf)
 
 		// Move from live snapshot list to dead list
 		s.db.snapshots.Delete(unsafe.Pointer(s), CompareSnapshot, buf, &s.db.snapshots.Stats)
 		s.db.gcsnapshots.Insert(unsafe.Pointer(s), CompareSnapshot, buf, &s.db.gcsnapshots.Stats)
+		deadSnaps := atomic.AddInt64(&s.db.deadSnaps, 1)
 		s.db.GC()
+
+		if s.db.deadSnapsLimit > 0 && deadSnaps > s.db.deadSnapsLimit {
+			s.db.reportGCBlocker()
+		}
 	}
 }
 
 // NewIterator creates a new snapshot iterator
+// It returns nil if the snapshot has already been destroyed.
 func (s *Snapshot) NewIterator() *Iterator {
 	return s.db.NewIterator(s)
 }
 
+// Get returns the item with the specified key which is visible to the
+// snapshot. It returns nil if the item does not exist or the snapshot has
+// already been destroyed. The item is valid as long as the snapshot is open.
+// If bloom filters are enabled, the filter of the snapshot is consulted
+// before the store and the lookup is skipped for items which are definitely
+// missing.
+func (s *Snapshot) Get(bs []byte) *Item {
+	if !s.db.MightContain(s, bs) {
+		return nil
+	}
+
+	itr := s.NewIterator()
+	if itr == nil {
+		return nil
+	}
+	defer itr.Close()
+
+	if !itr.SeekExact(bs) {
+		return nil
+	}
+
+	return itr.GetItem()
+}
+
+// WithIterator creates an iterator for the snapshot and invokes the callback
+// with it. The iterator is closed once the callback returns, even if it panics.
+// A panic in the callback is returned as an error. ErrSnapshotClosed is
+// returned if the snapshot has already been destroyed.
+func (s *Snapshot) WithIterator(fn func(it *Iterator) error) (err error) {
+	it := s.NewIterator()
+	if it == nil {
+		return ErrSnapshotClosed
+	}
+
+	defer func() {
+		it.Close()
+		if r := recover(); r != nil {
+			err = panicError(r)
+		}
+	}()
+
+	return fn(it)
+}
+
 // CompareSnapshot implements comparator for snapshots based on snapshot number
 func CompareSnapshot(this, that unsafe.Pointer) int {
 	thisItem := (*Snapshot)(this)
@@ -593,10 +1832,17 @@ func (m *Nitro) NewSnapshot() (*Snapshot, error) {
 	buf := m.snapshots.MakeBuf()
 	defer m.snapshots.FreeBuf(buf)
 
-	// Stitch all local gclists from all writers to create snapshot gclist
+	// Stitch the local gclists of the writers modified since the latest
+	// snapshot to create snapshot gclist. Other writers have empty gclists.
 	var head, tail *skiplist.Node
 
-	for w := m.wlist; w != nil; w = w.next {
+	var next *Writer
+	dirty := (*Writer)(atomic.SwapPointer(&m.dirtyWriters, nil))
+	for w := dirty; w != nil; w = next {
+		next = w.nextDirty
+		w.nextDirty = nil
+		w.dirty = false
+
 		if tail == nil {
 			head = w.gchead
 			tail = w.gctail
@@ -613,10 +1859,23 @@ func (m *Nitro) NewSnapshot() (*Snapshot, error) {
 		atomic.AddInt64(&m.itemsCount, w.count)
 		w.count = 0
 	}
+	atomic.AddInt64(&m.itemsCount, atomic.SwapInt64(&m.pooledCount, 0))
 
-	snap := &Snapshot{db: m, sn: m.getCurrSn(), refCount: 1, count: m.ItemsCount()}
+	indexSnaps, err := m.newIndexSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{db: m, sn: m.getCurrSn(), refCount: 1, count: m.ItemsCount(),
+		store: m.store, storeRef: m.storeRef, indexSnaps: indexSnaps}
+	atomic.AddInt64(&snap.storeRef.snapshots, 1)
+	snap.created = time.Now()
+	if m.leakThreshold > 0 {
+		snap.stack = debug.Stack()
+	}
 	m.snapshots.Insert(unsafe.Pointer(snap), CompareSnapshot, buf, &m.snapshots.Stats)
 	snap.gclist = head
+	atomic.StorePointer(&m.lastSnapshot, unsafe.Pointer(snap))
 	newSn := atomic.AddUint32(&m.currSn, 1)
 	if newSn == math.MaxUint32 {
 		return nil, ErrMaxSnapshotsLimitReached
@@ -625,11 +1884,121 @@ func (m *Nitro) NewSnapshot() (*Snapshot, error) {
 	return snap, nil
 }
 
+// NewSnapshotOrReuse returns the latest snapshot with an additional reference
+// if the store has not been modified since it was created. Otherwise, a new
+// snapshot is created using NewSnapshot(). Readers which do not need a new
+// isolation point can use it to avoid creating a snapshot and advancing the
+// snapshot number for every read. The returned snapshot should be closed
+// once, like a new snapshot.
+// The same restrictions on concurrent writers as NewSnapshot() apply.
+func (m *Nitro) NewSnapshotOrReuse() (*Snapshot, error) {
+	snap := (*Snapshot)(atomic.LoadPointer(&m.lastSnapshot))
+	if snap != nil && atomic.LoadPointer(&m.dirtyWriters) == nil &&
+		snap.sn+1 == m.getCurrSn() && snap.store == m.store && snap.Open() {
+		return snap, nil
+	}
+
+	return m.NewSnapshot()
+}
+
+// WithSnapshot creates a new snapshot and invokes the callback with it.
+// The snapshot is closed once the callback returns, even if it panics. A panic
+// in the callback is returned as an error. The callback may Open() the
+// snapshot to retain it beyond the callback.
+// The same restrictions on concurrent writers as NewSnapshot() apply.
+func (m *Nitro) WithSnapshot(fn func(snap *Snapshot) error) (err error) {
+	snap, err := m.NewSnapshot()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		snap.Close()
+		if r := recover(); r != nil {
+			err = panicError(r)
+		}
+	}()
+
+	return fn(snap)
+}
+
+// leakDetector periodically reports live snapshots which are older than
+// the leak threshold. Each leaked snapshot is reported only once.
+func (m *Nitro) leakDetector() {
+	// A ticker cannot be created with a non-positive period
+	period := m.leakThreshold / 2
+	if period < time.Millisecond {
+		period = time.Millisecond
+	}
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.leakStop:
+			return
+		case <-ticker.C:
+			for _, snap := range m.GetSnapshots() {
+				if !snap.leakReported && time.Since(snap.created) > m.leakThreshold {
+					snap.leakReported = true
+					log.Printf("nitro: snapshot %d has been open for %v, created at:\n%s",
+						snap.sn, time.Since(snap.created), snap.stack)
+				}
+			}
+		}
+	}
+}
+
+// memoryMonitor periodically samples the memory in use and reports the
+// crossings of the memory watermarks.
+func (m *Nitro) memoryMonitor() {
+	ticker := time.NewTicker(memSamplePeriod)
+	defer ticker.Stop()
+	defer close(m.memDone)
+
+	var high bool
+	for {
+		select {
+		case <-m.memStop:
+			return
+		case <-ticker.C:
+			memInUse := m.MemoryInUse()
+			if !high && memInUse >= m.memHighWatermark {
+				high = true
+				m.memPressureCallb(true, memInUse)
+			} else if high && memInUse <= m.memLowWatermark {
+				high = false
+				m.memPressureCallb(false, memInUse)
+			}
+		}
+	}
+}
+
 // ItemsCount returns the number of items in the Nitro instance
+// Writers count their changes locally and the counts are aggregated when a
+// snapshot is created. Hence, the count includes the changes captured by the
+// latest snapshot and not the changes made after it.
 func (m *Nitro) ItemsCount() int64 {
 	return atomic.LoadInt64(&m.itemsCount)
 }
 
+// IsEmpty returns true if no item is visible to the snapshot
+// Unlike ItemsCount(), which counts the live items of the store across all
+// the snapshots, it seeks the first item visible to the snapshot. Hence, its
+// cost depends on the number of invisible items which precede it. A snapshot
+// which has already been destroyed is reported as empty.
+func (m *Nitro) IsEmpty(snap *Snapshot) bool {
+	itr := m.NewIterator(snap)
+	if itr == nil {
+		return true
+	}
+	defer itr.Close()
+
+	itr.SeekFirst()
+	return !itr.Valid()
+}
+
 func (m *Nitro) collectionWorker(w *Writer) {
 	buf := m.store.MakeBuf()
 	defer m.store.FreeBuf(buf)
@@ -639,41 +2008,77 @@ func (m *Nitro) collectionWorker(w *Writer) {
 		select {
 		case <-w.dwrCtx.notifyStatus:
 			w.doCheckpoint()
-		case gclist, ok := <-m.gcchan:
+		case snap, ok := <-m.gcchan:
 			if !ok {
 				close(w.dwrCtx.closed)
 				return
 			}
-			for n := gclist; n != nil; n = n.GClink {
-				w.doDeltaWrite((*Item)(n.Item()))
-				m.store.DeleteNode(n, m.insCmp, buf, &w.slSts2)
-			}
+			m.collectGCList(snap, w, buf, &w.slSts2)
+			m.gcFinished(snap.sn)
+		}
+	}
+}
 
-			m.store.Stats.Merge(&w.slSts2)
+// gcWorker is a dedicated collection worker configured by SetGCWorkers()
+// It does not take part in delta writes. Hence, it does not collect while a
+// backup with delta interleaving is in progress.
+func (m *Nitro) gcWorker() {
+	buf := m.store.MakeBuf()
+	defer m.store.FreeBuf(buf)
+	defer m.shutdownWg1.Done()
 
-			barrier := m.store.GetAccesBarrier()
-			barrier.FlushSession(unsafe.Pointer(gclist))
-		}
+	var sts skiplist.Stats
+	sts.IsLocal(true)
+	for snap := range m.gcchan {
+		m.gcPauseMu.RLock()
+		m.collectGCList(snap, nil, buf, &sts)
+		m.gcPauseMu.RUnlock()
+		m.gcFinished(snap.sn)
 	}
 }
 
-func (m *Nitro) freeWorker(w *Writer) {
-	for freelist := range m.freechan {
-		for n := freelist; n != nil; {
-			dnode := n
-			n = n.GClink
+// collectGCList removes the nodes in a snapshot gclist from the store to
+// which the snapshot belongs.
+// The writer is used for delta writes and can be nil.
+func (m *Nitro) collectGCList(snap *Snapshot, w *Writer,
+	buf *skiplist.ActionBuffer, sts *skiplist.Stats) {
 
-			itm := (*Item)(dnode.Item())
-			m.freeItem(itm)
-			m.store.FreeNode(dnode, &w.slSts3)
+	store := snap.store
+	for n := snap.gclist; n != nil; n = n.GClink {
+		if w != nil {
+			w.doDeltaWrite((*Item)(n.Item()))
 		}
+		store.DeleteNode(n, m.insCmp, buf, sts)
+	}
+
+	store.Stats.Merge(sts)
+
+	barrier := store.GetAccesBarrier()
+	barrier.FlushSession(unsafe.Pointer(snap.gclist))
+	m.releaseStore(snap)
+}
 
-		m.store.Stats.Merge(&w.slSts3)
+func (m *Nitro) freeWorker(sts *skiplist.Stats) {
+	for freelist := range m.freechan {
+		m.freeNodeList(freelist, sts)
 	}
 
 	m.shutdownWg2.Done()
 }
 
+func (m *Nitro) freeNodeList(freelist *skiplist.Node, sts *skiplist.Stats) {
+	for n := freelist; n != nil; {
+		dnode := n
+		n = n.GClink
+
+		itm := (*Item)(dnode.Item())
+		m.freeItem(itm)
+		m.store.FreeNode(dnode, sts)
+	}
+
+	m.store.Stats.Merge(sts)
+}
+
 // Invariant: Each snapshot n is dependent on snapshot n-1.
 // Unless snapshot n-1 is collected, snapshot n cannot be collected.
 func (m *Nitro) collectDead() {
@@ -685,6 +2090,14 @@ func (m *Nitro) collectDead() {
 	iter := m.gcsnapshots.NewIterator(CompareSnapshot, buf1)
 	defer iter.Close()
 
+	var storeBuf *skiplist.ActionBuffer
+	var sts skiplist.Stats
+	if m.useSyncGC {
+		storeBuf = m.store.MakeBuf()
+		defer m.store.FreeBuf(storeBuf)
+		sts.IsLocal(true)
+	}
+
 	for iter.SeekFirst(); iter.Valid(); iter.Next() {
 		node := iter.GetNode()
 		sn := (*Snapshot)(node.Item())
@@ -692,10 +2105,105 @@ func (m *Nitro) collectDead() {
 			return
 		}
 
-		m.lastGCSn = sn.sn
-		m.gcchan <- sn.gclist
+		// Flush() waits for the snapshots up to lastGCSn
+		m.gcStarted(sn.sn)
+		atomic.StoreUint32(&m.lastGCSn, sn.sn)
+		if m.useSyncGC {
+			m.collectGCList(sn, nil, storeBuf, &sts)
+			m.gcFinished(sn.sn)
+		} else {
+			m.gcchan <- sn
+		}
 		m.gcsnapshots.DeleteNode(node, CompareSnapshot, buf2, &m.gcsnapshots.Stats)
+		atomic.AddInt64(&m.deadSnaps, -1)
+	}
+}
+
+func (m *Nitro) gcStarted(sn uint32) {
+	m.gcMu.Lock()
+	m.gcPending[sn] = struct{}{}
+	m.gcMu.Unlock()
+}
+
+func (m *Nitro) gcFinished(sn uint32) {
+	m.gcMu.Lock()
+	delete(m.gcPending, sn)
+	m.gcCond.Broadcast()
+	m.gcMu.Unlock()
+}
+
+// Flush blocks until the gclists of all the snapshots which have been handed
+// over for garbage collection before the call have been collected. Hence, the
+// items deleted before such snapshots have been physically removed from the
+// store and MemoryInUse() reflects their removal. Snapshots handed over
+// during the call are not waited for. A closed snapshot is handed over only
+// after all the older snapshots have been closed. Use Compact() to collect
+// closed snapshots which are waiting for a concurrent GC run as well.
+func (m *Nitro) Flush() error {
+	if m.hasShutdown {
+		return ErrShutdown
+	}
+
+	upto := atomic.LoadUint32(&m.lastGCSn)
+	m.gcMu.Lock()
+	defer m.gcMu.Unlock()
+
+	for m.hasPendingGC(upto) {
+		m.gcCond.Wait()
+	}
+
+	return nil
+}
+
+// hasPendingGC returns true if a snapshot numbered upto or below is being
+// collected. gcMu should be held by the caller.
+func (m *Nitro) hasPendingGC(upto uint32) bool {
+	for sn := range m.gcPending {
+		if sn <= upto {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DeadSnapshotsCount returns the number of closed snapshots which are
+// awaiting garbage collection, as an older snapshot is still live
+func (m *Nitro) DeadSnapshotsCount() int64 {
+	return atomic.LoadInt64(&m.deadSnaps)
+}
+
+// oldestSnapshot returns the live snapshot with the smallest snapshot number
+func (m *Nitro) oldestSnapshot() *Snapshot {
+	buf := m.snapshots.MakeBuf()
+	defer m.snapshots.FreeBuf(buf)
+	iter := m.snapshots.NewIterator(CompareSnapshot, buf)
+	defer iter.Close()
+
+	iter.SeekFirst()
+	if !iter.Valid() {
+		return nil
+	}
+
+	return (*Snapshot)(iter.Get())
+}
+
+// reportGCBlocker logs a warning about the oldest live snapshot, which
+// prevents the garbage collection of the closed snapshots
+func (m *Nitro) reportGCBlocker() {
+	snap := m.oldestSnapshot()
+	if snap == nil || snap.sn != atomic.LoadUint32(&m.lastGCSn)+1 ||
+		!atomic.CompareAndSwapInt32(&snap.blockReported, 0, 1) {
+		return
+	}
+
+	msg := fmt.Sprintf("nitro: %d closed snapshots are awaiting garbage collection, "+
+		"blocked by snapshot %d open for %v", m.DeadSnapshotsCount(), snap.sn,
+		time.Since(snap.created))
+	if snap.stack != nil {
+		msg += fmt.Sprintf(", created at:\n%s", snap.stack)
 	}
+	log.Print(msg)
 }
 
 // GC implements manual garbage collection of Nitro snapshots.
@@ -706,19 +2214,369 @@ func (m *Nitro) GC() {
 	}
 }
 
+// Compact reclaims all item versions which are no longer visible to any live
+// snapshot and blocks until they have been physically removed from the store.
+// A snapshot which was closed while another GC run was in progress is
+// collected only on the next snapshot Close(). Compact collects such
+// snapshots immediately. Items deleted after the latest snapshot are reclaimed
+// only after the next snapshot has been created and closed.
+// Compact does not rebuild the store. The dead items are removed in-place by
+// the GC workers, so that concurrent writers and the secondary indexes are not
+// affected. The item versions pinned by an open snapshot are retained until
+// the snapshot is closed. A store holding only the latest version of each key
+// can be built offline using a Loader and installed using SwapStore().
+func (m *Nitro) Compact() error {
+	for !atomic.CompareAndSwapInt32(&m.isGCRunning, 0, 1) {
+		// Close() holds the GC ownership until the instance is shut down
+		if atomic.LoadInt32(&m.closed) == 1 {
+			return ErrShutdown
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if atomic.LoadInt32(&m.closed) == 1 {
+		atomic.CompareAndSwapInt32(&m.isGCRunning, 1, 0)
+		return ErrShutdown
+	}
+
+	m.collectDead()
+	atomic.CompareAndSwapInt32(&m.isGCRunning, 1, 0)
+
+	return m.Flush()
+}
+
+// LastGCSn returns the number of the latest snapshot whose gclist has been
+// handed over for collection. The snapshots are collected in the order of
+// snapshot numbers.
+func (m *Nitro) LastGCSn() uint32 {
+	return atomic.LoadUint32(&m.lastGCSn)
+}
+
+// ForceCollect synchronously collects a closed snapshot and returns once the
+// items deleted before the snapshot was created have been removed from the
+// store. ErrSnapshotInUse is returned if the snapshot is still open.
+// The collection cannot be forced while an older snapshot is open, since the
+// items in the gclist of the snapshot are still visible to the older
+// snapshots. An error wrapping ErrOlderSnapshotOpen with the number of the
+// oldest snapshot which blocks the collection is returned in that case.
+func (m *Nitro) ForceCollect(snap *Snapshot) error {
+	if snap.Open() {
+		snap.Close()
+		return ErrSnapshotInUse
+	}
+
+	if err := m.Compact(); err != nil {
+		return err
+	}
+
+	if lastGCSn := m.LastGCSn(); lastGCSn < snap.sn {
+		return fmt.Errorf("%w: snapshot %d blocks the collection of snapshot %d",
+			ErrOlderSnapshotOpen, lastGCSn+1, snap.sn)
+	}
+
+	return nil
+}
+
+// TrimToSnapshot rewinds the store to the state visible to a snapshot by
+// discarding all the changes made after the snapshot was created. The items
+// added after the snapshot are removed and the items deleted after the
+// snapshot are restored. The changes of the writers which are not captured by
+// a snapshot are discarded as well and the next snapshot number is reset to
+// the one following the snapshot. The secondary indexes are rewound along
+// with the store. The store and the indexes are modified only if all of them
+// can be rewound, otherwise the error is returned and nothing is changed.
+// ErrNewerSnapshotOpen is returned if a newer snapshot is still open, as it
+// would observe the discarded changes. ErrSnapshotClosed is returned if the
+// snapshot has already been destroyed and ErrStoreReplaced is returned if
+// the snapshot belongs to a store replaced by SwapStore().
+// This is a thread-unsafe API. No writers should be active and NewSnapshot()
+// should not be called concurrently. The items count is reset to the count
+// captured by the snapshot.
+func (m *Nitro) TrimToSnapshot(snap *Snapshot) error {
+	if !snap.Open() {
+		return ErrSnapshotClosed
+	}
+	defer snap.Close()
+
+	// The indexes are checked before any of the stores is modified. Hence, an
+	// error leaves the store and the indexes unchanged.
+	if err := m.checkTrim(snap); err != nil {
+		return err
+	}
+
+	for i, idx := range m.indexes {
+		if err := idx.db.checkTrim(snap.indexSnaps[i]); err != nil {
+			return err
+		}
+	}
+
+	m.trim(snap)
+	for i, idx := range m.indexes {
+		idx.db.trim(snap.indexSnaps[i])
+	}
+
+	return nil
+}
+
+// checkTrim returns an error if the instance cannot be rewound to a snapshot
+func (m *Nitro) checkTrim(snap *Snapshot) error {
+	if m.hasShutdown {
+		return ErrShutdown
+	}
+
+	if !snap.IsLive() {
+		return ErrSnapshotClosed
+	}
+
+	if snap.store != m.store {
+		return ErrStoreReplaced
+	}
+
+	for _, s := range m.GetSnapshots() {
+		if s.sn > snap.sn && s.RefCount() > 0 {
+			return ErrNewerSnapshotOpen
+		}
+	}
+
+	return nil
+}
+
+// trim rewinds the store of the instance to a snapshot checked by checkTrim()
+func (m *Nitro) trim(snap *Snapshot) {
+	for !atomic.CompareAndSwapInt32(&m.isGCRunning, 0, 1) {
+		time.Sleep(time.Millisecond)
+	}
+	defer atomic.CompareAndSwapInt32(&m.isGCRunning, 1, 0)
+
+	m.dropDeadSnapshots(snap.sn)
+	m.discardPendingWrites()
+	m.trimStore(snap.sn)
+
+	atomic.StoreInt64(&m.itemsCount, snap.count)
+	atomic.StoreUint32(&m.currSn, snap.sn+1)
+	atomic.StorePointer(&m.lastSnapshot, unsafe.Pointer(snap))
+}
+
+// dropDeadSnapshots removes the closed snapshots newer than a snapshot from
+// the list of snapshots awaiting garbage collection without collecting their
+// gclists. They cannot have been collected, as the snapshot is still open.
+func (m *Nitro) dropDeadSnapshots(sn uint32) {
+	buf1 := m.gcsnapshots.MakeBuf()
+	buf2 := m.gcsnapshots.MakeBuf()
+	defer m.gcsnapshots.FreeBuf(buf1)
+	defer m.gcsnapshots.FreeBuf(buf2)
+
+	iter := m.gcsnapshots.NewIterator(CompareSnapshot, buf1)
+	defer iter.Close()
+
+	for iter.SeekFirst(); iter.Valid(); iter.Next() {
+		node := iter.GetNode()
+		s := (*Snapshot)(node.Item())
+		if s.sn > sn {
+			m.gcsnapshots.DeleteNode(node, CompareSnapshot, buf2, &m.gcsnapshots.Stats)
+			atomic.AddInt64(&m.deadSnaps, -1)
+			m.releaseStore(s)
+		}
+	}
+}
+
+// discardPendingWrites clears the gclists and the stats of the writers which
+// have modified the store since the latest snapshot
+func (m *Nitro) discardPendingWrites() {
+	var next *Writer
+	dirty := (*Writer)(atomic.SwapPointer(&m.dirtyWriters, nil))
+	for w := dirty; w != nil; w = next {
+		next = w.nextDirty
+		w.nextDirty = nil
+		w.dirty = false
+		w.gchead = nil
+		w.gctail = nil
+		m.store.Stats.Merge(&w.slSts1)
+		w.count = 0
+	}
+	atomic.StoreInt64(&m.pooledCount, 0)
+}
+
+// trimStore removes the items added after a snapshot number and restores
+// the items deleted after it
+func (m *Nitro) trimStore(sn uint32) {
+	buf := m.store.MakeBuf()
+	defer m.store.FreeBuf(buf)
+	iter := m.store.NewIterator(m.iterCmp, buf)
+	defer iter.Close()
+
+	var sts skiplist.Stats
+	sts.IsLocal(true)
+
+	var freelist *skiplist.Node
+	for iter.SeekFirst(); iter.Valid(); iter.Next() {
+		n := iter.GetNode()
+		itm := (*Item)(n.Item())
+		if itm.bornSn > sn {
+			if m.store.DeleteNode(n, m.insCmp, buf, &sts) {
+				n.GClink = freelist
+				freelist = n
+			}
+		} else if atomic.LoadUint32(&itm.deadSn) > sn {
+			n.GClink = nil
+			atomic.StoreUint32(&itm.deadSn, 0)
+		}
+	}
+
+	m.store.Stats.Merge(&sts)
+
+	barrier := m.store.GetAccesBarrier()
+	barrier.FlushSession(unsafe.Pointer(freelist))
+}
+
+// GetAsOf returns a copy of the version of an item which was visible to the
+// snapshot number sn, whether or not a snapshot with the number is open. It
+// returns nil if no version of the item was visible at sn. The versions are
+// retained only while the snapshots which can see them are open and a
+// version is removed by the garbage collector afterwards. Hence, nil may be
+// returned for an old snapshot number, even though the item was visible to
+// it. Only the versions in the current store are considered.
+func (m *Nitro) GetAsOf(bs []byte, sn uint32) *Item {
+	buf := m.store.MakeBuf()
+	defer m.store.FreeBuf(buf)
+	iter := m.store.NewIterator(m.iterCmp, buf)
+	defer iter.Close()
+
+	// The versions of a key are ordered by bornSn and they have
+	// non-overlapping lifetimes. Hence, only the latest version born at or
+	// before sn can be visible at sn.
+	var itm *Item
+	if len(bs) > MaxItemLen {
+		for m.seekKey(iter, bs); iter.Valid(); iter.Next() {
+			curr := (*Item)(iter.Get())
+			if m.keyCmp(curr.Bytes(), bs) != 0 || curr.bornSn > sn {
+				break
+			}
+			itm = curr
+		}
+	} else {
+		target := m.newItem(bs, false)
+		target.bornSn = sn + 1
+		if sn == math.MaxUint32 {
+			target.bornSn = sn
+		}
+
+		if iter.SeekPrevWithCmp(unsafe.Pointer(target), m.insCmp) {
+			itm = (*Item)(iter.Get())
+		}
+	}
+
+	if itm == nil || m.keyCmp(itm.Bytes(), bs) != 0 || itm.bornSn > sn {
+		return nil
+	}
+
+	if deadSn := atomic.LoadUint32(&itm.deadSn); deadSn != 0 && deadSn <= sn {
+		return nil
+	}
+
+	return m.ptrToItem(unsafe.Pointer(itm))
+}
+
+// VersionCount returns the number of versions of an item which are physically
+// present in the store. It includes live as well as deleted versions which are
+// yet to be garbage collected.
+// This API is mainly for debugging purpose
+func (m *Nitro) VersionCount(bs []byte) int {
+	var count int
+	buf := m.store.MakeBuf()
+	defer m.store.FreeBuf(buf)
+	iter := m.store.NewIterator(m.iterCmp, buf)
+	defer iter.Close()
+
+	for m.seekKey(iter, bs); iter.Valid(); iter.Next() {
+		if m.keyCmp((*Item)(iter.Get()).Bytes(), bs) != 0 {
+			break
+		}
+		count++
+	}
+
+	return count
+}
+
+// KeyHistory returns copies of all the versions of an item which are
+// physically present in the store, ordered from the newest to the oldest
+// version. It includes deleted versions, whose deadSn is set. The depth of
+// the history depends on the snapshots which are retained. A version is
+// removed by the garbage collector once no live snapshot can see it.
+// This API is mainly for debugging and auditing purpose
+func (m *Nitro) KeyHistory(bs []byte) []*Item {
+	var items []*Item
+	buf := m.store.MakeBuf()
+	defer m.store.FreeBuf(buf)
+	iter := m.store.NewIterator(m.iterCmp, buf)
+	defer iter.Close()
+
+	// Versions of a key are ordered by ascending bornSn
+	for m.seekKey(iter, bs); iter.Valid(); iter.Next() {
+		if m.keyCmp((*Item)(iter.Get()).Bytes(), bs) != 0 {
+			break
+		}
+		items = append(items, m.ptrToItem(iter.Get()))
+	}
+
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+
+	return items
+}
+
 // GetSnapshots returns the list of current live snapshots
+// It is safe to call it while snapshots are created and closed concurrently.
+// The lock-free snapshot list is scanned in the order of snapshot numbers,
+// so that every snapshot is returned at most once and in order. However, the
+// list is not a point-in-time copy. The snapshots created or closed during the
+// scan may or may not be returned and a returned snapshot may be closed
+// afterwards. A snapshot should be opened before it is used.
 // This API is mainly for debugging purpose
 func (m *Nitro) GetSnapshots() []*Snapshot {
 	var snaps []*Snapshot
 	buf := m.snapshots.MakeBuf()
 	defer m.snapshots.FreeBuf(buf)
 	iter := m.snapshots.NewIterator(CompareSnapshot, buf)
+	defer iter.Close()
 	iter.SeekFirst()
 	for ; iter.Valid(); iter.Next() {
 		snaps = append(snaps, (*Snapshot)(iter.Get()))
 	}
 
-	return snaps
+	return snaps
+}
+
+// GetSnapshotsFiltered returns the live snapshots for which the predicate
+// returns true, in the order of snapshot numbers. Like GetSnapshots(), it may
+// be called while snapshots are created and closed concurrently.
+// This API is mainly for management tools
+func (m *Nitro) GetSnapshotsFiltered(pred func(*Snapshot) bool) []*Snapshot {
+	var snaps []*Snapshot
+	for _, snap := range m.GetSnapshots() {
+		if pred(snap) {
+			snaps = append(snaps, snap)
+		}
+	}
+
+	return snaps
+}
+
+// panicError converts a recovered panic into an error with the stack trace
+func panicError(r interface{}) error {
+	return fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+}
+
+// callVisitor invokes the visitor callback and reports a panic as an error
+func callVisitor(callb VisitorCallback, itm *Item, shard int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError(r)
+		}
+	}()
+
+	return callb(itm, shard)
 }
 
 func (m *Nitro) ptrToItem(itmPtr unsafe.Pointer) *Item {
@@ -732,44 +2590,167 @@ func (m *Nitro) ptrToItem(itmPtr unsafe.Pointer) *Item {
 // Visitor implements concurrent Nitro snapshot visitor
 // This API divides the range of keys in a snapshot into `shards` range partitions
 // Number of concurrent worker threads used can be specified.
+// If the snapshot does not have enough items, fewer partitions are used.
+// The concurrency is an upper bound and no more workers than the number of
+// partitions are started. A concurrency less than 1 is treated as 1.
+// The items are not read ahead. A worker invokes the callback for an item
+// directly from the store and it moves to the next item only after the
+// callback returns. Hence, a slow callback holds back its worker and the
+// visitor does not buffer any items.
 func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concurrency int) error {
-	var wg sync.WaitGroup
-	var pivotItems []*Item
+	return m.visitor(snap, callb, shards, concurrency, nil)
+}
 
-	wch := make(chan int, shards)
+// VisitorWithPivots is same as Visitor(). Instead of dividing the range of
+// keys using the store, it uses the provided pivot items as the partition
+// boundaries. N pivots create N+1 partitions, where partition 0 holds the
+// items smaller than pivots[0], partition i holds the items from pivots[i-1]
+// until pivots[i] and the last partition holds the items from the last pivot
+// onwards. It is useful for a skewed keyspace, for which the boundaries can
+// be balanced by sampling the keys.
+// The pivots should be sorted in strictly ascending key order, otherwise
+// ErrNotSorted is returned. ErrInvalidPivot is returned for a nil pivot.
+func (m *Nitro) VisitorWithPivots(snap *Snapshot, callb VisitorCallback, pivots []*Item,
+	concurrency int) error {
+
+	pivotItems := []*Item{nil} // start item
+	for i, pivot := range pivots {
+		if pivot == nil {
+			return ErrInvalidPivot
+		}
+
+		if i > 0 && m.keyCmp(pivots[i-1].Bytes(), pivot.Bytes()) >= 0 {
+			return ErrNotSorted
+		}
+
+		// Partitions are delimited by keys irrespective of the versions
+		pivotItems = append(pivotItems, m.newItem(pivot.Bytes(), false))
+	}
+	pivotItems = append(pivotItems, nil) // end item
+
+	return m.visitRanges(snap, callb, pivotItems, concurrency, nil)
+}
+
+// Aggregate computes an aggregate over the items of a snapshot using the
+// concurrent snapshot visitor. Every partition starts with an accumulator
+// returned by init and the items of the partition are folded into it in key
+// order. The accumulators of the partitions are then combined in the order
+// of the partitions. A panic in fold is returned as an error. The functions
+// should not retain the items, as they may be freed once the snapshot is
+// closed.
+func (m *Nitro) Aggregate(snap *Snapshot, shards, concurrency int,
+	init func() interface{},
+	fold func(acc interface{}, itm *Item) interface{},
+	combine func(a, b interface{}) interface{}) (interface{}, error) {
+
+	if shards < 1 {
+		shards = 1
+	}
+
+	accs := make([]interface{}, shards)
+	for i := range accs {
+		accs[i] = init()
+	}
+
+	callb := func(itm *Item, shard int) error {
+		accs[shard] = fold(accs[shard], itm)
+		return nil
+	}
+
+	if err := m.Visitor(snap, callb, shards, concurrency); err != nil {
+		return nil, err
+	}
+
+	result := accs[0]
+	for _, acc := range accs[1:] {
+		result = combine(result, acc)
+	}
+
+	return result, nil
+}
+
+// rangePivots divides the range of keys in a snapshot into at most `shards`
+// partitions. Partition i covers the items from pivotItems[i] until
+// pivotItems[i+1]. The first and the last pivots are nil.
+func (m *Nitro) rangePivots(snap *Snapshot, shards int) ([]*Item, error) {
+	var pivotItems []*Item
 
 	if snap == nil {
 		panic("snapshot cannot be nil")
 	}
 
+	tmpIter := m.NewIterator(snap)
+	if tmpIter == nil {
+		return nil, ErrSnapshotClosed
+	}
+
 	func() {
-		tmpIter := m.NewIterator(snap)
-		if tmpIter == nil {
-			panic("iterator cannot be nil")
-		}
 		defer tmpIter.Close()
 
-		barrier := m.store.GetAccesBarrier()
+		barrier := snap.store.GetAccesBarrier()
 		token := barrier.Acquire()
 		defer barrier.Release(token)
 
 		pivotItems = append(pivotItems, nil) // start item
-		pivotPtrs := m.store.GetRangeSplitItems(shards)
+
+		// Every partition should start with an item visible in the snapshot
+		// and the first partition holds the first item. Hence, pivots are
+		// picked from the visible items bigger than the first one.
+		tmpIter.SeekFirst()
+		if !tmpIter.Valid() {
+			return
+		}
+		prevItm := m.ptrToItem(tmpIter.GetNode().Item())
+
+		pivotPtrs := snap.store.GetRangeSplitItems(shards)
 		for _, itmPtr := range pivotPtrs {
-			itm := m.ptrToItem(itmPtr)
-			tmpIter.Seek(itm.Bytes())
+			tmpIter.Seek(m.ptrToItem(itmPtr).Bytes())
 			if tmpIter.Valid() {
-				prevItm := pivotItems[len(pivotItems)-1]
+				itm := m.ptrToItem(tmpIter.GetNode().Item())
 				// Find bigger item than prev pivot
-				if prevItm == nil || m.insCmp(unsafe.Pointer(itm), unsafe.Pointer(prevItm)) > 0 {
+				if m.iterCmp(unsafe.Pointer(itm), unsafe.Pointer(prevItm)) > 0 {
 					pivotItems = append(pivotItems, itm)
+					prevItm = itm
 				}
 			}
 		}
-		pivotItems = append(pivotItems, nil) // end item
 	}()
 
-	errors := make([]error, len(pivotItems)-1)
+	pivotItems = append(pivotItems, nil) // end item
+	return pivotItems, nil
+}
+
+// visitor runs the snapshot visitor. If a semaphore is provided, every
+// worker holds a token from it while it is running.
+func (m *Nitro) visitor(snap *Snapshot, callb VisitorCallback, shards int, concurrency int,
+	sem chan struct{}) error {
+	pivotItems, err := m.rangePivots(snap, shards)
+	if err != nil {
+		return err
+	}
+
+	return m.visitRanges(snap, callb, pivotItems, concurrency, sem)
+}
+
+// visitRanges runs the snapshot visitor for the partitions delimited by the
+// pivot items. Partition i covers the items from pivotItems[i] until
+// pivotItems[i+1] and a nil pivot leaves the range unbounded.
+func (m *Nitro) visitRanges(snap *Snapshot, callb VisitorCallback, pivotItems []*Item,
+	concurrency int, sem chan struct{}) error {
+	var wg sync.WaitGroup
+
+	shards := len(pivotItems) - 1
+	wch := make(chan int, shards)
+	errors := make([]error, shards)
+
+	// Idle workers are not started
+	if concurrency > shards {
+		concurrency = shards
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
 
 	// Run workers
 	for i := 0; i < concurrency; i++ {
@@ -777,40 +2758,29 @@ func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concu
 		go func(wg *sync.WaitGroup) {
 			defer wg.Done()
 
-			for shard := range wch {
-				startItem := pivotItems[shard]
-				endItem := pivotItems[shard+1]
+			if sem != nil {
+				sem <- struct{}{}
+				defer func() { <-sem }()
+			}
 
+			for shard := range wch {
 				itr := m.NewIterator(snap)
 				if itr == nil {
-					panic("iterator cannot be nil")
-				}
-				defer itr.Close()
-
-				itr.SetRefreshRate(m.refreshRate)
-				if startItem == nil {
-					itr.SeekFirst()
-				} else {
-					itr.Seek(startItem.Bytes())
+					errors[shard] = ErrSnapshotClosed
+					continue
 				}
-			loop:
-				for ; itr.Valid(); itr.Next() {
-					if endItem != nil && m.insCmp(itr.GetNode().Item(), unsafe.Pointer(endItem)) >= 0 {
-						break loop
-					}
 
-					itm := (*Item)(itr.GetNode().Item())
-					if err := callb(itm, shard); err != nil {
-						errors[shard] = err
-						return
-					}
+				err := m.visitShard(itr, callb, shard, pivotItems[shard], pivotItems[shard+1])
+				if err != nil {
+					errors[shard] = err
+					return
 				}
 			}
 		}(&wg)
 	}
 
 	// Provide work and wait
-	for shard := 0; shard < len(pivotItems)-1; shard++ {
+	for shard := 0; shard < shards; shard++ {
 		wch <- shard
 	}
 	close(wch)
@@ -826,9 +2796,37 @@ func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concu
 	return nil
 }
 
+// visitShard invokes the visitor callback for the items of a partition
+// The iterator is closed once the partition has been visited, so that a
+// worker holds a single iterator and its accessor session at a time.
+func (m *Nitro) visitShard(itr *Iterator, callb VisitorCallback, shard int,
+	startItem, endItem *Item) error {
+	defer itr.Close()
+
+	itr.SetRefreshRate(m.refreshRate)
+	if startItem == nil {
+		itr.SeekFirst()
+	} else {
+		itr.Seek(startItem.Bytes())
+	}
+
+	for ; itr.Valid(); itr.Next() {
+		if endItem != nil && m.insCmp(itr.GetNode().Item(), unsafe.Pointer(endItem)) >= 0 {
+			break
+		}
+
+		itm := (*Item)(itr.GetNode().Item())
+		if err := callVisitor(callb, itm, shard); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (m *Nitro) numWriters() int {
 	var count int
-	for w := m.wlist; w != nil; w = w.next {
+	for w := m.getWriters(); w != nil; w = w.next {
 		count++
 	}
 
@@ -840,7 +2838,7 @@ func (m *Nitro) changeDeltaWrState(state int,
 
 	var err error
 
-	for id, w := 0, m.wlist; w != nil; w, id = w.next, id+1 {
+	for id, w := 0, m.getWriters(); w != nil; w, id = w.next, id+1 {
 		w.dwrCtx.state = state
 		if state == dwStateInit {
 			w.dwrCtx.sn = snap.sn
@@ -872,7 +2870,49 @@ func (m *Nitro) changeDeltaWrState(state int,
 
 // StoreToDisk backups Nitro snapshot to disk
 // Concurrent threads are used to perform backup and concurrency can be specified.
-func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback ItemCallback) (err error) {
+// The items are streamed from the store to the shard files and no item is
+// copied. Every shard file, and every delta file of a writer if delta files
+// are used, holds a buffer of the writer size configured by
+// SetIOBufferSizes(). Hence, the memory used by a backup is about
+// (shards + writers) * buffer size, irrespective of the number and the size
+// of the items.
+func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback ItemCallback) error {
+	_, err := m.StoreToDisk2(dir, snap, concurr, itmCallback)
+	return err
+}
+
+// StoreToDisk2 is same as StoreToDisk(). Additionally it returns the
+// statistics of the backup data files.
+func (m *Nitro) StoreToDisk2(dir string, snap *Snapshot, concurr int,
+	itmCallback ItemCallback) (stats BackupStats, err error) {
+	return m.storeToDisk(dir, snap, concurr, itmCallback, nil)
+}
+
+// StoreToDiskPartitioned is same as StoreToDisk(), but the shards of the backup
+// are aligned to the provided key boundaries instead of the internal split
+// points of the store. The boundaries should be in sorted order. Shard file
+// shard-i holds the items with keys in the range [boundaries[i-1],
+// boundaries[i]), where the first and the last ranges are unbounded. Hence,
+// every shard file can be restored independently. The files of empty ranges
+// are not created. ErrNotSorted is returned if the boundaries are not sorted.
+func (m *Nitro) StoreToDiskPartitioned(dir string, snap *Snapshot, boundaries [][]byte,
+	itmCallback ItemCallback) error {
+	if boundaries == nil {
+		boundaries = [][]byte{}
+	}
+
+	_, err := m.storeToDisk(dir, snap, runtime.NumCPU(), itmCallback, boundaries)
+	return err
+}
+
+// storeToDisk runs StoreToDisk(). If the boundaries are nil, the shards are
+// obtained from the split points of the store.
+func (m *Nitro) storeToDisk(dir string, snap *Snapshot, concurr int,
+	itmCallback ItemCallback, boundaries [][]byte) (stats BackupStats, err error) {
+
+	t0 := time.Now()
+	op := m.beginOperation(OpStoreToDisk)
+	defer m.endOperation(op)
 
 	var snapClosed bool
 	defer func() {
@@ -886,9 +2926,25 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		defer m.shutdownWg1.Done()
 	}
 
-	datadir := filepath.Join(dir, "data")
-	os.MkdirAll(datadir, 0755)
+	var pivotItems []*Item
 	shards := runtime.NumCPU()
+	if boundaries != nil {
+		pivotItems = append(pivotItems, nil)
+		for i, bs := range boundaries {
+			if i > 0 && m.keyCmp(boundaries[i-1], bs) >= 0 {
+				return stats, ErrNotSorted
+			}
+			if len(bs) > MaxItemLen {
+				return stats, ErrMaxItemSizeExceeded
+			}
+			pivotItems = append(pivotItems, m.newItem(bs, false))
+		}
+		pivotItems = append(pivotItems, nil)
+		shards = len(pivotItems) - 1
+	}
+
+	datadir := filepath.Join(dir, "data")
+	os.MkdirAll(datadir, m.backupDirPerm())
 
 	writers := make([]FileWriter, shards)
 	files := make([]string, shards)
@@ -900,20 +2956,8 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		}
 	}()
 
-	for shard := 0; shard < shards; shard++ {
-		w := m.newFileWriter(m.fileType)
-		file := fmt.Sprintf("shard-%d", shard)
-		datafile := filepath.Join(datadir, file)
-		if err := w.Open(datafile); err != nil {
-			return err
-		}
-
-		writers[shard] = w
-		files[shard] = file
-	}
-
 	// Initialize and setup delta processing
-	if m.useDeltaFiles {
+	if m.useDeltaFiles && !m.useSyncGC {
 		deltaWriters := make([]FileWriter, m.numWriters())
 		deltaFiles := make([]string, m.numWriters())
 		defer func() {
@@ -925,77 +2969,244 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		}()
 
 		deltadir := filepath.Join(dir, "delta")
-		os.MkdirAll(deltadir, 0755)
+		os.MkdirAll(deltadir, m.backupDirPerm())
 		for id := 0; id < m.numWriters(); id++ {
 			dw := m.newFileWriter(m.fileType)
 			file := fmt.Sprintf("shard-%d", id)
 			deltafile := filepath.Join(deltadir, file)
 			if err = dw.Open(deltafile); err != nil {
-				return err
+				return stats, err
 			}
 			deltaWriters[id] = dw
 			deltaFiles[id] = file
 		}
 
 		if err = m.changeDeltaWrState(dwStateInit, deltaWriters, snap); err != nil {
-			return err
+			return stats, err
+		}
+
+		// Items of a destroyed snapshot may have been collected already
+		if atomic.LoadInt32(&snap.refCount) <= 0 {
+			m.changeDeltaWrState(dwStateTerminate, nil, nil)
+			return stats, ErrSnapshotClosed
 		}
 
 		// Create a placeholder snapshot object. We are decoupled from holding snapshot items
 		// The fakeSnap object is to use the same iterator without any special handling for
 		// usual refcount based freeing.
 
+		// The dedicated GC workers cannot write the items of the snapshot to
+		// the delta files once it is closed
+		if m.gcWorkers > 0 {
+			m.gcPauseMu.Lock()
+			defer m.gcPauseMu.Unlock()
+		}
+
 		snap.Close()
 		snapClosed = true
 		fakeSnap := *snap
 		fakeSnap.refCount = 1
 		snap = &fakeSnap
 
+		// The first error is returned, as the delta files are finalized
+		// even if writing the data files has failed
 		defer func() {
-			if err = m.changeDeltaWrState(dwStateTerminate, nil, nil); err == nil {
-				bs, _ := json.Marshal(deltaFiles)
-				ioutil.WriteFile(filepath.Join(deltadir, "files.json"), bs, 0660)
+			derr := m.changeDeltaWrState(dwStateTerminate, nil, nil)
+			if derr == nil {
+				for id, w := range deltaWriters {
+					deltaWriters[id] = nil
+					if cerr := w.Close(); cerr != nil && derr == nil {
+						derr = cerr
+					}
+				}
+
+				bs := m.encodeManifest(deltaFiles)
+				ioutil.WriteFile(filepath.Join(deltadir, "files.json"), bs, m.manifestPerm())
+				if derr == nil && m.useFsync {
+					derr = m.syncBackupFiles(deltadir, deltaFiles)
+				}
+			}
+
+			if err == nil {
+				err = derr
 			}
 		}()
 	}
 
+	// Progress is accumulated per shard and published in batches. The bytes
+	// are counted by the shard file writers, which account for the encoding
+	// of the file type and the custom item encoders.
+	period := m.progressBatch()
+
+	shardItems := make([]int64, shards)
+	shardBytes := make([]int64, shards) // Bytes of the shard published so far
+	shardCounts := make([]int64, shards)
+	flushProgress := func(shard int) {
+		n := fileByteCount(writers[shard])
+		nitems, nbytes := op.addProgress(shardItems[shard], n-shardBytes[shard])
+		shardItems[shard] = 0
+		shardBytes[shard] = n
+		if m.progressCallb != nil {
+			m.progressCallb(nitems, nbytes)
+		}
+	}
+
 	visitorCallback := func(itm *Item, shard int) error {
 		if m.hasShutdown {
 			return ErrShutdown
 		}
 
+		// Shard files are created on demand to avoid writing empty files
 		w := writers[shard]
+		if w == nil {
+			w = m.newFileWriter(m.fileType)
+			file := fmt.Sprintf("shard-%d", shard)
+			if err := w.Open(filepath.Join(datadir, file)); err != nil {
+				return err
+			}
+
+			writers[shard] = w
+			files[shard] = file
+		}
+
 		if err := w.WriteItem(itm); err != nil {
 			return err
 		}
 
+		shardCounts[shard]++
 		if itmCallback != nil {
 			itmCallback(&ItemEntry{itm: itm, n: nil})
 		}
 
+		shardItems[shard]++
+		if shardItems[shard] >= period {
+			flushProgress(shard)
+		}
+
 		return nil
 	}
 
-	if err = m.Visitor(snap, visitorCallback, shards, concurr); err == nil {
-		bs, _ := json.Marshal(files)
-		ioutil.WriteFile(filepath.Join(datadir, "files.json"), bs, 0660)
+	if pivotItems == nil {
+		err = m.visitor(snap, visitorCallback, shards, concurr, m.backupSem)
+	} else {
+		err = m.visitRanges(snap, visitorCallback, pivotItems, concurr, m.backupSem)
 	}
 
-	return err
+	if err == nil {
+		var shardFiles []string
+		for shard, file := range files {
+			if file == "" {
+				continue
+			}
+
+			// Close to account for the buffered data
+			w := writers[shard]
+			writers[shard] = nil
+			if err = w.Close(); err != nil {
+				return stats, err
+			}
+
+			// The remaining progress includes the end of file marker
+			nbytes := fileByteCount(w)
+			op.addProgress(shardItems[shard], nbytes-shardBytes[shard])
+			shardItems[shard], shardBytes[shard] = 0, nbytes
+
+			shardFiles = append(shardFiles, file)
+			stats.ItemsWritten += shardCounts[shard]
+			stats.BytesWritten += nbytes
+		}
+		stats.ShardCount = len(shardFiles)
+
+		bs := m.encodeManifest(shardFiles)
+		ioutil.WriteFile(filepath.Join(datadir, "files.json"), bs, m.manifestPerm())
+		if m.useFsync {
+			if err = m.syncBackupFiles(datadir, shardFiles); err != nil {
+				return stats, err
+			}
+		}
+
+		itemsWritten, bytesWritten := op.addProgress(0, 0)
+		if m.progressCallb != nil {
+			m.progressCallb(itemsWritten, bytesWritten)
+		}
+	}
+
+	stats.Duration = time.Since(t0)
+	return stats, err
+}
+
+// checkPendingWrites returns ErrPendingWrites if any writer has modified the
+// store since the latest snapshot. The store cannot be replaced in that case,
+// as the pending changes of the writers refer to the current store.
+func (m *Nitro) checkPendingWrites() error {
+	if atomic.LoadPointer(&m.dirtyWriters) != nil {
+		return ErrPendingWrites
+	}
+
+	return nil
+}
+
+// reopenShard opens a backup data file and skips the items which have already
+// been loaded from it.
+func (m *Nitro) reopenShard(t FileType, path string, skip int) (FileReader, error) {
+	r := m.newFileReader(t)
+	if err := r.Open(path); err != nil {
+		return r, err
+	}
+
+	for i := 0; i < skip; i++ {
+		itm, err := r.ReadItem()
+		if err != nil {
+			return r, err
+		}
+
+		if itm == nil {
+			return r, io.ErrUnexpectedEOF
+		}
+		m.freeItem(itm)
+	}
+
+	return r, nil
 }
 
 // LoadFromDisk restores Nitro from a disk backup
+// The existing contents of the store are replaced. Writers always operate on
+// the current store and the existing writers see the restored items once the
+// restore is complete. ErrPendingWrites is returned if a writer has modified
+// the store after the latest snapshot. Such changes should be captured by
+// creating a snapshot before the restore.
+// This is a thread-unsafe API and no writers should be active.
 func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snapshot, error) {
+	snap, _, err := m.LoadFromDisk2(dir, concurr, callb)
+	return snap, err
+}
+
+// LoadFromDisk2 is same as LoadFromDisk(). Additionally it returns the
+// statistics of the backup data files which were read.
+func (m *Nitro) LoadFromDisk2(dir string, concurr int, callb ItemCallback) (*Snapshot, LoadStats, error) {
+	var stats LoadStats
 	var wg sync.WaitGroup
-	var files []string
+	t0 := time.Now()
+	op := m.beginOperation(OpLoadFromDisk)
+	defer m.endOperation(op)
+
+	var mf fileManifest
 	var bs []byte
 	var err error
 	datadir := filepath.Join(dir, "data")
 
+	if err = m.checkPendingWrites(); err != nil {
+		return nil, stats, err
+	}
+
 	if bs, err = ioutil.ReadFile(filepath.Join(datadir, "files.json")); err != nil {
-		return nil, err
+		return nil, stats, err
+	}
+
+	if mf, err = m.decodeManifest(bs); err != nil {
+		return nil, stats, err
 	}
-	json.Unmarshal(bs, &files)
+	files := m.nonEmptyFiles(datadir, mf.Files, mf.FileType)
 
 	var nodeCallb skiplist.NodeCallback
 	wchan := make(chan int)
@@ -1004,6 +3215,11 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 	segments := make([]*skiplist.Segment, len(files))
 	readers := make([]FileReader, len(files))
 	errors := make([]error, len(files))
+	firstItems := make([]*Item, len(files))
+	lastItems := make([]*Item, len(files))
+	shardCounts := make([]int64, len(files))
+	var itemsLoaded int64
+	var shardsLoaded int32
 
 	if callb != nil {
 		nodeCallb = func(n *skiplist.Node) {
@@ -1022,10 +3238,10 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 	for i, file := range files {
 		segments[i] = b.NewSegment()
 		segments[i].SetNodeCallback(nodeCallb)
-		r := m.newFileReader(m.fileType)
+		r := m.newFileReader(mf.FileType)
 		datafile := filepath.Join(datadir, file)
 		if err := r.Open(datafile); err != nil {
-			return nil, err
+			return nil, stats, err
 		}
 
 		readers[i] = r
@@ -1037,20 +3253,65 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 			defer wg.Done()
 
 			for shard := range wchan {
-				r := readers[shard]
-			loop:
-				for {
-					itm, err := r.ReadItem()
-					if err != nil {
-						errors[shard] = err
-						return
-					}
+				errors[shard] = func() (err error) {
+					// Progress is published in batches
+					var nitems, nbytes int64
+					defer func() {
+						op.addProgress(nitems, nbytes)
+						if r := recover(); r != nil {
+							err = panicError(r)
+						}
+					}()
+
+					for pos, retries := 0, 0; ; pos++ {
+						itm, err := readers[shard].ReadItem()
+						if err != nil {
+							// Resume the shard from the current position using a new reader
+							if retries < m.loadRetries {
+								retries++
+								readers[shard].Close()
+								readers[shard], err = m.reopenShard(mf.FileType,
+									filepath.Join(datadir, files[shard]), pos)
+								if err == nil {
+									pos--
+									continue
+								}
+							}
+
+							return &ShardLoadError{File: files[shard], ItemsLoaded: int64(pos), Err: err}
+						}
+
+						if itm == nil {
+							shardCounts[shard] = int64(pos)
+							if m.loadProgressCallb != nil {
+								m.loadProgressCallb(atomic.AddInt64(&itemsLoaded, int64(pos)),
+									int(atomic.AddInt32(&shardsLoaded, 1)))
+							}
+							return nil
+						}
+
+						if m.useLoadValidation {
+							if prev := lastItems[shard]; prev != nil &&
+								m.keyCmp(prev.Bytes(), itm.Bytes()) >= 0 {
+								m.freeItem(itm)
+								return &SortOrderError{File: files[shard], Position: pos}
+							}
+
+							if firstItems[shard] == nil {
+								firstItems[shard] = itm
+							}
+							lastItems[shard] = itm
+						}
 
-					if itm == nil {
-						break loop
+						nitems++
+						nbytes += EncodedItemSize(itm)
+						if nitems >= m.progressBatch() {
+							op.addProgress(nitems, nbytes)
+							nitems, nbytes = 0, 0
+						}
+						segments[shard].Add(unsafe.Pointer(itm))
 					}
-					segments[shard].Add(unsafe.Pointer(itm))
-				}
+				}()
 			}
 		}(&wg)
 	}
@@ -1063,12 +3324,33 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 
 	for _, err := range errors {
 		if err != nil {
-			return nil, err
+			return nil, stats, err
+		}
+	}
+
+	// Shards should hold non-overlapping ranges in the order of files
+	if m.useLoadValidation {
+		var prev *Item
+		for i := range files {
+			if firstItems[i] == nil {
+				continue
+			}
+
+			if prev != nil && m.keyCmp(prev.Bytes(), firstItems[i].Bytes()) >= 0 {
+				return nil, stats, &SortOrderError{File: files[i], Position: 0}
+			}
+			prev = lastItems[i]
 		}
 	}
 
 	m.store = b.Assemble(segments...)
 
+	for i, r := range readers {
+		stats.ItemsRead += shardCounts[i]
+		stats.BytesRead += fileByteCount(r)
+	}
+	stats.ShardCount = len(files)
+
 	// Delta processing
 	if m.useDeltaFiles {
 		m.DeltaRestoreFailed = 0
@@ -1077,8 +3359,14 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 		wchan := make(chan int)
 		deltadir := filepath.Join(dir, "delta")
 		var files []string
+		var deltaFileType FileType
 		if bs, err := ioutil.ReadFile(filepath.Join(deltadir, "files.json")); err == nil {
-			json.Unmarshal(bs, &files)
+			mf, err := m.decodeManifest(bs)
+			if err != nil {
+				return nil, stats, err
+			}
+			files = m.nonEmptyFiles(deltadir, mf.Files, mf.FileType)
+			deltaFileType = mf.FileType
 		}
 
 		readers := make([]FileReader, len(files))
@@ -1094,10 +3382,10 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 		}()
 
 		for i, file := range files {
-			r := m.newFileReader(m.fileType)
+			r := m.newFileReader(deltaFileType)
 			deltafile := filepath.Join(deltadir, file)
 			if err := r.Open(deltafile); err != nil {
-				return nil, err
+				return nil, stats, err
 			}
 
 			readers[i] = r
@@ -1110,32 +3398,47 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 				defer wg.Done()
 
 				for shard := range wchan {
-					r := readers[shard]
-				loop:
-					for {
-						itm, err := r.ReadItem()
-						if err != nil {
-							errors[shard] = err
-							return
-						}
+					errors[shard] = func() (err error) {
+						var nitems, nbytes int64
+						defer func() {
+							op.addProgress(nitems, nbytes)
+							if r := recover(); r != nil {
+								err = panicError(r)
+							}
+						}()
 
-						if itm == nil {
-							break loop
-						}
+						r := readers[shard]
+						for {
+							itm, err := r.ReadItem()
+							if err != nil {
+								return err
+							}
 
-						w := writers[id]
-						if n, success := w.store.Insert2(unsafe.Pointer(itm),
-							w.insCmp, w.existCmp, w.buf, w.rand.Float32, &w.slSts1); success {
+							if itm == nil {
+								return nil
+							}
+
+							nitems++
+							nbytes += EncodedItemSize(itm)
+							if nitems >= m.progressBatch() {
+								op.addProgress(nitems, nbytes)
+								nitems, nbytes = 0, 0
+							}
 
-							w.resSts.DeltaRestored++
-							if nodeCallb != nil {
-								nodeCallb(n)
+							w := writers[id]
+							if n, success := w.store.Insert2(unsafe.Pointer(itm),
+								w.insCmp, w.existCmp, w.buf, w.rand.Float32, &w.slSts1); success {
+
+								w.resSts.DeltaRestored++
+								if nodeCallb != nil {
+									nodeCallb(n)
+								}
+							} else {
+								w.freeItem(itm)
+								w.resSts.DeltaRestoreFailed++
 							}
-						} else {
-							w.freeItem(itm)
-							w.resSts.DeltaRestoreFailed++
 						}
-					}
+					}()
 				}
 
 				// Aggregate stats
@@ -1154,16 +3457,141 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 
 		for _, err := range errors {
 			if err != nil {
-				return nil, err
+				return nil, stats, err
 			}
 		}
 	}
 
-	stats := m.store.GetStats()
-	m.itemsCount = int64(stats.NodeCount)
+	m.itemsCount = int64(m.store.GetStats().NodeCount)
+	snap, err := m.NewSnapshot()
+	stats.Duration = time.Since(t0)
+	return snap, stats, err
+}
+
+// BuildFromSorted builds the Nitro store from a stream of items which are
+// sorted by the key comparator. The next callback returns the next item data
+// and false once there are no more items.
+// The items are added without any comparisons with items in the store.
+// The existing contents of the store are replaced and a snapshot of the new
+// store is returned. If the items are not in sorted order, ErrNotSorted is
+// returned and the store remains unchanged.
+// This is a thread-unsafe API and no writers should be active during the build.
+// Use a Loader to build the store from multiple sorted segments.
+func (m *Nitro) BuildFromSorted(next func() ([]byte, bool)) (*Snapshot, error) {
+	l := m.NewLoader()
+	segment := l.AddSegment()
+	for bs, ok := next(); ok; bs, ok = next() {
+		if err := segment.AddSortedItems(bs); err != nil {
+			l.Abort()
+			return nil, err
+		}
+	}
+
+	return l.Finish()
+}
+
+// SwapStore replaces the store of the Nitro instance with newStore, which
+// holds newCount items, and returns a snapshot of the new store.
+// The existing snapshots and their iterators continue to read from the old
+// store, while all snapshots created after the swap see the new store.
+// The new store should be built offline with a configuration compatible to
+// this instance and its items should be visible to all snapshots, as the
+// store assembled by a Loader. The ownership of the new store is transferred
+// to this instance.
+// Once all the snapshots of the old store have been closed and garbage
+// collected, the old store is retired. With memory management enabled, its
+// remaining items and nodes are freed by the collection of its last snapshot
+// or by Close(), whichever happens first.
+// This is a thread-unsafe API. While it is invoked, no writers should be
+// active, as required by NewSnapshot(). Concurrent readers are allowed.
+func (m *Nitro) SwapStore(newStore *skiplist.Skiplist, newCount int64) (*Snapshot, error) {
+	if m.hasShutdown {
+		return nil, ErrShutdown
+	}
+
+	// Capture the pending gclists of writers in a final old store snapshot
+	last, err := m.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	// The old store is retired once the final snapshot has been created, so
+	// that the snapshots of the old store keep it alive until collected
+	old := m.storeRef
+	old.store = m.store
+	m.retireMu.Lock()
+	old.retired = true
+	if m.useMemoryMgmt {
+		m.retiredStores = append(m.retiredStores, old)
+	}
+	m.retireMu.Unlock()
+
+	newStore.SetItemSizeFunc(ItemSize)
+	newStore.SetBarrierDestructor(m.newBSDestructor())
+	m.store = newStore
+	m.storeRef = new(storeRef)
+	atomic.StoreInt64(&m.itemsCount, newCount)
+	last.Close()
+
 	return m.NewSnapshot()
 }
 
+// storeRef tracks the snapshots of a store which have not been collected yet
+type storeRef struct {
+	store     *skiplist.Skiplist
+	snapshots int64
+	retired   bool
+}
+
+// releaseStore is invoked once a snapshot has been collected
+// With memory management enabled, a store replaced by SwapStore() is freed
+// once all its snapshots have been collected. The retired stores which still
+// have snapshots pending collection at shutdown are freed by Close().
+func (m *Nitro) releaseStore(snap *Snapshot) {
+	ref := snap.storeRef
+	if atomic.AddInt64(&ref.snapshots, -1) != 0 || !m.useMemoryMgmt {
+		return
+	}
+
+	m.retireMu.Lock()
+	if !ref.retired {
+		m.retireMu.Unlock()
+		return
+	}
+
+	for i, r := range m.retiredStores {
+		if r == ref {
+			m.retiredStores = append(m.retiredStores[:i], m.retiredStores[i+1:]...)
+			break
+		}
+	}
+	m.retireMu.Unlock()
+
+	m.freeStore(ref.store)
+}
+
+// Clear removes all the items from the store and resets the items count
+// The store is replaced with an empty store as in SwapStore(). Hence, the
+// existing snapshots and their iterators continue to read the items from the
+// old store until they are closed, while the snapshots created afterwards are
+// empty. The stores of the secondary indexes are cleared as well.
+// This is a thread-unsafe API and no writers should be active.
+func (m *Nitro) Clear() error {
+	snap, err := m.SwapStore(skiplist.NewWithConfig(m.newStoreConfig()), 0)
+	if err != nil {
+		return err
+	}
+	snap.Close()
+
+	for _, idx := range m.indexes {
+		if err := idx.db.Clear(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // DumpStats returns Nitro statistics
 func (m *Nitro) DumpStats() string {
 	return m.aggrStoreStats().String()
@@ -1171,7 +3599,7 @@ func (m *Nitro) DumpStats() string {
 
 func (m *Nitro) aggrStoreStats() skiplist.StatsReport {
 	sts := m.store.GetStats()
-	for w := m.wlist; w != nil; w = w.next {
+	for w := m.getWriters(); w != nil; w = w.next {
 		sts.Apply(&w.slSts1)
 		sts.Apply(&w.slSts2)
 		sts.Apply(&w.slSts3)
@@ -1182,15 +3610,54 @@ func (m *Nitro) aggrStoreStats() skiplist.StatsReport {
 
 // MemoryInUse returns total memory used by all Nitro instances in the current process
 func MemoryInUse() (sz int64) {
+	visitInstances(func(db *Nitro) {
+		sz += db.MemoryInUse()
+	})
+
+	return
+}
+
+// InstanceStat is a summary of the statistics of a Nitro instance
+type InstanceStat struct {
+	ID          int
+	Name        string
+	MemoryInUse int64
+	ItemsCount  int64
+	Snapshots   int
+}
+
+// InstanceStats returns the statistics of all the Nitro instances in the
+// current process, which have not been closed, in the order of creation.
+// Snapshots is the number of live snapshots of an instance.
+func InstanceStats() []InstanceStat {
+	var stats []InstanceStat
+	visitInstances(func(db *Nitro) {
+		stats = append(stats, InstanceStat{
+			ID:          db.id,
+			Name:        db.name,
+			MemoryInUse: db.MemoryInUse(),
+			ItemsCount:  db.ItemsCount(),
+			Snapshots:   int(db.snapshots.GetStats().NodeCount),
+		})
+	})
+
+	return stats
+}
+
+// visitInstances invokes the callback for every Nitro instance in the current
+// process. The instances cannot be closed until the callbacks have returned.
+func visitInstances(callb func(db *Nitro)) {
+	dbInstancesLock.RLock()
+	defer dbInstancesLock.RUnlock()
+
 	buf := dbInstances.MakeBuf()
 	defer dbInstances.FreeBuf(buf)
 	iter := dbInstances.NewIterator(CompareNitro, buf)
+	defer iter.Close()
+
 	for iter.SeekFirst(); iter.Valid(); iter.Next() {
-		db := (*Nitro)(iter.Get())
-		sz += db.MemoryInUse()
+		callb((*Nitro)(iter.Get()))
 	}
-
-	return
 }
 
 // Debug enables debug mode
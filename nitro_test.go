@@ -12,13 +12,27 @@ package nitro
 import "fmt"
 import "sync/atomic"
 import "os"
+import "path/filepath"
 import "testing"
 import "time"
+import "math"
+import "unsafe"
 import "math/rand"
 import "sync"
 import "runtime"
 import "encoding/binary"
+import "bytes"
+import "encoding/base64"
+import "encoding/csv"
+import "encoding/json"
+import "io"
+import "log"
+import "strings"
+import "errors"
+import "io/ioutil"
+import "syscall"
 import "github.com/t3rm1n4l/nitro/mm"
+import "github.com/t3rm1n4l/nitro/skiplist"
 
 var testConf Config
 
@@ -504,6 +518,183 @@ func TestVisitor(t *testing.T) {
 	}
 }
 
+func TestAggregate(t *testing.T) {
+	const n = 100000
+	var wg sync.WaitGroup
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	wg.Add(1)
+	doInsert(db, &wg, n, false, false)
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	var expCount, expSize int64
+	itr := snap.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		expCount++
+		expSize += int64(len(itr.Get()))
+	}
+	itr.Close()
+
+	count, err := db.Aggregate(snap, 16, 4,
+		func() interface{} { return int64(0) },
+		func(acc interface{}, itm *Item) interface{} { return acc.(int64) + 1 },
+		func(a, b interface{}) interface{} { return a.(int64) + b.(int64) })
+	if err != nil || count.(int64) != expCount {
+		t.Errorf("Expected count %d, got=%v, %v", expCount, count, err)
+	}
+
+	size, err := db.Aggregate(snap, 16, 4,
+		func() interface{} { return int64(0) },
+		func(acc interface{}, itm *Item) interface{} { return acc.(int64) + int64(len(itm.Bytes())) },
+		func(a, b interface{}) interface{} { return a.(int64) + b.(int64) })
+	if err != nil || size.(int64) != expSize {
+		t.Errorf("Expected size %d, got=%v, %v", expSize, size, err)
+	}
+
+	_, err = db.Aggregate(snap, 16, 4,
+		func() interface{} { return nil },
+		func(acc interface{}, itm *Item) interface{} { panic("fold failed") },
+		func(a, b interface{}) interface{} { return nil })
+	if err == nil || !strings.Contains(err.Error(), "fold failed") {
+		t.Errorf("Expected fold error, got=%v", err)
+	}
+}
+
+func TestVisitorWithPivots(t *testing.T) {
+	const n = 10000
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%06d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	var pivots []*Item
+	itr := snap.NewIterator()
+	for _, k := range []int{10, 20, 9000} {
+		itr.Seek([]byte(fmt.Sprintf("%06d", k)))
+		pivots = append(pivots, (*Item)(itr.GetNode().Item()))
+	}
+	itr.Close()
+
+	visit := func(visitor func(VisitorCallback) error) (map[string]int, error) {
+		var mu sync.Mutex
+		visited := make(map[string]int)
+		err := visitor(func(itm *Item, shard int) error {
+			mu.Lock()
+			defer mu.Unlock()
+			visited[string(itm.Bytes())] = shard
+			return nil
+		})
+		return visited, err
+	}
+
+	exp, err := visit(func(callb VisitorCallback) error {
+		return db.Visitor(snap, callb, 4, 4)
+	})
+	if err != nil || len(exp) != n {
+		t.Fatalf("Expected %d items, got=%d, %v", n, len(exp), err)
+	}
+
+	got, err := visit(func(callb VisitorCallback) error {
+		return db.VisitorWithPivots(snap, callb, pivots, 2)
+	})
+	if err != nil || len(got) != len(exp) {
+		t.Fatalf("Expected %d items, got=%d, %v", len(exp), len(got), err)
+	}
+
+	for k := range exp {
+		var i, shard int
+		fmt.Sscanf(k, "%d", &i)
+		switch {
+		case i < 10:
+			shard = 0
+		case i < 20:
+			shard = 1
+		case i < 9000:
+			shard = 2
+		default:
+			shard = 3
+		}
+
+		if s, ok := got[k]; !ok || s != shard {
+			t.Errorf("Expected %s in shard %d, got=%d, %v", k, shard, s, ok)
+		}
+	}
+
+	callb := func(*Item, int) error { return nil }
+	if err := db.VisitorWithPivots(snap, callb, []*Item{pivots[1], pivots[0]}, 2); err != ErrNotSorted {
+		t.Errorf("Expected ErrNotSorted, got=%v", err)
+	}
+
+	if err := db.VisitorWithPivots(snap, callb, []*Item{pivots[0], nil}, 2); err != ErrInvalidPivot {
+		t.Errorf("Expected ErrInvalidPivot, got=%v", err)
+	}
+}
+
+func TestVisitorConcurrencyClamp(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%06d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	itr := snap.NewIterator()
+	itr.Seek([]byte("000500"))
+	pivot := (*Item)(itr.GetNode().Item())
+	itr.Close()
+
+	for _, concurrency := range []int{-1, 0, 1, 2, 1000} {
+		// Count the callbacks running concurrently
+		var count, active, maxWorkers int64
+		callb := func(itm *Item, shard int) error {
+			atomic.AddInt64(&count, 1)
+			n := atomic.AddInt64(&active, 1)
+			defer atomic.AddInt64(&active, -1)
+			for {
+				max := atomic.LoadInt64(&maxWorkers)
+				if n <= max || atomic.CompareAndSwapInt64(&maxWorkers, max, n) {
+					break
+				}
+			}
+
+			runtime.Gosched()
+			return nil
+		}
+
+		if err := db.VisitorWithPivots(snap, callb, []*Item{pivot}, concurrency); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+
+		if count != 1000 {
+			t.Errorf("Expected 1000 items with concurrency %d, got=%d", concurrency, count)
+		}
+
+		limit := int64(2)
+		if concurrency < 2 {
+			limit = 1
+		}
+
+		if maxWorkers > limit {
+			t.Errorf("Expected at most %d workers with concurrency %d, got=%d",
+				limit, concurrency, maxWorkers)
+		}
+	}
+}
+
 func TestVisitorError(t *testing.T) {
 	const n = 100000
 	var wg sync.WaitGroup
@@ -735,3 +926,5627 @@ func TestCloseWithActiveIterators(t *testing.T) {
 	wg.Wait()
 
 }
+
+func TestStoreDiskProgress(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+	const n = 100000
+
+	for _, tc := range []struct {
+		fileType FileType
+		itemSize int64
+	}{{RawdbFile, 2 + 8}, {RawdbFileV2, 3 + 8}} {
+		var lastItems, lastBytes int64
+
+		conf := testConf
+		conf.SetFileType(tc.fileType)
+		conf.SetStoreProgressCallback(func(items, bytes int64) {
+			atomic.StoreInt64(&lastItems, items)
+			atomic.StoreInt64(&lastBytes, bytes)
+		}, 1000)
+
+		var wg sync.WaitGroup
+		db := NewWithConfig(conf)
+
+		wg.Add(1)
+		doInsert(db, &wg, n, false, false)
+		snap, _ := db.NewSnapshot()
+		count := snap.Count()
+
+		stats, err := db.StoreToDisk2("db.dump", snap, 4, nil)
+		if err != nil {
+			t.Errorf("Expected no error. got=%v", err)
+		}
+
+		if lastItems != count {
+			t.Errorf("Expected progress items %d, got %d", count, lastItems)
+		}
+
+		// The bytes include the flags of the file type and the end of
+		// file markers
+		if lastBytes != stats.BytesWritten || lastBytes < count*tc.itemSize {
+			t.Errorf("Expected progress bytes %d, got %d", stats.BytesWritten, lastBytes)
+		}
+
+		db.Close()
+	}
+}
+
+func TestStoreDiskDeltaError(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	// The delta files are finalized after the data files fail
+	errEncode := errors.New("encode failed")
+	conf := testConf
+	conf.SetItemCodec(func(itm *Item, w io.Writer) error {
+		if itm.len() > 0 {
+			return errEncode
+		}
+		return nil
+	}, nil)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != errEncode {
+		t.Errorf("Expected the data file error, got=%v", err)
+	}
+}
+
+func BenchmarkIteratorSeek(b *testing.B) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	key := []byte(fmt.Sprintf("%010d", 5000))
+	for _, pool := range []bool{false, true} {
+		name := "NoPool"
+		if pool {
+			name = "Pool"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			poolIterators = pool
+			defer func() { poolIterators = true }()
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				itr := snap.NewIterator()
+				itr.Seek(key)
+				itr.Close()
+			}
+		})
+	}
+}
+
+func TestIteratorBufferPool(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	// A repeated Close does not release the state of an iterator twice,
+	// even if the state has been handed to another iterator
+	itr := snap.NewIterator()
+	itr.Close()
+	itr1 := snap.NewIterator()
+	itr.Close()
+
+	itr2 := snap.NewIterator()
+	if itr1 == itr2 || itr1.state == itr2.state || itr1.state.buf == itr2.state.buf {
+		t.Errorf("Expected iterators not to share a state")
+	}
+
+	// A recycled state does not retain the position of the closed iterator
+	w := db.NewWriter()
+	w.Put([]byte("key"))
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	itr3 := snap2.NewIterator()
+	if itr3.SeekFirst(); !itr3.Valid() {
+		t.Fatalf("Expected a valid iterator")
+	}
+	st := itr3.state
+	itr3.Close()
+	if st.iter.Valid() || st.iter.GetNode() != nil {
+		t.Errorf("Expected the state to be reset")
+	}
+
+	if itr3.Valid() {
+		t.Errorf("Expected a closed iterator to be invalid")
+	}
+
+	itr1.Close()
+	itr2.Close()
+}
+
+func TestMemoryInUseRunningTotal(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+
+	for i := 0; i < 10000; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap2, _ := w.NewSnapshot()
+	snap3, _ := w.NewSnapshot()
+	snap1.Close()
+	snap2.Close()
+	for db.store.GetStats().NodeCount != 5000 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var sz int64
+	buf := db.store.MakeBuf()
+	itr := db.store.NewIterator(db.iterCmp, buf)
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		sz += int64(db.store.Size(itr.GetNode()))
+	}
+	itr.Close()
+	db.store.FreeBuf(buf)
+
+	if got := db.store.MemoryInUse(); got != sz {
+		t.Errorf("Expected store memory %d, got %d", sz, got)
+	}
+
+	expected := sz + db.snapshots.GetStats().Memory + db.gcsnapshots.GetStats().Memory
+	if got := db.MemoryInUse(); got != expected {
+		t.Errorf("Expected memory %d, got %d", expected, got)
+	}
+
+	snap3.Close()
+}
+
+func TestConcurrentReadersWriters(t *testing.T) {
+	const n = 10000
+	var wg sync.WaitGroup
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	for i := 1; i <= 4; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			w := db.NewWriter()
+			for x := id * n; x < id*n+n; x++ {
+				w.Put([]byte(fmt.Sprintf("%010d", x)))
+			}
+		}(i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c := CountItems(snap); c != n {
+				t.Errorf("Expected count %d, got %d", n, c)
+			}
+
+			itr := snap.NewIterator()
+			defer itr.Close()
+			for x := 0; x < n; x += 100 {
+				key := fmt.Sprintf("%010d", x)
+				itr.Seek([]byte(key))
+				if !itr.Valid() || string(itr.Get()) != key {
+					t.Errorf("Expected to find %s", key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWriterConcurrentUse(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected panic on concurrent use of writer")
+		}
+	}()
+
+	w.acquire()
+	w.Put([]byte("key"))
+}
+
+func TestVisitorPanic(t *testing.T) {
+	const n = 100000
+	var wg sync.WaitGroup
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	wg.Add(1)
+	doInsert(db, &wg, n, false, false)
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	callb := func(itm *Item, shard int) error {
+		v := binary.BigEndian.Uint64(itm.Bytes())
+		if v == 90000 {
+			panic("visitor panic")
+		}
+		return nil
+	}
+
+	if err := db.Visitor(snap, callb, 4, 4); err == nil {
+		t.Errorf("Expected error")
+	}
+
+	if snap.refCount != 1 {
+		t.Errorf("Expected all iterators to be closed, refcount %d", snap.refCount)
+	}
+}
+
+func TestStoreDiskPerms(t *testing.T) {
+	os.RemoveAll("db.dump")
+	conf := DefaultConfig()
+	conf.SetFilePerms(0700, 0600)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Errorf("Expected no error. got=%v", err)
+	}
+
+	checkPerm := func(path string, perm os.FileMode) {
+		if fi, err := os.Stat(path); err != nil {
+			t.Errorf("Expected no error. got=%v", err)
+		} else if fi.Mode().Perm() != perm {
+			t.Errorf("Expected %v for %s, got %v", perm, path, fi.Mode().Perm())
+		}
+	}
+
+	checkPerm("db.dump/data", 0700)
+	checkPerm("db.dump/data/files.json", 0600)
+	checkPerm("db.dump/data/shard-0", 0600)
+
+	// The default permissions are subject to the umask
+	umask := os.FileMode(syscall.Umask(0))
+	syscall.Umask(int(umask))
+
+	os.RemoveAll("db.dump")
+	db2 := NewWithConfig(DefaultConfig())
+	defer db2.Close()
+
+	w = db2.NewWriter()
+	w.Put([]byte("key"))
+	snap, _ = w.NewSnapshot()
+	if err := db2.StoreToDisk("db.dump", snap, 1, nil); err != nil {
+		t.Errorf("Expected no error. got=%v", err)
+	}
+
+	checkPerm("db.dump/data", 0755&^umask)
+	checkPerm("db.dump/data/files.json", 0660&^umask)
+	checkPerm("db.dump/data/shard-0", 0755&^umask)
+}
+
+func TestLoadDiskFileType(t *testing.T) {
+	os.RemoveAll("db.dump")
+	db := New()
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Errorf("Expected no error. got=%v", err)
+	}
+	db.Close()
+
+	// Backup file type should be picked from the manifest
+	conf := DefaultConfig()
+	conf.fileType = FileType(-1)
+	db = NewWithConfig(conf)
+	defer db.Close()
+	snap, err := db.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	VerifyCount(snap, 1000, t)
+	snap.Close()
+
+	bs, _ := json.Marshal(fileManifest{FileType: FileType(-1), Files: []string{"shard-0"}})
+	ioutil.WriteFile("db.dump/data/files.json", bs, 0660)
+	db2 := New()
+	defer db2.Close()
+	if _, err := db2.LoadFromDisk("db.dump", 4, nil); err != ErrUnknownFileType {
+		t.Errorf("Expected ErrUnknownFileType, got=%v", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+
+	for i := 0; i < 10000; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+	snap3, _ := w.NewSnapshot()
+
+	// Simulate a concurrent GC run which skips collection
+	atomic.StoreInt32(&db.isGCRunning, 1)
+	snap1.Close()
+	snap2.Close()
+	atomic.StoreInt32(&db.isGCRunning, 0)
+
+	if c := db.store.GetStats().NodeCount; c != 10000 {
+		t.Errorf("Expected node count 10000, got %d", c)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Errorf("Expected no error. got=%v", err)
+	}
+
+	if c := db.store.GetStats().NodeCount; c != 5000 {
+		t.Errorf("Expected node count 5000, got %d", c)
+	}
+
+	VerifyCount(snap3, 5000, t)
+	snap3.Close()
+}
+
+func TestCompactClose(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	// Simulate Close() holding the GC ownership while Compact() waits for it
+	atomic.StoreInt32(&db.isGCRunning, 1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		atomic.StoreInt32(&db.closed, 1)
+	}()
+
+	if err := db.Compact(); err != ErrShutdown {
+		t.Errorf("Expected ErrShutdown, got=%v", err)
+	}
+
+	atomic.StoreInt32(&db.closed, 0)
+	atomic.StoreInt32(&db.isGCRunning, 0)
+}
+
+func TestVersionCount(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	key := []byte("hotkey")
+	w := db.NewWriter()
+	w.Put([]byte("coldkey"))
+	w.Put(key)
+
+	var snaps []*Snapshot
+	for i := 0; i < 10; i++ {
+		snap, _ := w.NewSnapshot()
+		snaps = append(snaps, snap)
+		w.Delete(key)
+		w.Put(key)
+	}
+
+	if c := db.VersionCount(key); c != 11 {
+		t.Errorf("Expected 11 versions, got %d", c)
+	}
+
+	if c := db.VersionCount([]byte("coldkey")); c != 1 {
+		t.Errorf("Expected 1 version, got %d", c)
+	}
+
+	if c := db.VersionCount([]byte("nokey")); c != 0 {
+		t.Errorf("Expected 0 versions, got %d", c)
+	}
+
+	for _, snap := range snaps {
+		snap.Close()
+	}
+}
+
+func TestSyncGC(t *testing.T) {
+	conf := testConf
+	conf.UseSyncGC()
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+
+	for i := 0; i < 10000; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+	snap3, _ := w.NewSnapshot()
+	snap1.Close()
+	snap2.Close()
+
+	sts := db.store.GetStats()
+	if sts.NodeCount != 5000 {
+		t.Errorf("Expected node count 5000, got %d", sts.NodeCount)
+	}
+
+	if sts.NodeFrees != 5000 {
+		t.Errorf("Expected node frees 5000, got %d", sts.NodeFrees)
+	}
+
+	VerifyCount(snap3, 5000, t)
+	snap3.Close()
+}
+
+func TestItemCodec(t *testing.T) {
+	os.RemoveAll("db.dump")
+	enc := func(itm *Item, w io.Writer) error {
+		bs, _ := json.Marshal(string(itm.Bytes()))
+		_, err := w.Write(append(bs, '\n'))
+		return err
+	}
+
+	dec := func(r io.Reader) ([]byte, error) {
+		var line []byte
+		b := make([]byte, 1)
+		for {
+			if _, err := io.ReadFull(r, b); err != nil {
+				return nil, err
+			}
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+
+		var s string
+		err := json.Unmarshal(line, &s)
+		return []byte(s), err
+	}
+
+	conf := DefaultConfig()
+	conf.SetItemCodec(enc, dec)
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Errorf("Expected no error. got=%v", err)
+	}
+	db.Close()
+
+	db = NewWithConfig(conf)
+	defer db.Close()
+	snap, err := db.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer snap.Close()
+
+	i := 0
+	itr := snap.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if exp := fmt.Sprintf("%010d", i); string(itr.Get()) != exp {
+			t.Errorf("Expected %s, got %s", exp, string(itr.Get()))
+		}
+		i++
+	}
+
+	if i != 1000 {
+		t.Errorf("Expected 1000 items, got %d", i)
+	}
+}
+
+func TestExport(t *testing.T) {
+	const n = 10000
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	var jsonBuf, csvBuf bytes.Buffer
+	if err := db.ExportJSON(snap, &jsonBuf); err != nil {
+		t.Errorf("Expected no error. got=%v", err)
+	}
+
+	seen := make(map[string]bool)
+	dec := json.NewDecoder(&jsonBuf)
+	for {
+		var e ExportEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Expected no error. got=%v", err)
+		}
+		seen[string(e.Key)] = true
+	}
+
+	if len(seen) != n {
+		t.Errorf("Expected %d items in json export, got %d", n, len(seen))
+	}
+
+	if err := db.ExportCSV(snap, &csvBuf, ';'); err != nil {
+		t.Errorf("Expected no error. got=%v", err)
+	}
+
+	r := csv.NewReader(&csvBuf)
+	r.Comma = ';'
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Errorf("Expected no error. got=%v", err)
+	}
+
+	if len(records) != n {
+		t.Errorf("Expected %d items in csv export, got %d", n, len(records))
+	}
+
+	for _, rec := range records {
+		if key, _ := base64.StdEncoding.DecodeString(rec[0]); !seen[string(key)] {
+			t.Errorf("Unexpected key %s", string(key))
+		}
+	}
+}
+
+func TestBuildFromSorted(t *testing.T) {
+	const n = 100000
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	i := 0
+	next := func() ([]byte, bool) {
+		if i == n {
+			return nil, false
+		}
+		i++
+		return []byte(fmt.Sprintf("%010d", i-1)), true
+	}
+
+	snap, err := db.BuildFromSorted(next)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	VerifyCount(snap, n, t)
+
+	itr := snap.NewIterator()
+	key := fmt.Sprintf("%010d", 5000)
+	itr.Seek([]byte(key))
+	if !itr.Valid() || string(itr.Get()) != key {
+		t.Errorf("Expected to find %s", key)
+	}
+	itr.Close()
+	snap.Close()
+
+	keys := []string{"a", "c", "b"}
+	next = func() ([]byte, bool) {
+		if len(keys) == 0 {
+			return nil, false
+		}
+		k := keys[0]
+		keys = keys[1:]
+		return []byte(k), true
+	}
+
+	if _, err := db.BuildFromSorted(next); err != ErrNotSorted {
+		t.Errorf("Expected ErrNotSorted, got=%v", err)
+	}
+}
+
+func BenchmarkBuildFromSorted(b *testing.B) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	i := 0
+	next := func() ([]byte, bool) {
+		if i == b.N {
+			return nil, false
+		}
+		bs := make([]byte, 8)
+		binary.BigEndian.PutUint64(bs, uint64(i))
+		i++
+		return bs, true
+	}
+
+	snap, _ := db.BuildFromSorted(next)
+	snap.Close()
+}
+
+func BenchmarkPutSorted(b *testing.B) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < b.N; i++ {
+		bs := make([]byte, 8)
+		binary.BigEndian.PutUint64(bs, uint64(i))
+		w.Put(bs)
+	}
+}
+
+func TestLoadDiskValidation(t *testing.T) {
+	os.RemoveAll("db.dump")
+	os.MkdirAll("db.dump/data", 0755)
+
+	conf := DefaultConfig()
+	conf.UseLoadValidation()
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	writeShard := func(file string, keys ...string) {
+		fw := db.newFileWriter(RawdbFile)
+		fw.Open(filepath.Join("db.dump/data", file))
+		for _, k := range keys {
+			fw.WriteItem(db.newItem([]byte(k), false))
+		}
+		fw.Close()
+	}
+
+	writeShard("shard-0", "a", "b", "c")
+	writeShard("shard-1", "d", "f", "e", "g")
+	ioutil.WriteFile("db.dump/data/files.json", db.encodeManifest([]string{"shard-0", "shard-1"}), 0660)
+
+	_, err := db.LoadFromDisk("db.dump", 2, nil)
+	if serr, ok := err.(*SortOrderError); !ok || serr.File != "shard-1" || serr.Position != 2 {
+		t.Errorf("Expected sort order error, got=%v", err)
+	}
+
+	writeShard("shard-1", "c", "d")
+	_, err = db.LoadFromDisk("db.dump", 2, nil)
+	if serr, ok := err.(*SortOrderError); !ok || serr.File != "shard-1" || serr.Position != 0 {
+		t.Errorf("Expected sort order error, got=%v", err)
+	}
+
+	writeShard("shard-1", "d", "e")
+	snap, err := db.LoadFromDisk("db.dump", 2, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	VerifyCount(snap, 5, t)
+	snap.Close()
+}
+
+func TestSnapshotCount(t *testing.T) {
+	var wg sync.WaitGroup
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	var writers []*Writer
+	for i := 0; i < 4; i++ {
+		writers = append(writers, db.NewWriter())
+	}
+
+	var snaps []*Snapshot
+	for x := 0; x < 5; x++ {
+		for i, w := range writers {
+			wg.Add(1)
+			go func(w *Writer, id int) {
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					key := []byte(fmt.Sprintf("%010d", id*1000000+x*1000+j))
+					w.Put(key)
+					if j%3 == 0 {
+						w.Delete(key)
+					}
+				}
+			}(w, i)
+		}
+		wg.Wait()
+
+		snap, _ := db.NewSnapshot()
+		snaps = append(snaps, snap)
+	}
+
+	for _, snap := range snaps {
+		if c := CountItems(snap); int64(c) != snap.Count() {
+			t.Errorf("Expected snapshot count %d, got %d", c, snap.Count())
+		}
+		snap.Close()
+	}
+}
+
+func TestStoreDiskMaxConcurrency(t *testing.T) {
+	const maxConcurr = 2
+	var wg sync.WaitGroup
+	var active, maxActive int64
+
+	conf := DefaultConfig()
+	conf.SetMaxBackupConcurrency(maxConcurr)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	wg.Add(1)
+	doInsert(db, &wg, 20000, false, false)
+
+	callb := func(*ItemEntry) {
+		n := atomic.AddInt64(&active, 1)
+		for {
+			max := atomic.LoadInt64(&maxActive)
+			if n <= max || atomic.CompareAndSwapInt64(&maxActive, max, n) {
+				break
+			}
+		}
+		runtime.Gosched()
+		atomic.AddInt64(&active, -1)
+	}
+
+	for i := 0; i < 4; i++ {
+		snap, _ := db.NewSnapshot()
+		dir := fmt.Sprintf("db.dump.%d", i)
+		os.RemoveAll(dir)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer os.RemoveAll(dir)
+			if err := db.StoreToDisk(dir, snap, 4, callb); err != nil {
+				t.Errorf("Expected no error. got=%v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxActive > maxConcurr {
+		t.Errorf("Expected at most %d concurrent workers, got %d", maxConcurr, maxActive)
+	}
+}
+
+func TestDoubleClose(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	itr := snap1.NewIterator()
+	itr.Close()
+	itr.Close()
+
+	if snap1.refCount != 1 {
+		t.Errorf("Expected refcount 1, got %d", snap1.refCount)
+	}
+
+	for i := 0; i < 1000; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+	snap3, _ := w.NewSnapshot()
+	defer snap3.Close()
+
+	snap1.Close()
+	snap1.Close()
+	snap2.Close()
+	snap2.Close()
+
+	if snap1.refCount != 0 || snap2.refCount != 0 {
+		t.Errorf("Expected refcount 0, got %d, %d", snap1.refCount, snap2.refCount)
+	}
+
+	if snap1.Open() {
+		t.Errorf("Expected open of a closed snapshot to fail")
+	}
+
+	for db.store.GetStats().NodeCount != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClosedSnapshot(t *testing.T) {
+	os.RemoveAll("db.dump")
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	snap.Close()
+
+	if err := snap.Acquire(); err != ErrSnapshotClosed {
+		t.Errorf("Expected ErrSnapshotClosed, got=%v", err)
+	}
+
+	if itr := snap.NewIterator(); itr != nil {
+		t.Errorf("Expected nil iterator for closed snapshot")
+	}
+
+	callb := func(itm *Item, shard int) error {
+		return nil
+	}
+
+	if err := db.Visitor(snap, callb, 4, 4); err != ErrSnapshotClosed {
+		t.Errorf("Expected ErrSnapshotClosed, got=%v", err)
+	}
+
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != ErrSnapshotClosed {
+		t.Errorf("Expected ErrSnapshotClosed, got=%v", err)
+	}
+}
+
+func TestSnapshotLeakDetection(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	conf := DefaultConfig()
+	conf.SetSnapshotLeakThreshold(10 * time.Millisecond)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	snap1, _ := db.NewSnapshot()
+	snap1.Close()
+	snap2, _ := db.NewSnapshot()
+	time.Sleep(100 * time.Millisecond)
+	snap2.Close()
+
+	out := buf.String()
+	if !strings.Contains(out, "snapshot 2 has been open") {
+		t.Errorf("Expected leak warning for snapshot 2, got %s", out)
+	}
+
+	if strings.Contains(out, "snapshot 1 has been open") {
+		t.Errorf("Unexpected leak warning for snapshot 1")
+	}
+}
+
+func TestSnapshotLeakTinyThreshold(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	conf := DefaultConfig()
+	conf.SetSnapshotLeakThreshold(time.Nanosecond)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	snap, _ := db.NewSnapshot()
+	time.Sleep(20 * time.Millisecond)
+	snap.Close()
+
+	if out := buf.String(); !strings.Contains(out, "snapshot 1 has been open") {
+		t.Errorf("Expected leak warning for snapshot 1, got %s", out)
+	}
+}
+
+func TestDeadSnapshotsLimit(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	conf := testConf
+	conf.SetDeadSnapshotsLimit(10)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	snap1, _ := db.NewSnapshot()
+	snap1.Close()
+
+	w.Put([]byte("key"))
+	pin, _ := db.NewSnapshot()
+	for i := 0; i < 20; i++ {
+		w.Delete([]byte("key"))
+		w.Put([]byte("key"))
+		snap, _ := db.NewSnapshot()
+		snap.Close()
+	}
+
+	if n := db.DeadSnapshotsCount(); n != 20 {
+		t.Errorf("Expected 20 dead snapshots, got=%d", n)
+	}
+
+	out := buf.String()
+	if strings.Count(out, "blocked by snapshot") != 1 ||
+		!strings.Contains(out, fmt.Sprintf("blocked by snapshot %d ", pin.sn)) {
+		t.Errorf("Expected a warning about snapshot %d, got %s", pin.sn, out)
+	}
+
+	pin.Close()
+	if n := db.DeadSnapshotsCount(); n != 0 {
+		t.Errorf("Expected no dead snapshots, got=%d", n)
+	}
+}
+
+func TestSwapStore(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("old-%05d", i)))
+	}
+	oldSnap, _ := db.NewSnapshot()
+	itr := oldSnap.NewIterator()
+
+	l := db.NewLoader()
+	seg := l.AddSegment()
+	for i := 0; i < 500; i++ {
+		seg.AddSortedItems([]byte(fmt.Sprintf("new-%05d", i)))
+	}
+	store, n, _ := l.Assemble()
+
+	newSnap, err := db.SwapStore(store, n)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	count := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if !bytes.HasPrefix(itr.Get(), []byte("old-")) {
+			t.Errorf("Unexpected item %s in old snapshot", itr.Get())
+		}
+		count++
+	}
+	if count != 1000 {
+		t.Errorf("Expected 1000 items in old snapshot, got %d", count)
+	}
+	itr.Close()
+	oldSnap.Close()
+
+	VerifyCount(newSnap, 500, t)
+	newSnap.Close()
+
+	w.Put([]byte("new-99999"))
+	w.Delete([]byte("new-00000"))
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	VerifyCount(snap, 500, t)
+
+	itr = snap.NewIterator()
+	defer itr.Close()
+	itr.SeekFirst()
+	if !itr.Valid() || string(itr.Get()) != "new-00001" {
+		t.Errorf("Expected new-00001 as the first item")
+	}
+}
+
+func TestClear(t *testing.T) {
+	conf := testConf
+	conf.AddIndex("first", func(itm *Item) []byte { return itm.Bytes()[:1] })
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	indexCount := func(snap *Snapshot) int {
+		n := 0
+		db.IndexScan(snap, "first", nil, nil, func(ikey, data []byte) bool {
+			n++
+			return true
+		})
+		return n
+	}
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%05d", i)))
+	}
+	oldSnap, _ := db.NewSnapshot()
+	defer oldSnap.Close()
+
+	if err := db.Clear(); err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+
+	if cnt := db.ItemsCount(); cnt != 0 {
+		t.Errorf("Expected zero items, got=%d", cnt)
+	}
+
+	snap, _ := db.NewSnapshot()
+	VerifyCount(snap, 0, t)
+	itr := snap.NewIterator()
+	if itr.SeekFirst(); itr.Valid() {
+		t.Errorf("Expected no items after clear, got=%s", itr.Get())
+	}
+	itr.Close()
+	if n := indexCount(snap); n != 0 {
+		t.Errorf("Expected empty index after clear, got=%d", n)
+	}
+	snap.Close()
+
+	// Snapshots created before clear continue to see the old items
+	VerifyCount(oldSnap, 1000, t)
+	if n := indexCount(oldSnap); n != 1000 {
+		t.Errorf("Expected 1000 index entries in old snapshot, got=%d", n)
+	}
+
+	for i := 0; i < 10; i++ {
+		w.Put([]byte(fmt.Sprintf("%05d", i)))
+	}
+	snap, _ = db.NewSnapshot()
+	VerifyCount(snap, 10, t)
+	if n := indexCount(snap); n != 10 {
+		t.Errorf("Expected 10 index entries, got=%d", n)
+	}
+	snap.Close()
+}
+
+func TestSwapStoreFree(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("Memory management is supported only on amd64")
+	}
+
+	var allocs, frees int64
+	conf := DefaultConfig()
+	conf.UseMemoryMgmt(func(sz int) unsafe.Pointer {
+		atomic.AddInt64(&allocs, 1)
+		return mm.Malloc(sz)
+	}, func(p unsafe.Pointer) {
+		atomic.AddInt64(&frees, 1)
+		mm.Free(p)
+	})
+
+	for _, collect := range []bool{true, false} {
+		allocs, frees = 0, 0
+		db := NewWithConfig(conf)
+		w := db.NewWriter()
+		for i := 0; i < 1000; i++ {
+			w.Put([]byte(fmt.Sprintf("old-%05d", i)))
+		}
+		oldSnap, _ := db.NewSnapshot()
+
+		l := db.NewLoader()
+		seg := l.AddSegment()
+		for i := 0; i < 500; i++ {
+			seg.AddSortedItems([]byte(fmt.Sprintf("new-%05d", i)))
+		}
+		store, n, _ := l.Assemble()
+		newSnap, _ := db.SwapStore(store, n)
+		newSnap.Close()
+
+		if collect {
+			// The old store is freed once its last snapshot is collected
+			oldSnap.Close()
+			deadline := time.Now().Add(5 * time.Second)
+			for atomic.LoadInt64(&frees) < 2000 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+
+			if f := atomic.LoadInt64(&frees); f < 2000 {
+				t.Errorf("Expected the old store to be freed, got=%d frees", f)
+			}
+		} else {
+			// Block the collection of the old store snapshots until close
+			atomic.StoreInt32(&db.isGCRunning, 1)
+			oldSnap.Close()
+			atomic.StoreInt32(&db.isGCRunning, 0)
+		}
+
+		db.Close()
+		if a, f := atomic.LoadInt64(&allocs), atomic.LoadInt64(&frees); a != f {
+			t.Errorf("Expected all %d allocations to be freed after close, got=%d", a, f)
+		}
+	}
+}
+
+func TestPutStatus(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	if inserted, n, _ := w.PutStatus([]byte("key")); !inserted || n == nil {
+		t.Errorf("Expected first insert to succeed")
+	}
+
+	// Duplicate in the same snapshot number replaces the item
+	if inserted, n, _ := w.PutStatus([]byte("key")); !inserted || n == nil {
+		t.Errorf("Expected duplicate insert to replace the item")
+	}
+
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+
+	// Duplicate in a later snapshot number
+	if inserted, _, _ := w.PutStatus([]byte("key")); inserted {
+		t.Errorf("Expected duplicate insert to fail")
+	}
+
+	// Overwrite in a later snapshot number
+	w.Delete([]byte("key"))
+	if inserted, n, _ := w.PutStatus([]byte("key")); !inserted || n == nil {
+		t.Errorf("Expected overwrite to succeed")
+	}
+
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+	VerifyCount(snap1, 1, t)
+	VerifyCount(snap2, 1, t)
+}
+
+func TestMergeBackups(t *testing.T) {
+	defer os.RemoveAll("db.dump")
+	os.RemoveAll("db.dump")
+
+	keyCmp := func(a, b []byte) int {
+		return bytes.Compare(a[:6], b[:6])
+	}
+
+	conf := testConf
+	conf.SetKeyComparator(keyCmp)
+
+	backup := func(dir string, start, end int, val string) {
+		db := NewWithConfig(conf)
+		defer db.Close()
+
+		w := db.NewWriter()
+		for i := start; i < end; i++ {
+			w.Put([]byte(fmt.Sprintf("k%05d:%s", i, val)))
+		}
+		snap, _ := db.NewSnapshot()
+		if err := db.StoreToDisk(dir, snap, 4, nil); err != nil {
+			t.Fatalf("Expected no error. got=%v", err)
+		}
+	}
+
+	backup("db.dump/b1", 0, 1000, "old")
+	backup("db.dump/b2", 500, 1500, "new")
+
+	dirs := []string{"db.dump/b1", "db.dump/b2"}
+	instances := atomic.LoadInt64(&dbInstancesCount)
+	if err := MergeBackups(dirs, "db.dump/merged", keyCmp); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	if n := atomic.LoadInt64(&dbInstancesCount); n != instances {
+		t.Errorf("Expected no nitro instance to be created, got %d", n-instances)
+	}
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+	snap, err := db.LoadFromDisk("db.dump/merged", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer snap.Close()
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+	i := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		val := "old"
+		if i >= 500 {
+			val = "new"
+		}
+
+		if exp := fmt.Sprintf("k%05d:%s", i, val); string(itr.Get()) != exp {
+			t.Errorf("Expected %s, got %s", exp, itr.Get())
+		}
+		i++
+	}
+
+	if i != 1500 {
+		t.Errorf("Expected 1500 items, got %d", i)
+	}
+}
+
+func TestItemSn(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	n := w.Put2([]byte("key"))
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+
+	w.Delete([]byte("key"))
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+
+	itm := (*Item)(n.Item())
+	if itm.BornSn() != 1 {
+		t.Errorf("Expected bornSn 1, got %d", itm.BornSn())
+	}
+
+	if itm.DeadSn() != 2 || !itm.IsDeleted() {
+		t.Errorf("Expected deadSn 2, got %d", itm.DeadSn())
+	}
+}
+
+func TestStoreDiskTiny(t *testing.T) {
+	defer os.RemoveAll("db.dump")
+	os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 3; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	snap.Open()
+	defer snap.Close()
+
+	var shards [64]int64
+	callb := func(itm *Item, shard int) error {
+		atomic.AddInt64(&shards[shard], 1)
+		return nil
+	}
+
+	if err := db.Visitor(snap, callb, 64, 64); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	// Only the leading shards should be used and none of them are empty
+	used := 0
+	for used < len(shards) && shards[used] != 0 {
+		used++
+	}
+
+	for shard := used; shard < len(shards); shard++ {
+		if shards[shard] != 0 {
+			t.Errorf("Unexpected items in shard %d after an empty shard", shard)
+		}
+	}
+
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	bs, _ := ioutil.ReadFile("db.dump/data/files.json")
+	mf, _ := db.decodeManifest(bs)
+	if len(mf.Files) == 0 || len(mf.Files) > 3 {
+		t.Errorf("Expected at most 3 shards, got %d", len(mf.Files))
+	}
+
+	for _, file := range mf.Files {
+		r := db.newFileReader(mf.FileType)
+		r.Open(filepath.Join("db.dump/data", file))
+		if itm, _ := r.ReadItem(); itm == nil {
+			t.Errorf("Expected non-empty shard %s", file)
+		}
+		r.Close()
+	}
+}
+
+func TestStoreDiskEmpty(t *testing.T) {
+	defer os.RemoveAll("db.dump")
+	os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	db.Close()
+
+	db = NewWithConfig(testConf)
+	defer db.Close()
+	snap, err := db.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	VerifyCount(snap, 0, t)
+	snap.Close()
+}
+
+func TestLoadDiskSkipEmptyShards(t *testing.T) {
+	defer os.RemoveAll("db.dump")
+	os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	w := db.NewWriter()
+	for i := 0; i < 3; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	bs, _ := ioutil.ReadFile("db.dump/data/files.json")
+	mf, _ := db.decodeManifest(bs)
+	if len(mf.Files) > 3 {
+		t.Errorf("Expected at most 3 shards, got %d", len(mf.Files))
+	}
+
+	// Older backups list empty shards in the manifest
+	files := mf.Files
+	for i := 0; i < 4; i++ {
+		file := fmt.Sprintf("shard-empty-%d", i)
+		fw := db.newFileWriter(RawdbFile)
+		fw.Open(filepath.Join("db.dump/data", file))
+		fw.Close()
+		files = append(files, file)
+	}
+	bs, _ = json.Marshal(files)
+	ioutil.WriteFile("db.dump/data/files.json", bs, 0660)
+	db.Close()
+
+	db = NewWithConfig(testConf)
+	defer db.Close()
+	if got := db.nonEmptyFiles("db.dump/data", files, mf.FileType); len(got) != len(mf.Files) {
+		t.Errorf("Expected %d non-empty files, got %v", len(mf.Files), got)
+	}
+
+	// The empty size depends on the file type
+	for _, fileType := range []FileType{RawdbFile, RawdbFileV2} {
+		fw := db.newFileWriter(fileType)
+		fw.Open("db.dump/data/shard-empty")
+		fw.Close()
+		fw.Open("db.dump/data/shard-one")
+		fw.WriteItem(db.newItem([]byte("key"), false))
+		fw.Close()
+
+		got := db.nonEmptyFiles("db.dump/data", []string{"shard-empty", "shard-one"}, fileType)
+		if len(got) != 1 || got[0] != "shard-one" {
+			t.Errorf("Expected only shard-one for file type %d, got %v", fileType, got)
+		}
+	}
+	os.Remove("db.dump/data/shard-empty")
+	os.Remove("db.dump/data/shard-one")
+
+	snap, err := db.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	VerifyCount(snap, 3, t)
+	snap.Close()
+}
+
+func TestIOBufferSizes(t *testing.T) {
+	defer os.RemoveAll("db.dump")
+	os.RemoveAll("db.dump")
+
+	conf := testConf
+	conf.SetIOBufferSizes(64, 64)
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		bs := make([]byte, 10000)
+		copy(bs, fmt.Sprintf("%010d", i))
+		w.Put(bs)
+	}
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	db.Close()
+
+	db = NewWithConfig(conf)
+	defer db.Close()
+	snap, err := db.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer snap.Close()
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+	i := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if bs := itr.Get(); len(bs) != 10000 || string(bs[:10]) != fmt.Sprintf("%010d", i) {
+			t.Errorf("Unexpected item %d", i)
+		}
+		i++
+	}
+
+	if i != 100 {
+		t.Errorf("Expected 100 items, got %d", i)
+	}
+}
+
+func TestEncodeItemLimits(t *testing.T) {
+	db := New()
+	defer db.Close()
+
+	var out bytes.Buffer
+	itm := db.newItem([]byte("key"), false)
+	if err := db.EncodeItem(itm, make([]byte, ItemHeaderEncodeSize-1), &out); err != ErrNotEnoughSpace {
+		t.Errorf("Expected ErrNotEnoughSpace, got=%v", err)
+	}
+
+	buf := make([]byte, ItemHeaderEncodeSize)
+	itm = db.newItem(make([]byte, MaxEncodedItemLen), false)
+	if err := db.EncodeItem(itm, buf, &out); err != nil {
+		t.Errorf("Expected no error. got=%v", err)
+	}
+
+	if n := int64(out.Len()); n != EncodedItemSize(itm) {
+		t.Errorf("Expected %d encoded bytes, got %d", EncodedItemSize(itm), n)
+	}
+
+	if got, err := db.DecodeItem(buf, &out); err != nil || len(got.Bytes()) != MaxEncodedItemLen {
+		t.Errorf("Expected to decode item, got err=%v", err)
+	}
+
+	out.Reset()
+	itm = db.newItem(make([]byte, MaxEncodedItemLen+1), false)
+	if err := db.EncodeItem(itm, buf, &out); err != ErrItemTooLarge || out.Len() != 0 {
+		t.Errorf("Expected ErrItemTooLarge, got=%v", err)
+	}
+
+	if _, err := db.DecodeItem(buf[:1], &out); err != ErrNotEnoughSpace {
+		t.Errorf("Expected ErrNotEnoughSpace, got=%v", err)
+	}
+
+	var snap Snapshot
+	if err := snap.Decode(make([]byte, 3), &out); err != ErrNotEnoughSpace {
+		t.Errorf("Expected ErrNotEnoughSpace, got=%v", err)
+	}
+
+	out.Reset()
+	if err := snap.Encode(make([]byte, 3), &out); !errors.Is(err, ErrNotEnoughSpace) || out.Len() != 0 {
+		t.Errorf("Expected ErrNotEnoughSpace, got=%v", err)
+	}
+
+	snap.sn = 10
+	if err := snap.Encode(make([]byte, SnapshotEncodeSize), &out); err != nil {
+		t.Errorf("Expected no error, got=%v", err)
+	}
+
+	var snap2 Snapshot
+	if err := snap2.Decode(make([]byte, SnapshotEncodeSize), &out); err != nil || snap2.sn != 10 {
+		t.Errorf("Expected to decode snapshot 10, got=%d, err=%v", snap2.sn, err)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	conf := DefaultConfig()
+	if err := conf.SetFileType(FileType(100)); !errors.Is(err, ErrInvalidFileType) {
+		t.Errorf("Expected ErrInvalidFileType, got=%v", err)
+	}
+
+	db := NewWithConfig(conf)
+	var out bytes.Buffer
+	itm := db.newItem([]byte("key"), false)
+	if err := db.EncodeItem(itm, nil, &out); !errors.Is(err, ErrNotEnoughSpace) {
+		t.Errorf("Expected ErrNotEnoughSpace, got=%v", err)
+	}
+
+	snap, _ := db.NewSnapshot()
+	snap.Close()
+	if err := snap.Acquire(); !errors.Is(err, ErrSnapshotClosed) {
+		t.Errorf("Expected ErrSnapshotClosed, got=%v", err)
+	}
+
+	db.Close()
+	if err := db.Compact(); !errors.Is(err, ErrDBClosed) {
+		t.Errorf("Expected ErrDBClosed, got=%v", err)
+	}
+}
+
+func TestIteratorSeekExact(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 100; i += 2 {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+
+	if !itr.SeekExact([]byte(fmt.Sprintf("%010d", 10))) {
+		t.Errorf("Expected to find exact match")
+	}
+
+	if itr.SeekExact([]byte(fmt.Sprintf("%010d", 11))) {
+		t.Errorf("Unexpected exact match")
+	}
+
+	if exp := fmt.Sprintf("%010d", 12); !itr.Valid() || string(itr.Get()) != exp {
+		t.Errorf("Expected iterator at %s", exp)
+	}
+
+	if itr.SeekExact([]byte(fmt.Sprintf("%010d", 99))) || itr.Valid() {
+		t.Errorf("Expected iterator to be invalid")
+	}
+}
+
+func TestDescendingComparator(t *testing.T) {
+	conf := testConf
+	conf.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	})
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	var snaps []*Snapshot
+	for v := 0; v < 3; v++ {
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("%010d", i))
+			if v > 0 {
+				w.Delete(key)
+			}
+			w.Put(key)
+		}
+		snap, _ := db.NewSnapshot()
+		snaps = append(snaps, snap)
+	}
+
+	for i := 0; i < 10; i++ {
+		n := w.GetNode([]byte(fmt.Sprintf("%010d", i)))
+		if n == nil {
+			t.Fatalf("Expected to find key %d", i)
+		}
+
+		if itm := (*Item)(n.Item()); itm.BornSn() != 3 || itm.IsDeleted() {
+			t.Errorf("Expected latest version, got bornSn=%d deadSn=%d", itm.BornSn(), itm.DeadSn())
+		}
+	}
+
+	for _, snap := range snaps {
+		itr := snap.NewIterator()
+		i := 9
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			if exp := fmt.Sprintf("%010d", i); string(itr.Get()) != exp {
+				t.Errorf("Expected %s, got %s", exp, itr.Get())
+			}
+			i--
+		}
+		itr.Close()
+
+		if i != -1 {
+			t.Errorf("Expected 10 items in snapshot %d", snap.sn)
+		}
+		snap.Close()
+	}
+}
+
+func TestLoader(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	l := db.NewLoader()
+	for s := 0; s < 4; s++ {
+		seg := l.AddSegment()
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := s * 1000; i < (s+1)*1000; i++ {
+				seg.AddSortedItems([]byte(fmt.Sprintf("%010d", i)))
+			}
+		}(s)
+	}
+	l.AddSegment() // Empty segments are allowed
+	wg.Wait()
+
+	snap, err := l.Finish()
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer snap.Close()
+	VerifyCount(snap, 4000, t)
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+	i := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if exp := fmt.Sprintf("%010d", i); string(itr.Get()) != exp {
+			t.Errorf("Expected %s, got %s", exp, itr.Get())
+		}
+		i++
+	}
+
+	// Overlapping segments
+	l = db.NewLoader()
+	l.AddSegment().AddSortedItems([]byte("a"), []byte("c"))
+	l.AddSegment().AddSortedItems([]byte("b"), []byte("d"))
+	if _, err := l.Finish(); err != ErrNotSorted {
+		t.Errorf("Expected ErrNotSorted, got=%v", err)
+	}
+
+	// Unsorted segment
+	l = db.NewLoader()
+	if err := l.AddSegment().AddSortedItems([]byte("b"), []byte("a")); err != ErrNotSorted {
+		t.Errorf("Expected ErrNotSorted, got=%v", err)
+	}
+	l.Abort()
+}
+
+func TestLoaderFree(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("Memory management is supported only on amd64")
+	}
+
+	var allocs, frees int64
+	conf := DefaultConfig()
+	conf.UseMemoryMgmt(func(sz int) unsafe.Pointer {
+		atomic.AddInt64(&allocs, 1)
+		return mm.Malloc(sz)
+	}, func(p unsafe.Pointer) {
+		atomic.AddInt64(&frees, 1)
+		mm.Free(p)
+	})
+
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	snap.Close()
+
+	// Aborting a finished loader has no effect
+	load := func(items ...string) (*Snapshot, error) {
+		l := db.NewLoader()
+		defer l.Abort()
+		seg := l.AddSegment()
+		for _, itm := range items {
+			seg.AddSortedItems([]byte(itm))
+		}
+		return l.Finish()
+	}
+
+	snap, err := load("a", "b", "c")
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	VerifyCount(snap, 3, t)
+	snap.Close()
+
+	// A failed loader is aborted once
+	if _, err := load("b", "a"); err != ErrNotSorted {
+		t.Errorf("Expected ErrNotSorted, got=%v", err)
+	}
+
+	db.Close()
+	if a, f := atomic.LoadInt64(&allocs), atomic.LoadInt64(&frees); a != f {
+		t.Errorf("Expected all %d allocations to be freed after close, got=%d", a, f)
+	}
+}
+
+func TestBackupStats(t *testing.T) {
+	defer os.RemoveAll("db.dump")
+	os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	w := db.NewWriter()
+	for i := 0; i < 100000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	stats, err := db.StoreToDisk2("db.dump", snap, 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	db.Close()
+
+	bs, _ := ioutil.ReadFile("db.dump/data/files.json")
+	mf, _ := db.decodeManifest(bs)
+	var size int64
+	for _, file := range mf.Files {
+		fi, _ := os.Stat(filepath.Join("db.dump/data", file))
+		size += fi.Size()
+	}
+
+	if stats.BytesWritten == 0 || stats.BytesWritten != size {
+		t.Errorf("Expected %d bytes written, got %d", size, stats.BytesWritten)
+	}
+
+	if stats.ItemsWritten != 100000 || stats.ShardCount != len(mf.Files) {
+		t.Errorf("Unexpected backup stats %+v", stats)
+	}
+
+	db = NewWithConfig(testConf)
+	defer db.Close()
+	snap, lstats, err := db.LoadFromDisk2("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	snap.Close()
+
+	if lstats.BytesRead != size || lstats.ItemsRead != 100000 || lstats.ShardCount != len(mf.Files) {
+		t.Errorf("Unexpected load stats %+v", lstats)
+	}
+}
+
+func TestSnapshotClosedCallback(t *testing.T) {
+	var closed []uint32
+	conf := testConf
+	conf.SetSnapshotClosedCallback(func(sn uint32) {
+		closed = append(closed, sn)
+	})
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	snap1, _ := db.NewSnapshot()
+	snap2, _ := db.NewSnapshot()
+	snap1.Open()
+
+	snap1.Close()
+	if len(closed) != 0 {
+		t.Errorf("Unexpected callback for a referenced snapshot")
+	}
+
+	snap2.Close()
+	snap1.Close()
+	snap1.Close()
+	if len(closed) != 2 || closed[0] != 2 || closed[1] != 1 {
+		t.Errorf("Expected callbacks for snapshots 2 and 1, got %v", closed)
+	}
+}
+
+func doDeleteAll(b testing.TB, gcWorkers int, n int) {
+	conf := testConf
+	if err := conf.SetGCWorkers(gcWorkers, 1024); err != nil {
+		b.Fatalf("Expected no error, got=%v", err)
+	}
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	if count := db.numWriters(); count != 1 {
+		b.Errorf("Expected 1 writer, got %d", count)
+	}
+
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	// Spread the deletes across many snapshots
+	for i := 0; i < n; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+		if i%100 == 0 {
+			snap, _ := db.NewSnapshot()
+			snap.Close()
+		}
+	}
+	snap, _ := db.NewSnapshot()
+	snap.Close()
+	db.Compact()
+
+	if nodes := db.store.GetStats().NodeCount; nodes != 0 {
+		b.Errorf("Expected all nodes to be reclaimed, got %d", nodes)
+	}
+}
+
+func TestGCWorkers(t *testing.T) {
+	doDeleteAll(t, 4, 100000)
+
+	conf := testConf
+	if err := conf.SetGCWorkers(-1, 1024); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig, got=%v", err)
+	}
+
+	if err := conf.SetGCWorkers(4, -1); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig, got=%v", err)
+	}
+}
+
+func TestGCWorkersDeltaBackup(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	conf := testConf
+	conf.SetGCWorkers(4, 16)
+	db := NewWithConfig(conf)
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+
+	// The items deleted during the backup are collected by any of the workers
+	var once sync.Once
+	callb := func(*ItemEntry) {
+		once.Do(func() {
+			for i := 0; i < 1000; i++ {
+				w.Delete([]byte(fmt.Sprintf("%010d", i)))
+			}
+			snap, _ := db.NewSnapshot()
+			snap.Close()
+			time.Sleep(100 * time.Millisecond)
+		})
+	}
+
+	if err := db.StoreToDisk("db.dump", snap, 1, callb); err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	db.Close()
+
+	db = NewWithConfig(testConf)
+	defer db.Close()
+	snap, err := db.LoadFromDisk("db.dump", 1, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+
+	VerifyCount(snap, 1000, t)
+	snap.Close()
+}
+
+func BenchmarkGCWorkers(b *testing.B) {
+	for _, workers := range []int{0, 4} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				doDeleteAll(b, workers, 100000)
+			}
+		})
+	}
+}
+
+func TestPutSameSnReplace(t *testing.T) {
+	conf := testConf
+	conf.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(a[:3], b[:3])
+	})
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	w.Put([]byte("key:v1"))
+	w.Put([]byte("key:v2"))
+
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+	VerifyCount(snap1, 1, t)
+
+	itr := snap1.NewIterator()
+	itr.SeekFirst()
+	if !itr.Valid() || string(itr.Get()) != "key:v2" {
+		t.Errorf("Expected key:v2 to win")
+	}
+	itr.Close()
+
+	// Items from an earlier snapshot number are not replaced
+	w.Put([]byte("key:v3"))
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+	VerifyCount(snap2, 1, t)
+
+	itr = snap2.NewIterator()
+	itr.SeekFirst()
+	if !itr.Valid() || string(itr.Get()) != "key:v2" {
+		t.Errorf("Expected key:v2 to be retained")
+	}
+	itr.Close()
+}
+
+func TestPutInPlace(t *testing.T) {
+	conf := testConf
+	conf.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(a[:3], b[:3])
+	})
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.PutInPlace([]byte(fmt.Sprintf("key:%05d", i)))
+	}
+
+	if allocs := db.aggrStoreStats().NodeAllocs; allocs != 1 {
+		t.Errorf("Expected a single node allocation, got %d", allocs)
+	}
+
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+
+	// Items from an earlier snapshot number are not modified
+	w.Delete([]byte("key"))
+	w.PutInPlace([]byte("key:final"))
+	w.PutInPlace([]byte("key:x"))
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+
+	for snap, exp := range map[*Snapshot]string{snap1: "key:09999", snap2: "key:x"} {
+		VerifyCount(snap, 1, t)
+		itr := snap.NewIterator()
+		itr.SeekFirst()
+		if !itr.Valid() || string(itr.Get()) != exp {
+			t.Errorf("Expected %s", exp)
+		}
+		itr.Close()
+	}
+}
+
+func TestRawIterator(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 0; i < 5; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+	VerifyCount(snap2, 5, t)
+
+	itr := db.NewRawIterator(snap2)
+	defer itr.Close()
+
+	var live, dead int
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		itm := itr.GetItem()
+		if itm.IsDeleted() {
+			if itm.DeadSn() != 2 {
+				t.Errorf("Expected deadSn 2, got %d", itm.DeadSn())
+			}
+			dead++
+		} else {
+			live++
+		}
+	}
+
+	if live != 5 || dead != 5 {
+		t.Errorf("Expected 5 live and 5 dead items, got %d, %d", live, dead)
+	}
+}
+
+func TestConfigImmutable(t *testing.T) {
+	conf := DefaultConfig()
+	if err := conf.SetFileType(FileType(-1)); err != ErrInvalidFileType {
+		t.Errorf("Expected ErrInvalidFileType, got=%v", err)
+	}
+
+	conf.fileType = FileType(-1)
+	if _, err := NewWithConfigChecked(conf); err != ErrInvalidFileType {
+		t.Errorf("Expected ErrInvalidFileType, got=%v", err)
+	}
+
+	conf = DefaultConfig()
+	db, err := NewWithConfigChecked(conf)
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	defer db.Close()
+
+	// Modifying the original config should not affect the instance
+	conf.SetKeyComparator(func(a, b []byte) int { return bytes.Compare(b, a) })
+	w := db.NewWriter()
+	for i := 0; i < 10; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+	itr := snap.NewIterator()
+	defer itr.Close()
+	itr.SeekFirst()
+	if !itr.Valid() || string(itr.Get()) != fmt.Sprintf("%010d", 0) {
+		t.Errorf("Expected ascending order of items")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected panic on config modification")
+		}
+	}()
+	db.UseDeltaInterleaving()
+}
+
+func TestNewWithInvalidConfig(t *testing.T) {
+	var conf Config
+	db, err := NewWithConfigChecked(conf)
+	if db != nil || !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Expected ErrInvalidConfig, got=%v", err)
+	}
+
+	if !strings.Contains(err.Error(), "key comparator") {
+		t.Errorf("Expected missing key comparator error, got=%v", err)
+	}
+
+	conf.SetKeyComparator(defaultKeyCmp)
+	conf.fileType = FileType(-1)
+	if _, err := NewWithConfigChecked(conf); err != ErrInvalidFileType {
+		t.Errorf("Expected ErrInvalidFileType, got=%v", err)
+	}
+}
+
+func TestPurgeRange(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i += 2 {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+
+	// Items added after the latest snapshot are removed immediately
+	for i := 1; i < 1000; i += 2 {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	start, end := []byte(fmt.Sprintf("%010d", 100)), []byte(fmt.Sprintf("%010d", 200))
+	if n := w.PurgeRange(start, end); n != 100 {
+		t.Errorf("Expected 100 purged items, got=%d", n)
+	}
+
+	if n := w.PurgeRange(start, end); n != 0 {
+		t.Errorf("Expected no purged items, got=%d", n)
+	}
+
+	snap2, _ := w.NewSnapshot()
+	VerifyCount(snap1, 500, t)
+	VerifyCount(snap2, 900, t)
+
+	itr := snap1.NewIterator()
+	itr.Seek(start)
+	if !itr.Valid() || string(itr.Get()) != string(start) {
+		t.Errorf("Expected purged item to be visible to older snapshot")
+	}
+	itr.Close()
+
+	snap1.Close()
+	snap2.Close()
+	snap3, _ := w.NewSnapshot()
+	defer snap3.Close()
+	db.Compact()
+
+	var count int
+	itr = db.NewRawIterator(snap3)
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		count++
+	}
+	itr.Close()
+
+	if count != 900 || db.ItemsCount() != 900 {
+		t.Errorf("Expected 900 items after gc, got=%d, %d", count, db.ItemsCount())
+	}
+
+	if n := w.PurgeRange(nil, nil); n != 900 {
+		t.Errorf("Expected 900 purged items, got=%d", n)
+	}
+}
+
+func TestDeleteCurrent(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	var i, deleted int
+	itr := snap1.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); i++ {
+		if exp := fmt.Sprintf("%010d", i); string(itr.Get()) != exp {
+			t.Fatalf("Expected %s, got=%s", exp, string(itr.Get()))
+		}
+
+		if i%2 == 0 {
+			if !w.DeleteCurrent(itr) {
+				t.Errorf("Expected delete to succeed for %d", i)
+			}
+			deleted++
+		} else {
+			itr.Next()
+		}
+	}
+	itr.Close()
+
+	if i != 1000 || deleted != 500 {
+		t.Errorf("Expected 1000 items and 500 deletes, got=%d, %d", i, deleted)
+	}
+
+	if w.DeleteCurrent(itr) {
+		t.Errorf("Expected delete to fail on an invalid iterator")
+	}
+
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+	VerifyCount(snap1, 1000, t)
+	VerifyCount(snap2, 500, t)
+
+	itr = snap2.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		var v int
+		fmt.Sscanf(string(itr.Get()), "%d", &v)
+		if v%2 == 0 {
+			t.Errorf("Unexpected item %d", v)
+		}
+	}
+	if db.ItemsCount() != 500 {
+		t.Errorf("Expected 500 items, got=%d", db.ItemsCount())
+	}
+}
+
+func TestMemoryWatermarks(t *testing.T) {
+	type event struct {
+		high bool
+		mem  int64
+	}
+
+	events := make(chan event, 10)
+	conf := testConf
+	conf.SetMemoryWatermarks(10000, 100000, func(high bool, mem int64) {
+		events <- event{high, mem}
+	})
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	waitEvent := func(high bool) {
+		select {
+		case e := <-events:
+			if e.high != high {
+				t.Errorf("Expected high=%v event, got=%v", high, e.high)
+			}
+			if high && e.mem < 100000 || !high && e.mem > 10000 {
+				t.Errorf("Unexpected memory in use %d for high=%v event", e.mem, high)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected high=%v event", high)
+		}
+	}
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	waitEvent(true)
+
+	for i := 0; i < 10000; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	snap.Close()
+	snap, _ = w.NewSnapshot()
+	snap.Close()
+	db.Compact()
+	waitEvent(false)
+
+	time.Sleep(3 * memSamplePeriod)
+	if len(events) != 0 {
+		t.Errorf("Unexpected events")
+	}
+}
+
+// NewSnapshot visits only the writers modified since the latest snapshot.
+// Hence, its cost is proportional to the number of modified writers and
+// dirty-256 matches visiting every writer.
+func BenchmarkSnapshotManyWriters(b *testing.B) {
+	for _, dirty := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("dirty-%d", dirty), func(b *testing.B) {
+			db := NewWithConfig(testConf)
+			defer db.Close()
+
+			var writers []*Writer
+			for i := 0; i < 256; i++ {
+				writers = append(writers, db.NewWriter())
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j := 0; j < dirty; j++ {
+					w := writers[(i*dirty+j)%len(writers)]
+					w.Put([]byte(fmt.Sprintf("%010d", i*dirty+j)))
+				}
+				b.StartTimer()
+
+				snap, _ := db.NewSnapshot()
+
+				b.StopTimer()
+				snap.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// Concurrent writers insert disjoint keys. The writers count their items
+// locally, while the memory usage of the store is still a shared counter.
+func BenchmarkParallelPut(b *testing.B) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	var id int64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		w := db.NewWriter()
+		var key [16]byte
+		binary.BigEndian.PutUint64(key[:8], uint64(atomic.AddInt64(&id, 1)))
+		for i := uint64(0); pb.Next(); i++ {
+			binary.BigEndian.PutUint64(key[8:], i)
+			w.Put(key[:])
+		}
+	})
+}
+
+func TestItemsCountConcurrent(t *testing.T) {
+	const writers = 8
+	const n = 10000
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	// Writers add the same keys and delete every third key concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(w *Writer) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				w.Put([]byte(fmt.Sprintf("%06d", j)))
+			}
+
+			for j := 0; j < n; j += 3 {
+				w.Delete([]byte(fmt.Sprintf("%06d", j)))
+			}
+		}(db.NewWriter())
+	}
+	wg.Wait()
+
+	if db.ItemsCount() != 0 {
+		t.Errorf("Expected count to be published by a snapshot, got=%d", db.ItemsCount())
+	}
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	exp := int64(n - (n+2)/3)
+	if db.ItemsCount() != exp || int64(CountItems(snap)) != exp {
+		t.Errorf("Expected %d items, got=%d, %d", exp, db.ItemsCount(), CountItems(snap))
+	}
+}
+
+func TestConcurrentDeleteSameKey(t *testing.T) {
+	const writers = 8
+	const n = 100000
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for j := 0; j < n; j++ {
+		w.Put([]byte(fmt.Sprintf("%06d", j)))
+	}
+	snap1, _ := db.NewSnapshot()
+
+	// Every other key is replaced after the snapshot and removed in place
+	for j := 0; j < n; j += 2 {
+		w.Delete([]byte(fmt.Sprintf("%06d", j)))
+		w.Put([]byte(fmt.Sprintf("%06d", j)))
+	}
+
+	// Writers delete the same keys concurrently and only one of them succeeds
+	var wg sync.WaitGroup
+	var deleted int64
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(w *Writer) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				if w.Delete([]byte(fmt.Sprintf("%06d", j))) {
+					atomic.AddInt64(&deleted, 1)
+				}
+			}
+		}(db.NewWriter())
+	}
+	wg.Wait()
+
+	if deleted != n {
+		t.Errorf("Expected %d deletes, got=%d", n, deleted)
+	}
+
+	snap2, _ := db.NewSnapshot()
+	snap1.Close()
+	snap2.Close()
+	db.Compact()
+
+	if count := db.store.GetStats().NodeCount; count != 0 {
+		t.Errorf("Expected all nodes to be collected, got=%d", count)
+	}
+}
+
+func TestForceCollect(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+
+	for i := 0; i < 50; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+
+	if err := db.ForceCollect(snap2); err != ErrSnapshotInUse {
+		t.Errorf("Expected ErrSnapshotInUse, got=%v", err)
+	}
+
+	snap2.Close()
+	if err := db.ForceCollect(snap2); !errors.Is(err, ErrOlderSnapshotOpen) ||
+		!strings.Contains(err.Error(), "snapshot 1 blocks") {
+		t.Errorf("Expected ErrOlderSnapshotOpen for snapshot 1, got=%v", err)
+	}
+
+	if n := db.VersionCount([]byte(fmt.Sprintf("%010d", 0))); n != 1 {
+		t.Errorf("Expected deleted item to be present, got=%d", n)
+	}
+
+	snap1.Close()
+	if err := db.ForceCollect(snap2); err != nil {
+		t.Errorf("Expected no error, got=%v", err)
+	}
+
+	if db.LastGCSn() < snap2.sn {
+		t.Errorf("Expected last gc sn >= %d, got=%d", snap2.sn, db.LastGCSn())
+	}
+
+	for i := 0; i < 100; i++ {
+		exp := 0
+		if i >= 50 {
+			exp = 1
+		}
+		if n := db.VersionCount([]byte(fmt.Sprintf("%010d", i))); n != exp {
+			t.Errorf("Expected %d versions of %d, got=%d", exp, i, n)
+		}
+	}
+}
+
+func TestWithSnapshot(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	var snap *Snapshot
+	var itr *Iterator
+	err := db.WithSnapshot(func(s *Snapshot) error {
+		snap = s
+		return s.WithIterator(func(it *Iterator) error {
+			itr = it
+			var count int
+			for it.SeekFirst(); it.Valid(); it.Next() {
+				count++
+			}
+			if count != 100 {
+				t.Errorf("Expected 100 items, got=%d", count)
+			}
+			return nil
+		})
+	})
+
+	if err != nil || snap.Open() || !itr.closed {
+		t.Errorf("Expected closed snapshot and iterator, got=%v", err)
+	}
+
+	if err := snap.WithIterator(func(it *Iterator) error { return nil }); err != ErrSnapshotClosed {
+		t.Errorf("Expected ErrSnapshotClosed, got=%v", err)
+	}
+
+	errTest := fmt.Errorf("test error")
+	err = db.WithSnapshot(func(s *Snapshot) error {
+		snap = s
+		return errTest
+	})
+
+	if err != errTest || snap.Open() {
+		t.Errorf("Expected test error and closed snapshot, got=%v", err)
+	}
+
+	err = db.WithSnapshot(func(s *Snapshot) error {
+		snap = s
+		return s.WithIterator(func(it *Iterator) error {
+			itr = it
+			panic("test panic")
+		})
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "test panic") || snap.Open() || !itr.closed {
+		t.Errorf("Expected panic error and closed snapshot, got=%v", err)
+	}
+
+	if len(db.GetSnapshots()) != 0 {
+		t.Errorf("Expected no live snapshots")
+	}
+}
+
+func TestStoreDiskPartitioned(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	tenants := []string{"tenantA", "tenantB", "tenantC"}
+	for _, tenant := range tenants {
+		for i := 0; i < 100; i++ {
+			w.Put([]byte(fmt.Sprintf("%s-%03d", tenant, i)))
+		}
+	}
+
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDiskPartitioned("db.dump", snap, [][]byte{[]byte("tenantC"), []byte("tenantB")}, nil); err != ErrNotSorted {
+		t.Errorf("Expected ErrNotSorted, got=%v", err)
+	}
+
+	snap, _ = w.NewSnapshot()
+	boundaries := [][]byte{[]byte("tenantB"), []byte("tenantC"), []byte("tenantD")}
+	if err := db.StoreToDiskPartitioned("db.dump", snap, boundaries, nil); err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+
+	bs, _ := ioutil.ReadFile("db.dump/data/files.json")
+	mf, _ := db.decodeManifest(bs)
+	if len(mf.Files) != 3 {
+		t.Fatalf("Expected 3 shards, got=%v", mf.Files)
+	}
+
+	for shard, tenant := range tenants {
+		file := fmt.Sprintf("shard-%d", shard)
+		if mf.Files[shard] != file {
+			t.Errorf("Expected %s, got=%s", file, mf.Files[shard])
+		}
+
+		var count int
+		r := db.newFileReader(mf.FileType)
+		r.Open(filepath.Join("db.dump/data", file))
+		for itm, _ := r.ReadItem(); itm != nil; itm, _ = r.ReadItem() {
+			if exp := fmt.Sprintf("%s-%03d", tenant, count); string(itm.Bytes()) != exp {
+				t.Errorf("Expected %s in %s, got=%s", exp, file, string(itm.Bytes()))
+			}
+			count++
+		}
+		r.Close()
+
+		if count != 100 {
+			t.Errorf("Expected 100 items in %s, got=%d", file, count)
+		}
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	defer snap2.Close()
+	VerifyCount(snap2, 300, t)
+}
+
+func TestBloomFilter(t *testing.T) {
+	conf := testConf
+	conf.UseBloomFilter(10)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 10000; i < 20000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	for i := 0; i < 10000; i++ {
+		if !db.MightContain(snap1, []byte(fmt.Sprintf("%010d", i))) {
+			t.Fatalf("Unexpected false negative for %d", i)
+		}
+	}
+
+	var falsePositives int
+	for i := 10000; i < 20000; i++ {
+		if db.MightContain(snap1, []byte(fmt.Sprintf("%010d", i))) {
+			falsePositives++
+		}
+
+		if !db.MightContain(snap2, []byte(fmt.Sprintf("%010d", i))) {
+			t.Fatalf("Unexpected false negative for %d", i)
+		}
+	}
+
+	if falsePositives > 500 {
+		t.Errorf("Expected about 1%% false positives, got=%d", falsePositives)
+	}
+}
+
+func TestBloomFilterGet(t *testing.T) {
+	// Count the store lookups which compare the missing keys
+	var lookups int64
+	countMisses := func(useFilter bool) int64 {
+		conf := testConf
+		conf.SetKeyComparator(func(a, b []byte) int {
+			if len(b) > 0 && b[0] == 'm' {
+				atomic.AddInt64(&lookups, 1)
+			}
+			return bytes.Compare(a, b)
+		})
+		if useFilter {
+			conf.UseBloomFilter(10)
+			conf.SetBloomFilterKey(func(bs []byte) []byte { return bs })
+		}
+		db := NewWithConfig(conf)
+		defer db.Close()
+
+		w := db.NewWriter()
+		for i := 0; i < 10000; i++ {
+			w.Put([]byte(fmt.Sprintf("k%010d", i)))
+		}
+		snap, _ := w.NewSnapshot()
+		defer snap.Close()
+
+		if itm := snap.Get([]byte(fmt.Sprintf("k%010d", 10))); itm == nil ||
+			string(itm.Bytes()) != fmt.Sprintf("k%010d", 10) {
+			t.Errorf("Expected item for an existing key, got=%v", itm)
+		}
+
+		atomic.StoreInt64(&lookups, 0)
+		for i := 0; i < 10000; i++ {
+			if itm := snap.Get([]byte(fmt.Sprintf("m%010d", i))); itm != nil {
+				t.Fatalf("Unexpected item for a missing key %d", i)
+			}
+		}
+
+		return atomic.LoadInt64(&lookups)
+	}
+
+	without, with := countMisses(false), countMisses(true)
+	if with*10 > without {
+		t.Errorf("Expected the filter to avoid most lookups, got=%d, without filter=%d",
+			with, without)
+	}
+}
+
+func TestBloomFilterKeyValue(t *testing.T) {
+	// Items are key=value pairs ordered by the key
+	key := func(bs []byte) []byte {
+		if i := bytes.IndexByte(bs, '='); i >= 0 {
+			return bs[:i]
+		}
+		return bs
+	}
+
+	for _, withKey := range []bool{false, true} {
+		conf := testConf
+		conf.SetKeyComparator(func(a, b []byte) int {
+			return bytes.Compare(key(a), key(b))
+		})
+		conf.UseBloomFilter(10)
+		if withKey {
+			conf.SetBloomFilterKey(key)
+		}
+		db := NewWithConfig(conf)
+
+		w := db.NewWriter()
+		for i := 0; i < 10000; i++ {
+			w.Put([]byte(fmt.Sprintf("%010d=v%d", i, i)))
+		}
+		snap, _ := w.NewSnapshot()
+
+		for i := 0; i < 10000; i++ {
+			k := fmt.Sprintf("%010d", i)
+			if !db.MightContain(snap, []byte(k)) {
+				t.Fatalf("Unexpected false negative for %s", k)
+			}
+			if itm := snap.Get([]byte(k)); itm == nil ||
+				string(itm.Bytes()) != fmt.Sprintf("%s=v%d", k, i) {
+				t.Fatalf("Expected item for key %s, got=%v", k, itm)
+			}
+		}
+
+		var positives int
+		for i := 10000; i < 20000; i++ {
+			if db.MightContain(snap, []byte(fmt.Sprintf("%010d", i))) {
+				positives++
+			}
+		}
+
+		// The filter is not used without a key function
+		if withKey && positives > 500 {
+			t.Errorf("Expected about 1%% false positives, got=%d", positives)
+		} else if !withKey && positives != 10000 {
+			t.Errorf("Expected the filter to be skipped, got=%d positives", positives)
+		}
+
+		snap.Close()
+		db.Close()
+	}
+}
+
+func BenchmarkBloomFilterMiss(b *testing.B) {
+	conf := testConf
+	conf.UseBloomFilter(10)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 100000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i*2)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%010d", rand.Intn(100000)*2+1))
+	}
+
+	b.Run("Lookup", func(b *testing.B) {
+		itr := snap.NewIterator()
+		defer itr.Close()
+		for i := 0; i < b.N; i++ {
+			itr.SeekExact(keys[i%len(keys)])
+		}
+	})
+
+	b.Run("Filter", func(b *testing.B) {
+		itr := snap.NewIterator()
+		defer itr.Close()
+		db.MightContain(snap, keys[0])
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if key := keys[i%len(keys)]; db.MightContain(snap, key) {
+				itr.SeekExact(key)
+			}
+		}
+	})
+}
+
+func TestExistComparator(t *testing.T) {
+	testPutAfterDelete := func(conf Config) (bool, int) {
+		db := NewWithConfig(conf)
+		defer db.Close()
+
+		w := db.NewWriter()
+		w.Put([]byte("key"))
+		snap, _ := w.NewSnapshot()
+		defer snap.Close()
+
+		w.Delete([]byte("key"))
+		inserted, _, _ := w.PutStatus([]byte("key"))
+		return inserted, db.VersionCount([]byte("key"))
+	}
+
+	// A deleted item does not occupy its slot by default
+	if inserted, n := testPutAfterDelete(testConf); !inserted || n != 2 {
+		t.Errorf("Expected insert of a new version, got=%v, %d", inserted, n)
+	}
+
+	conf := testConf
+	conf.SetExistComparator(func(this, that *Item) int {
+		return bytes.Compare(this.Bytes(), that.Bytes())
+	})
+
+	if inserted, n := testPutAfterDelete(conf); inserted || n != 1 {
+		t.Errorf("Expected the deleted item to occupy the slot, got=%v, %d", inserted, n)
+	}
+}
+
+func TestLoadDiskWithWriters(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	db.Close()
+
+	db = NewWithConfig(testConf)
+	defer db.Close()
+	w = db.NewWriter()
+	w.Put([]byte("pending"))
+	if _, err := db.LoadFromDisk("db.dump", 4, nil); err != ErrPendingWrites {
+		t.Errorf("Expected ErrPendingWrites, got=%v", err)
+	}
+
+	snap, _ = w.NewSnapshot()
+	snap.Close()
+	snap, err := db.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	snap.Close()
+
+	// The existing writer should operate on the restored store
+	if n := w.GetNode([]byte(fmt.Sprintf("%010d", 10))); n == nil {
+		t.Errorf("Expected restored item to be visible to the writer")
+	}
+
+	w.Delete([]byte(fmt.Sprintf("%010d", 10)))
+	w.Put([]byte(fmt.Sprintf("%010d", 100)))
+	snap, _ = w.NewSnapshot()
+	defer snap.Close()
+	VerifyCount(snap, 100, t)
+	if db.ItemsCount() != 100 {
+		t.Errorf("Expected 100 items, got=%d", db.ItemsCount())
+	}
+}
+
+func TestIteratorSeekForPrev(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%010d", i)) }
+	w := db.NewWriter()
+	for i := 10; i <= 100; i += 10 {
+		w.Put(key(i))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	w.Delete(key(50))
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+	w.Put(key(55))
+
+	itr := snap2.NewIterator()
+	defer itr.Close()
+
+	tests := []struct {
+		target, exp int
+	}{
+		{30, 30}, {35, 30}, {10, 10}, {5, -1}, {200, 100}, {57, 40}, {50, 40}, {100, 100},
+	}
+
+	for _, tc := range tests {
+		itr.SeekForPrev(key(tc.target))
+		if tc.exp < 0 {
+			if itr.Valid() {
+				t.Errorf("Expected invalid iterator for %d, got=%s", tc.target, string(itr.Get()))
+			}
+		} else if !itr.Valid() || string(itr.Get()) != string(key(tc.exp)) {
+			t.Errorf("Expected %d for %d", tc.exp, tc.target)
+		}
+	}
+
+	itr.SeekForPrev(key(57))
+	itr.Next()
+	if !itr.Valid() || string(itr.Get()) != string(key(60)) {
+		t.Errorf("Expected next item after floor to be 60")
+	}
+
+	// The deleted item is visible to the older snapshot
+	itr1 := snap1.NewIterator()
+	defer itr1.Close()
+	itr1.SeekForPrev(key(57))
+	if !itr1.Valid() || string(itr1.Get()) != string(key(50)) {
+		t.Errorf("Expected 50 for 57 in older snapshot")
+	}
+}
+
+func TestIteratorSeekGT(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%010d", i)) }
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		w.Put(key(i))
+	}
+
+	// Every fifth key gets enough versions to make the iterator seek past them
+	for v := 0; v < 2*skipSeekThreshold; v++ {
+		for i := 0; i < 100; i += 5 {
+			w.Delete(key(i))
+			w.Put(key(i))
+		}
+		snap, _ := w.NewSnapshot()
+		snap.Close()
+	}
+	w.Delete(key(50))
+	w.Delete(key(99))
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+
+	tests := []struct {
+		target, exp int
+	}{
+		{0, 1}, {4, 5}, {5, 6}, {49, 51}, {50, 51}, {98, -1}, {99, -1}, {200, -1},
+	}
+
+	for _, tc := range tests {
+		itr.SeekGT(key(tc.target))
+		if tc.exp < 0 {
+			if itr.Valid() {
+				t.Errorf("Expected invalid iterator for %d, got=%s", tc.target, string(itr.Get()))
+			}
+		} else if !itr.Valid() || string(itr.Get()) != string(key(tc.exp)) {
+			t.Errorf("Expected %d for %d", tc.exp, tc.target)
+		}
+	}
+
+	// Paginate by resuming after the last key of the previous page
+	var got []string
+	var last []byte
+	for page := 0; ; page++ {
+		pitr := snap.NewIterator()
+		if last == nil {
+			pitr.SeekFirst()
+		} else {
+			pitr.SeekGT(last)
+		}
+
+		n := 0
+		for ; pitr.Valid() && n < 7; pitr.Next() {
+			last = append([]byte(nil), pitr.Get()...)
+			got = append(got, string(last))
+			n++
+		}
+		pitr.Close()
+		if n == 0 {
+			break
+		}
+	}
+
+	var exp []string
+	for i := 0; i < 99; i++ {
+		if i != 50 {
+			exp = append(exp, string(key(i)))
+		}
+	}
+
+	if strings.Join(got, ",") != strings.Join(exp, ",") {
+		t.Errorf("Expected pages to cover %d items once, got=%d", len(exp), len(got))
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	synced := make(map[string]bool)
+	db.syncPath = func(path string) error {
+		synced[path] = true
+		return nil
+	}
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	for round := 0; round < 2; round++ {
+		w.Put([]byte(fmt.Sprintf("round-%d", round)))
+		snap, err := db.Checkpoint("db.dump", 4)
+		if err != nil {
+			t.Fatalf("Expected no error, got=%v", err)
+		}
+		VerifyCount(snap, 1001+round, t)
+		snap.Close()
+	}
+
+	bs, _ := ioutil.ReadFile("db.dump/data/files.json")
+	mf, _ := db.decodeManifest(bs)
+	expected := []string{"db.dump.tmp", "db.dump.tmp/data", "db.dump.tmp/data/files.json", "."}
+	for _, file := range mf.Files {
+		expected = append(expected, filepath.Join("db.dump.tmp/data", file))
+	}
+
+	for _, path := range expected {
+		if !synced[path] {
+			t.Errorf("Expected %s to be synced", path)
+		}
+	}
+
+	for _, path := range []string{"db.dump.tmp", "db.dump.old"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got=%v", path, err)
+		}
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	if err := db2.syncTree("db.dump"); err != nil {
+		t.Errorf("Expected no error from fsync, got=%v", err)
+	}
+
+	snap, err := db2.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	defer snap.Close()
+	VerifyCount(snap, 1002, t)
+}
+
+func TestStoreDiskFsync(t *testing.T) {
+	for _, useFsync := range []bool{false, true} {
+		os.RemoveAll("db.dump")
+		conf := testConf
+		conf.UseDeltaInterleaving()
+		if useFsync {
+			conf.UseFsync()
+		}
+		db := NewWithConfig(conf)
+
+		var synced []string
+		db.syncPath = func(path string) error {
+			synced = append(synced, path)
+			return nil
+		}
+
+		w := db.NewWriter()
+		for i := 0; i < 1000; i++ {
+			w.Put([]byte(fmt.Sprintf("%010d", i)))
+		}
+		snap, _ := w.NewSnapshot()
+		if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+			t.Fatalf("Expected no error, got=%v", err)
+		}
+		db.Close()
+
+		if !useFsync {
+			if len(synced) != 0 {
+				t.Errorf("Expected no fsync, got=%v", synced)
+			}
+			continue
+		}
+
+		var expected []string
+		for _, dir := range []string{"db.dump/data", "db.dump/delta"} {
+			bs, _ := ioutil.ReadFile(filepath.Join(dir, "files.json"))
+			mf, _ := db.decodeManifest(bs)
+			for _, file := range append(mf.Files, "files.json") {
+				expected = append(expected, filepath.Join(dir, file))
+			}
+			expected = append(expected, dir)
+		}
+		expected = append(expected, "db.dump")
+
+		syncedSet := make(map[string]bool)
+		for _, path := range synced {
+			syncedSet[path] = true
+		}
+
+		for _, path := range expected {
+			if !syncedSet[path] {
+				t.Errorf("Expected %s to be synced", path)
+			}
+		}
+	}
+	os.RemoveAll("db.dump")
+}
+
+func TestLoadDiskRetry(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	errInjected := fmt.Errorf("injected read error")
+	var decodes, failAt int64
+	enc := func(itm *Item, w io.Writer) error {
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(itm.Bytes())))
+		if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		}
+		_, err := w.Write(itm.Bytes())
+		return err
+	}
+
+	dec := func(r io.Reader) ([]byte, error) {
+		if atomic.AddInt64(&decodes, 1) == atomic.LoadInt64(&failAt) {
+			return nil, errInjected
+		}
+
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		bs := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		_, err := io.ReadFull(r, bs)
+		return bs, err
+	}
+
+	conf := DefaultConfig()
+	conf.SetItemCodec(enc, dec)
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDiskPartitioned("db.dump", snap, nil, nil); err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	db.Close()
+
+	// The reader of the only shard fails at the 101st item
+	decodes, failAt = 0, 101
+	db = NewWithConfig(conf)
+	_, err := db.LoadFromDisk("db.dump", 1, nil)
+	serr, ok := err.(*ShardLoadError)
+	if !ok || serr.ItemsLoaded != 100 || serr.File != "shard-0" || !errors.Is(err, errInjected) {
+		t.Errorf("Expected shard load error after 100 items, got=%v", err)
+	}
+	db.Close()
+
+	var itemsLoaded int64
+	var shardsLoaded int
+	conf.SetLoadRetries(1)
+	conf.SetLoadProgressCallback(func(items int64, shards int) {
+		itemsLoaded, shardsLoaded = items, shards
+	})
+
+	decodes, failAt = 0, 101
+	db = NewWithConfig(conf)
+	defer db.Close()
+	snap, stats, err := db.LoadFromDisk2("db.dump", 1, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	defer snap.Close()
+
+	VerifyCount(snap, 1000, t)
+	if itemsLoaded != 1000 || shardsLoaded != 1 || stats.ShardCount != 1 {
+		t.Errorf("Expected progress of 1000 items and 1 shard, got=%d, %d", itemsLoaded, shardsLoaded)
+	}
+}
+
+func TestMergeFromDisk(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	// Keys are compared by the first 10 bytes and the rest is the value
+	keyCmp := func(a, b []byte) int { return bytes.Compare(a[:10], b[:10]) }
+	conf := testConf
+	conf.SetKeyComparator(keyCmp)
+
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	for i := 500; i < 1500; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d-backup", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	db.Close()
+
+	db = NewWithConfig(conf)
+	defer db.Close()
+	w = db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d-base", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	var count int64
+	snap2, err := db.MergeFromDisk("db.dump", 4, func(e *ItemEntry) {
+		atomic.AddInt64(&count, 1)
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	defer snap2.Close()
+
+	if count != 1000 {
+		t.Errorf("Expected 1000 loaded items, got=%d", count)
+	}
+
+	VerifyCount(snap1, 1000, t)
+	VerifyCount(snap2, 1500, t)
+	if db.ItemsCount() != 1500 {
+		t.Errorf("Expected 1500 items, got=%d", db.ItemsCount())
+	}
+
+	i := 0
+	itr := snap2.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		exp := fmt.Sprintf("%010d-base", i)
+		if i >= 500 {
+			exp = fmt.Sprintf("%010d-backup", i)
+		}
+
+		if string(itr.Get()) != exp {
+			t.Errorf("Expected %s, got=%s", exp, string(itr.Get()))
+		}
+		i++
+	}
+
+	// The replaced items are visible to the older snapshot
+	itr1 := snap1.NewIterator()
+	defer itr1.Close()
+	itr1.Seek([]byte(fmt.Sprintf("%010d", 600)))
+	if !itr1.Valid() || string(itr1.Get()) != fmt.Sprintf("%010d-base", 600) {
+		t.Errorf("Expected base item in older snapshot")
+	}
+}
+
+func TestMergeFromDiskFlags(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	conf := testConf
+	conf.SetFileType(RawdbFileV2)
+	conf.SetSkipIdenticalPuts(true)
+
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		n := w.Put2([]byte(fmt.Sprintf("%010d", i)))
+		(*Item)(n.Item()).SetFlags(1)
+	}
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	snap.Close()
+	db.Close()
+
+	db = NewWithConfig(conf)
+	defer db.Close()
+	w = db.NewWriter()
+	for i := 0; i < 100; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	snap2, err := db.MergeFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	defer snap2.Close()
+
+	// The identical items visible to the older snapshot retain their flags
+	for _, tc := range []struct {
+		snap  *Snapshot
+		flags uint8
+	}{{snap1, 0}, {snap2, 1}} {
+		count := 0
+		itr := tc.snap.NewIterator()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			if flags := itr.GetItem().Flags(); flags != tc.flags {
+				t.Errorf("Expected flags %d, got=%d", tc.flags, flags)
+				break
+			}
+			count++
+		}
+		itr.Close()
+
+		if count != 100 && !t.Failed() {
+			t.Errorf("Expected 100 items, got=%d", count)
+		}
+	}
+}
+
+func TestFileTypeValues(t *testing.T) {
+	// The values are recorded in the manifests of existing backups
+	if RawdbFile != 2 || RawdbFileV2 != 3 {
+		t.Errorf("Expected file types 2 and 3, got=%d, %d", RawdbFile, RawdbFileV2)
+	}
+
+	bs, _ := json.Marshal(fileManifest{FileType: 2, Files: []string{"shard-0"}})
+	db := New()
+	defer db.Close()
+	if mf, err := db.decodeManifest(bs); err != nil || mf.FileType != RawdbFile {
+		t.Errorf("Expected RawdbFile for a backup of file type 2, got=%d, %v", mf.FileType, err)
+	}
+}
+
+func TestItemFlagsHeader(t *testing.T) {
+	if itemHeaderSize != 12 {
+		t.Errorf("Expected item header size 12, got=%d", itemHeaderSize)
+	}
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	itm := db.newItem([]byte("key"), false)
+	itm.SetFlags(0xff)
+	if flags := itm.Flags(); flags != 0xff {
+		t.Errorf("Expected flags 255, got=%d", flags)
+	}
+
+	if bs := itm.Bytes(); string(bs) != "key" {
+		t.Errorf("Expected item key, got=%q", bs)
+	}
+
+	if sz := ItemSize(unsafe.Pointer(itm)); sz != 15 {
+		t.Errorf("Expected item size 15, got=%d", sz)
+	}
+
+	itm.SetFlags(0)
+	if bs := itm.Bytes(); string(bs) != "key" {
+		t.Errorf("Expected item key, got=%q", bs)
+	}
+}
+
+func TestItemFlags(t *testing.T) {
+	for _, fileType := range []FileType{RawdbFile, RawdbFileV2} {
+		os.RemoveAll("db.dump")
+		conf := testConf
+		conf.UseDeltaInterleaving()
+		if err := conf.SetFileType(fileType); err != nil {
+			t.Fatalf("Expected no error, got=%v", err)
+		}
+
+		db := NewWithConfig(conf)
+		w := db.NewWriter()
+		for i := 0; i < 1000; i++ {
+			n := w.Put2([]byte(fmt.Sprintf("%010d", i)))
+			(*Item)(n.Item()).SetFlags(uint8(i))
+		}
+		snap, _ := w.NewSnapshot()
+		if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+			t.Fatalf("Expected no error, got=%v", err)
+		}
+		db.Close()
+
+		db = NewWithConfig(testConf)
+		snap, err := db.LoadFromDisk("db.dump", 4, nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got=%v", err)
+		}
+
+		i := 0
+		itr := snap.NewIterator()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			exp := uint8(0)
+			if fileType == RawdbFileV2 {
+				exp = uint8(i)
+			}
+
+			if flags := itr.GetItem().Flags(); flags != exp {
+				t.Errorf("Expected flags %d for item %d, got=%d", exp, i, flags)
+			}
+			i++
+		}
+		itr.Close()
+
+		if i != 1000 {
+			t.Errorf("Expected 1000 items, got=%d", i)
+		}
+
+		snap.Close()
+		db.Close()
+	}
+	os.RemoveAll("db.dump")
+}
+
+func TestFileTypeMigration(t *testing.T) {
+	defer os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump2")
+
+	newDB := func(t FileType) *Nitro {
+		conf := testConf
+		conf.SetFileType(t)
+		return NewWithConfig(conf)
+	}
+
+	for _, tc := range []struct{ from, to FileType }{{RawdbFile, RawdbFileV2}, {RawdbFileV2, RawdbFile}} {
+		os.RemoveAll("db.dump")
+		os.RemoveAll("db.dump2")
+
+		db := newDB(tc.from)
+		w := db.NewWriter()
+		for i := 0; i < 1000; i++ {
+			n := w.Put2([]byte(fmt.Sprintf("%010d", i)))
+			(*Item)(n.Item()).SetFlags(1)
+		}
+		snap, _ := w.NewSnapshot()
+		if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+			t.Fatalf("Expected no error, got=%v", err)
+		}
+		snap.Close()
+		db.Close()
+
+		// Load the backup with a reader configured for the other format
+		// and store it again in the configured format
+		db = newDB(tc.to)
+		snap, err := db.LoadFromDisk("db.dump", 4, nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got=%v", err)
+		}
+		if err := db.StoreToDisk("db.dump2", snap, 4, nil); err != nil {
+			t.Fatalf("Expected no error, got=%v", err)
+		}
+		snap.Close()
+
+		bs, _ := ioutil.ReadFile("db.dump2/data/files.json")
+		if mf, _ := db.decodeManifest(bs); mf.FileType != tc.to {
+			t.Errorf("Expected migrated backup of file type %d, got=%d", tc.to, mf.FileType)
+		}
+		db.Close()
+
+		db = newDB(tc.from)
+		snap, err = db.LoadFromDisk("db.dump2", 4, nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got=%v", err)
+		}
+
+		// Flags survive only if both formats persist them
+		exp := uint8(0)
+		if tc.from == RawdbFileV2 && tc.to == RawdbFileV2 {
+			exp = 1
+		}
+
+		count := 0
+		itr := snap.NewIterator()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			if flags := itr.GetItem().Flags(); flags != exp {
+				t.Errorf("Expected flags %d, got=%d", exp, flags)
+			}
+			count++
+		}
+		itr.Close()
+
+		if count != 1000 {
+			t.Errorf("Expected 1000 items, got=%d", count)
+		}
+		snap.Close()
+		db.Close()
+	}
+
+	// A backup written by a newer format is rejected
+	bs, _ := json.Marshal(fileManifest{FileType: RawdbFileV2 + 1, Files: []string{"shard-0"}})
+	ioutil.WriteFile("db.dump/data/files.json", bs, 0660)
+	db := New()
+	defer db.Close()
+	if _, err := db.LoadFromDisk("db.dump", 4, nil); err != ErrUnknownFileType {
+		t.Errorf("Expected ErrUnknownFileType, got=%v", err)
+	}
+}
+
+func TestFileFormatHeader(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	conf := testConf
+	conf.SetFileType(RawdbFileV2)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+
+	// Every shard file starts with the header holding its file type
+	bs, _ := ioutil.ReadFile("db.dump/data/files.json")
+	mf, _ := db.decodeManifest(bs)
+	for _, file := range mf.Files {
+		data, _ := ioutil.ReadFile(filepath.Join("db.dump/data", file))
+		exp := append(append([]byte{}, fileHeaderMagic...), byte(RawdbFileV2))
+		if !bytes.HasPrefix(data, exp) {
+			t.Errorf("Expected the format version header in %s", file)
+		}
+	}
+
+	// A file whose header does not match the recorded file type is rejected
+	mf.FileType = RawdbFile
+	bs, _ = json.Marshal(mf)
+	ioutil.WriteFile("db.dump/data/files.json", bs, 0660)
+	if _, err := db.LoadFromDisk("db.dump", 4, nil); err != ErrUnsupportedFormatVersion {
+		t.Errorf("Expected ErrUnsupportedFormatVersion, got=%v", err)
+	}
+
+	// Files without the header are read using the recorded file type
+	for _, file := range mf.Files {
+		path := filepath.Join("db.dump/data", file)
+		data, _ := ioutil.ReadFile(path)
+		ioutil.WriteFile(path, data[fileHeaderSize:], 0660)
+	}
+	mf.FileType = RawdbFileV2
+	bs, _ = json.Marshal(mf)
+	ioutil.WriteFile("db.dump/data/files.json", bs, 0660)
+
+	db2 := NewWithConfig(conf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	VerifyCount(snap2, 1000, t)
+	snap2.Close()
+}
+
+func TestLoadLegacyManifestFileType(t *testing.T) {
+	defer os.RemoveAll("db.dump")
+	os.RemoveAll("db.dump")
+
+	conf := testConf
+	conf.SetFileType(RawdbFile)
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	snap.Close()
+	db.Close()
+
+	// Older backups record only the list of files in files.json
+	bs, _ := ioutil.ReadFile("db.dump/data/files.json")
+	var mf fileManifest
+	if err := json.Unmarshal(bs, &mf); err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	bs, _ = json.Marshal(mf.Files)
+	ioutil.WriteFile("db.dump/data/files.json", bs, 0660)
+
+	conf = testConf
+	conf.SetFileType(RawdbFileV2)
+	db = NewWithConfig(conf)
+	defer db.Close()
+	snap, err := db.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	defer snap.Close()
+	VerifyCount(snap, 1000, t)
+
+	i := 0
+	itr := snap.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if exp := fmt.Sprintf("%010d", i); string(itr.Get()) != exp {
+			t.Fatalf("Expected %s, got=%s", exp, string(itr.Get()))
+		}
+		i++
+	}
+}
+
+func TestKeyHistory(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	// Key is the first 3 bytes of the item
+	conf := testConf
+	conf.SetKeyComparator(func(a, b []byte) int { return bytes.Compare(a[:3], b[:3]) })
+	db2 := NewWithConfig(conf)
+	defer db2.Close()
+
+	w := db2.NewWriter()
+	var snaps []*Snapshot
+	for i := 0; i < 4; i++ {
+		if i > 0 {
+			w.Delete([]byte("key"))
+		}
+		w.Put([]byte(fmt.Sprintf("key-v%d", i)))
+		w.Put([]byte(fmt.Sprintf("oth-v%d", i)))
+		snap, _ := w.NewSnapshot()
+		snaps = append(snaps, snap)
+	}
+
+	history := db2.KeyHistory([]byte("key"))
+	if len(history) != 4 {
+		t.Fatalf("Expected 4 versions, got=%d", len(history))
+	}
+
+	for i, itm := range history {
+		v := 3 - i
+		if string(itm.Bytes()) != fmt.Sprintf("key-v%d", v) || itm.BornSn() != snaps[v].sn {
+			t.Errorf("Unexpected version %d: %s (%d)", i, string(itm.Bytes()), itm.BornSn())
+		}
+
+		if deleted := itm.IsDeleted(); deleted != (i > 0) {
+			t.Errorf("Expected deleted=%v for version %d", i > 0, i)
+		}
+	}
+
+	// The versions deleted before a snapshot are collected once the snapshot
+	// and the older snapshots are closed
+	for _, snap := range snaps[:3] {
+		snap.Close()
+	}
+	db2.Compact()
+
+	history = db2.KeyHistory([]byte("key"))
+	if len(history) != 2 || string(history[1].Bytes()) != "key-v2" {
+		t.Errorf("Expected 2 versions, got=%d", len(history))
+	}
+
+	snaps[3].Close()
+	db2.Compact()
+	history = db2.KeyHistory([]byte("key"))
+	if len(history) != 1 || string(history[0].Bytes()) != "key-v3" {
+		t.Errorf("Expected only the latest version, got=%d", len(history))
+	}
+
+	if len(db.KeyHistory([]byte("key"))) != 0 {
+		t.Errorf("Expected no history for a missing key")
+	}
+}
+
+func TestGetSnapshotsFiltered(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+	time.Sleep(10 * time.Millisecond)
+	t0 := time.Now()
+	snap3, _ := db.NewSnapshot()
+	defer snap3.Close()
+	snap4, _ := db.NewSnapshot()
+	snap4.Close()
+
+	snap2.Open()
+	shared := db.GetSnapshotsFiltered(func(s *Snapshot) bool { return s.RefCount() > 1 })
+	snap2.Close()
+	if len(shared) != 1 || shared[0] != snap2 {
+		t.Errorf("Expected snapshot 2, got=%v", shared)
+	}
+
+	live := db.GetSnapshotsFiltered(func(s *Snapshot) bool { return s.RefCount() > 0 })
+	if len(live) != 3 {
+		t.Errorf("Expected 3 live snapshots, got=%d", len(live))
+	}
+
+	recent := db.GetSnapshotsFiltered(func(s *Snapshot) bool { return !s.Created().Before(t0) })
+	if len(recent) != 1 || recent[0] != snap3 {
+		t.Errorf("Expected snapshot 3, got=%v", recent)
+	}
+}
+
+func TestGetSnapshotsConcurrent(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	snapch := make(chan *Snapshot, 100)
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(snapch)
+		for i := 0; i < 2000; i++ {
+			w.Put([]byte(fmt.Sprintf("%010d", i)))
+			snap, _ := db.NewSnapshot()
+			snapch <- snap
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for snap := range snapch {
+			snap.Close()
+		}
+	}()
+
+	for stop := false; !stop; {
+		select {
+		case <-done:
+			stop = true
+		default:
+		}
+
+		var last uint32
+		for _, snap := range db.GetSnapshots() {
+			if snap.sn <= last {
+				t.Fatalf("Expected snapshots in order, got=%d after %d", snap.sn, last)
+			}
+			last = snap.sn
+		}
+	}
+	wg.Wait()
+
+	if snaps := db.GetSnapshots(); len(snaps) != 0 {
+		t.Errorf("Expected no live snapshots, got=%d", len(snaps))
+	}
+}
+
+func TestIteratorVersionChurn(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10; i++ {
+		w.Put([]byte(fmt.Sprintf("%03d", i)))
+	}
+
+	var snaps []*Snapshot
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 10; j += 2 {
+			if i%10 == j {
+				w.Delete([]byte(fmt.Sprintf("%03d", j)))
+				continue
+			}
+
+			if i%10 == j+1 {
+				w.Put([]byte(fmt.Sprintf("%03d", j)))
+				continue
+			}
+
+			w.Delete([]byte(fmt.Sprintf("%03d", j)))
+			w.Put([]byte(fmt.Sprintf("%03d", j)))
+		}
+		snap, _ := w.NewSnapshot()
+		snaps = append(snaps, snap)
+	}
+
+	for i, snap := range snaps {
+		var got []string
+		itr := snap.NewIterator()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			itm := itr.GetItem()
+			if itm.bornSn > snap.sn || (itm.deadSn != 0 && itm.deadSn <= snap.sn) {
+				t.Errorf("Expected a visible item, got=%v", itm)
+			}
+			got = append(got, string(itr.Get()))
+		}
+		itr.Close()
+
+		var exp []string
+		for j := 0; j < 10; j++ {
+			if j%2 == 0 && i%10 == j {
+				continue
+			}
+			exp = append(exp, fmt.Sprintf("%03d", j))
+		}
+
+		if strings.Join(got, ",") != strings.Join(exp, ",") {
+			t.Errorf("Expected %v for snapshot %d, got=%v", exp, i, got)
+		}
+	}
+
+	for _, snap := range snaps {
+		snap.Close()
+	}
+}
+
+// Iterators of the oldest and the latest snapshots skip a long run of
+// invisible versions of a key which is updated frequently
+func BenchmarkIteratorVersionChurn(b *testing.B) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	w.Put([]byte("a"))
+	w.Put([]byte("k"))
+	w.Put([]byte("z"))
+	old, _ := w.NewSnapshot()
+	defer old.Close()
+
+	var snaps []*Snapshot
+	for i := 0; i < 10000; i++ {
+		w.Delete([]byte("k"))
+		w.Put([]byte("k"))
+		snap, _ := w.NewSnapshot()
+		snaps = append(snaps, snap)
+	}
+	latest := snaps[len(snaps)-1]
+
+	for _, snap := range []*Snapshot{old, latest} {
+		name := "Oldest"
+		if snap == latest {
+			name = "Latest"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			itr := snap.NewIterator()
+			defer itr.Close()
+			for i := 0; i < b.N; i++ {
+				var count int
+				for itr.SeekFirst(); itr.Valid(); itr.Next() {
+					count++
+				}
+
+				if count != 3 {
+					b.Fatalf("Expected 3 items, got=%d", count)
+				}
+			}
+		})
+	}
+
+	for _, snap := range snaps {
+		snap.Close()
+	}
+}
+
+func TestIteratorGetValue(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	w.Put([]byte("key-1"))
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+	itr.SeekFirst()
+
+	bs := itr.GetValue()
+	bs[0] = 'K'
+	if string(itr.Get()) != "key-1" {
+		t.Errorf("Expected unmodified item, got=%s", itr.Get())
+	}
+
+	if ubs := itr.GetValueUnsafe(); &ubs[0] != &itr.Get()[0] {
+		t.Errorf("Expected a slice aliasing the item")
+	}
+}
+
+func BenchmarkIteratorGetValue(b *testing.B) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		bs := make([]byte, 4096)
+		binary.BigEndian.PutUint64(bs, uint64(i))
+		w.Put(bs)
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	for _, name := range []string{"Copy", "ZeroCopy"} {
+		b.Run(name, func(b *testing.B) {
+			itr := snap.NewIterator()
+			defer itr.Close()
+
+			var size int
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if i%1000 == 0 {
+					itr.SeekFirst()
+				}
+
+				if name == "Copy" {
+					size += len(itr.GetValue())
+				} else {
+					size += len(itr.GetValueUnsafe())
+				}
+				itr.Next()
+			}
+		})
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	snap0, _ := w.NewSnapshot()
+	defer snap0.Close()
+
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%04d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 0; i < 1000; i++ {
+		w.Delete([]byte(fmt.Sprintf("key-%04d", i)))
+	}
+	w.Put([]byte("key-new"))
+	snap2, _ := w.NewSnapshot()
+
+	if db.ItemsCount() == 0 {
+		t.Errorf("Expected non-zero items count")
+	}
+
+	if !db.IsEmpty(snap0) {
+		t.Errorf("Expected an empty snapshot")
+	}
+
+	if db.IsEmpty(snap1) || db.IsEmpty(snap2) {
+		t.Errorf("Expected non-empty snapshots")
+	}
+
+	w.Delete([]byte("key-new"))
+	snap3, _ := w.NewSnapshot()
+	defer snap3.Close()
+	if !db.IsEmpty(snap3) {
+		t.Errorf("Expected an empty snapshot")
+	}
+
+	snap2.Close()
+	if !db.IsEmpty(snap2) {
+		t.Errorf("Expected a destroyed snapshot to be empty")
+	}
+}
+
+func TestNewSnapshotOrReuse(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	w.Put([]byte("key-1"))
+
+	snap1, _ := db.NewSnapshotOrReuse()
+	snap2, _ := db.NewSnapshotOrReuse()
+	if snap1 != snap2 || snap1.RefCount() != 2 {
+		t.Errorf("Expected the snapshot to be reused, got=%v, %v", snap1, snap2)
+	}
+	sn := db.getCurrSn()
+
+	w.Put([]byte("key-2"))
+	snap3, _ := db.NewSnapshotOrReuse()
+	if snap3 == snap2 || db.getCurrSn() != sn+1 {
+		t.Errorf("Expected a new snapshot after a write")
+	}
+
+	if cnt := CountItems(snap3); cnt != 2 {
+		t.Errorf("Expected 2 items, got=%d", cnt)
+	}
+
+	snap3.Close()
+	snap4, _ := db.NewSnapshotOrReuse()
+	if snap4 == snap3 {
+		t.Errorf("Expected a new snapshot after closing the snapshot")
+	}
+
+	snap1.Close()
+	snap2.Close()
+	snap4.Close()
+}
+
+func TestInstanceStats(t *testing.T) {
+	var dbs []*Nitro
+	for i := 0; i < 3; i++ {
+		db := NewWithConfig(testConf)
+		w := db.NewWriter()
+		for j := 0; j < (i+1)*100; j++ {
+			w.Put([]byte(fmt.Sprintf("key-%d", j)))
+		}
+
+		for j := 0; j <= i; j++ {
+			db.NewSnapshot()
+		}
+		dbs = append(dbs, db)
+	}
+
+	findStat := func(db *Nitro) *InstanceStat {
+		for _, st := range InstanceStats() {
+			if st.ID == db.id {
+				return &st
+			}
+		}
+		return nil
+	}
+
+	for i, db := range dbs {
+		st := findStat(db)
+		if st == nil {
+			t.Errorf("Expected stats for instance %d", db.id)
+			continue
+		}
+
+		if st.ItemsCount != int64((i+1)*100) || st.Snapshots != i+1 ||
+			st.MemoryInUse != db.MemoryInUse() {
+			t.Errorf("Unexpected stats for instance %d, got=%+v", db.id, *st)
+		}
+	}
+
+	for _, snap := range dbs[0].GetSnapshots() {
+		snap.Close()
+	}
+	dbs[0].Close()
+	if findStat(dbs[0]) != nil {
+		t.Errorf("Expected closed instance to be removed")
+	}
+
+	if findStat(dbs[1]) == nil || findStat(dbs[2]) == nil {
+		t.Errorf("Expected open instances to be listed")
+	}
+
+	for _, db := range dbs[1:] {
+		for _, snap := range db.GetSnapshots() {
+			snap.Close()
+		}
+		db.Close()
+	}
+}
+
+func TestInstanceName(t *testing.T) {
+	names := []string{"index-1", "index-2", ""}
+	var dbs []*Nitro
+	for _, name := range names {
+		conf := DefaultConfig()
+		if name != "" {
+			conf.SetName(name)
+		}
+		db := NewWithConfig(conf)
+		defer db.Close()
+		dbs = append(dbs, db)
+	}
+
+	listed := make(map[int]string)
+	for _, st := range InstanceStats() {
+		listed[st.ID] = st.Name
+	}
+
+	for i, db := range dbs {
+		if db.Name() != names[i] {
+			t.Errorf("Expected name %q, got=%q", names[i], db.Name())
+		}
+
+		if name, ok := listed[db.ID()]; !ok || name != names[i] {
+			t.Errorf("Expected instance %d listed as %q, got=%q", db.ID(), names[i], name)
+		}
+	}
+
+	if dbs[0].ID() >= dbs[1].ID() {
+		t.Errorf("Expected ids in the order of creation")
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	for _, cfg := range []Config{DefaultConfig(), testConf} {
+		db := NewWithConfig(cfg)
+		w := db.NewWriter()
+		w.Put([]byte("key"))
+
+		db.Close()
+		db.Close()
+	}
+}
+
+func TestBackupManifest(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%05d", i)))
+	}
+
+	snap1, err := db.Checkpoint("db.dump", 4)
+	if err != nil {
+		t.Fatalf("Expected checkpoint to succeed, got=%v", err)
+	}
+	defer snap1.Close()
+
+	if err := db.WriteManifest("db.dump", snap1); err != nil {
+		t.Fatalf("Expected manifest to be written, got=%v", err)
+	}
+
+	mf1, err := ReadManifest("db.dump")
+	if err != nil || mf1.Sn != snap1.sn || mf1.ItemsCount != 10000 || len(mf1.Shards) == 0 {
+		t.Errorf("Unexpected manifest %+v, err=%v", mf1, err)
+	}
+
+	if err := mf1.Verify("db.dump"); err != nil {
+		t.Errorf("Expected backup to match manifest, got=%v", err)
+	}
+
+	for i := 10000; i < 20000; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%05d", i)))
+	}
+
+	snap2, _ := db.Checkpoint("db.dump", 4)
+	defer snap2.Close()
+	db.WriteManifest("db.dump", snap2)
+
+	mf2, err := ReadManifest("db.dump")
+	if err != nil || mf2.Sn <= mf1.Sn || mf2.ItemsCount != 20000 {
+		t.Errorf("Expected a new manifest, got=%+v, err=%v", mf2, err)
+	}
+
+	if err := mf1.Verify("db.dump"); err != ErrInvalidManifest {
+		t.Errorf("Expected new backup not to match old manifest, got=%v", err)
+	}
+
+	bs, _ := ioutil.ReadFile(filepath.Join("db.dump", "manifest.json"))
+	bs = bytes.Replace(bs, []byte(`"itemsCount":20000`), []byte(`"itemsCount":20001`), 1)
+	ioutil.WriteFile(filepath.Join("db.dump", "manifest.json"), bs, 0660)
+	if _, err := ReadManifest("db.dump"); err != ErrInvalidManifest {
+		t.Errorf("Expected corrupted manifest to be detected, got=%v", err)
+	}
+}
+
+func TestSkiplistGeometry(t *testing.T) {
+	conf := DefaultConfig()
+	if err := conf.SetSkiplistMaxLevel(0); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected invalid max level, got=%v", err)
+	}
+
+	if err := conf.SetSkiplistProbability(1); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected invalid probability, got=%v", err)
+	}
+
+	conf.SetSkiplistMaxLevel(4)
+	conf.SetSkiplistProbability(0.5)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%05d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	sts := db.aggrStoreStats()
+	for level := 5; level <= skiplist.MaxLevel; level++ {
+		if sts.NodeDistribution[level] != 0 {
+			t.Errorf("Expected no nodes at level %d, got=%d", level, sts.NodeDistribution[level])
+		}
+	}
+
+	if sts.NodeDistribution[4] == 0 {
+		t.Errorf("Expected nodes at level 4")
+	}
+
+	if cnt := CountItems(snap); cnt != 10000 {
+		t.Errorf("Expected 10000 items, got=%d", cnt)
+	}
+}
+
+func BenchmarkSkiplistGeometry(b *testing.B) {
+	const n = 1000000
+
+	for _, geo := range []struct {
+		level int
+		prob  float32
+	}{{32, 0.25}, {32, 0.5}, {32, 0.0625}, {8, 0.25}} {
+		conf := DefaultConfig()
+		conf.SetSkiplistMaxLevel(geo.level)
+		conf.SetSkiplistProbability(geo.prob)
+		db := NewWithConfig(conf)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		doInsert(db, &wg, n, false, false)
+		snap, _ := db.NewSnapshot()
+
+		b.Run(fmt.Sprintf("Level%d_P%v", geo.level, geo.prob), func(b *testing.B) {
+			itr := snap.NewIterator()
+			defer itr.Close()
+
+			buf := make([]byte, 8)
+			for i := 0; i < b.N; i++ {
+				binary.BigEndian.PutUint64(buf, uint64(rand.Intn(n)))
+				if !itr.SeekExact(buf) {
+					b.Fatalf("Expected item to be found")
+				}
+			}
+		})
+
+		snap.Close()
+		db.Close()
+	}
+}
+
+func TestFlush(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("key-%06d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	snap.Close()
+	db.Flush()
+	memBefore := db.MemoryInUse()
+
+	for i := 0; i < 10000; i++ {
+		w.Delete([]byte(fmt.Sprintf("key-%06d", i)))
+	}
+	snap, _ = w.NewSnapshot()
+	snap.Close()
+
+	if err := db.Flush(); err != nil {
+		t.Errorf("Expected flush to succeed, got=%v", err)
+	}
+
+	if mem := db.MemoryInUse(); mem >= memBefore/2 {
+		t.Errorf("Expected memory in use to drop from %d, got=%d", memBefore, mem)
+	}
+
+	if len(db.gcPending) != 0 {
+		t.Errorf("Expected no pending gclists, got=%d", len(db.gcPending))
+	}
+}
+
+func TestMaxItemSize(t *testing.T) {
+	conf := testConf
+	conf.SetMaxItemSize(100)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	small := bytes.Repeat([]byte("a"), 100)
+	large := bytes.Repeat([]byte("b"), 101)
+
+	if err := w.PutChecked(small); err != nil {
+		t.Errorf("Expected item to be added, got=%v", err)
+	}
+
+	if err := w.PutChecked(large); err != ErrMaxItemSizeExceeded {
+		t.Errorf("Expected ErrMaxItemSizeExceeded, got=%v", err)
+	}
+
+	// The callers of Put and its variants see the rejection
+	if err := w.Put(large); err != ErrMaxItemSizeExceeded {
+		t.Errorf("Expected ErrMaxItemSizeExceeded, got=%v", err)
+	}
+
+	if n := w.Put2(large); n != nil {
+		t.Errorf("Expected Put2 to reject the item")
+	}
+
+	if inserted, n, err := w.PutStatus(large); inserted || n != nil || err != ErrMaxItemSizeExceeded {
+		t.Errorf("Expected PutStatus to reject the item, got=%v", err)
+	}
+
+	if err := w.Put(small); err != nil {
+		t.Errorf("Expected item to be added, got=%v", err)
+	}
+
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	if db.ItemsCount() != 1 || CountItems(snap) != 1 {
+		t.Errorf("Expected 1 item, got=%d", db.ItemsCount())
+	}
+}
+
+func TestMaxItemLen(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	w.Put([]byte("a"))
+	w.Put([]byte("z"))
+
+	// Items longer than MaxItemLen are rejected instead of being allocated
+	large := append([]byte("m"), make([]byte, MaxItemLen)...)
+	if err := w.PutChecked(large); err != ErrMaxItemSizeExceeded {
+		t.Errorf("Expected ErrMaxItemSizeExceeded, got=%v", err)
+	}
+	if _, err := w.TryPut(large); err != ErrMaxItemSizeExceeded {
+		t.Errorf("Expected ErrMaxItemSizeExceeded, got=%v", err)
+	}
+	if n := w.Put2(large); n != nil {
+		t.Errorf("Expected Put2 to reject the item")
+	}
+	if w.Delete(large) || w.GetNode(large) != nil {
+		t.Errorf("Expected no item for the key")
+	}
+
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+	VerifyCount(snap, 2, t)
+
+	if snap.Get(large) != nil || db.GetAsOf(large, snap.sn) != nil ||
+		db.VersionCount(large) != 0 || len(db.KeyHistory(large)) != 0 {
+		t.Errorf("Expected no item for the key")
+	}
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+	if itr.Seek(large); !itr.Valid() || string(itr.Get()) != "z" {
+		t.Errorf("Expected seek to the next bigger item")
+	}
+	if itr.SeekForPrev(large); !itr.Valid() || string(itr.Get()) != "a" {
+		t.Errorf("Expected seek to the previous smaller item")
+	}
+
+	l := db.NewLoader()
+	if err := l.AddSegment().AddSortedItems(large); err != ErrMaxItemSizeExceeded {
+		t.Errorf("Expected ErrMaxItemSizeExceeded, got=%v", err)
+	}
+	l.Abort()
+}
+
+func TestOverlayIterator(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for _, k := range []string{"b", "d", "f", "h"} {
+		w.Put([]byte(k))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	overlay := []OverlayEntry{
+		{Data: []byte("a")},
+		{Data: []byte("d")},
+		{Data: []byte("e"), Deleted: true},
+		{Data: []byte("f"), Deleted: true},
+		{Data: []byte("g")},
+		{Data: []byte("h"), Deleted: true},
+		{Data: []byte("i")},
+	}
+
+	itr := db.NewOverlayIterator(snap, overlay)
+	defer itr.Close()
+
+	var got []string
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		k := string(itr.Get())
+		if itr.FromOverlay() {
+			k += "*"
+		}
+		got = append(got, k)
+	}
+
+	if exp := "a*,b,d*,g*,i*"; strings.Join(got, ",") != exp {
+		t.Errorf("Expected %s, got=%v", exp, got)
+	}
+
+	got = nil
+	for itr.Seek([]byte("e")); itr.Valid(); itr.Next() {
+		got = append(got, string(itr.Get()))
+	}
+
+	if exp := "g,i"; strings.Join(got, ",") != exp {
+		t.Errorf("Expected %s, got=%v", exp, got)
+	}
+
+	if CountItems(snap) != 4 {
+		t.Errorf("Expected the snapshot to be unmodified")
+	}
+}
+
+func TestIndexScan(t *testing.T) {
+	field := func(bs []byte, i int) []byte {
+		return bytes.SplitN(bs, []byte(":"), 2)[i]
+	}
+
+	conf := testConf
+	conf.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(field(a, 0), field(b, 0))
+	})
+
+	extract := func(itm *Item) []byte { return field(itm.Bytes(), 1) }
+	if err := conf.AddIndex("color", extract); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if err := conf.AddIndex("color", extract); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig, got=%v", err)
+	}
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	scan := func(snap *Snapshot, start, end []byte) string {
+		var entries []string
+		err := db.IndexScan(snap, "color", start, end, func(ikey, data []byte) bool {
+			entries = append(entries, string(ikey)+"="+string(data))
+			return true
+		})
+
+		if err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+		return strings.Join(entries, ",")
+	}
+
+	w := db.NewWriter()
+	for _, x := range []string{"k1:red", "k2:blue", "k3:red", "k4:green"} {
+		w.Put([]byte(x))
+	}
+	snap1, _ := db.NewSnapshot()
+
+	for _, tc := range []struct {
+		start, end []byte
+		exp        string
+	}{
+		{nil, nil, "blue=k2:blue,green=k4:green,red=k1:red,red=k3:red"},
+		{[]byte("red"), nil, "red=k1:red,red=k3:red"},
+		{[]byte("blue"), []byte("red"), "blue=k2:blue,green=k4:green"},
+		{[]byte("c"), []byte("h"), "green=k4:green"},
+	} {
+		if got := scan(snap1, tc.start, tc.end); got != tc.exp {
+			t.Errorf("Expected %s, got=%s", tc.exp, got)
+		}
+	}
+
+	w.Delete([]byte("k1:"))
+	w.Put([]byte("k1:blue"))
+	w.Delete([]byte("k3:"))
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+
+	if got, exp := scan(snap2, nil, nil), "blue=k1:blue,blue=k2:blue,green=k4:green"; got != exp {
+		t.Errorf("Expected %s, got=%s", exp, got)
+	}
+
+	if got, exp := scan(snap1, nil, nil), "blue=k2:blue,green=k4:green,red=k1:red,red=k3:red"; got != exp {
+		t.Errorf("Expected old snapshot to be unchanged %s, got=%s", exp, got)
+	}
+
+	var count int
+	db.IndexScan(snap2, "color", nil, nil, func(ikey, data []byte) bool {
+		count++
+		return false
+	})
+
+	if count != 1 {
+		t.Errorf("Expected scan to stop after 1 entry, got=%d", count)
+	}
+
+	if err := db.IndexScan(snap2, "size", nil, nil, nil); err != ErrIndexNotFound {
+		t.Errorf("Expected ErrIndexNotFound, got=%v", err)
+	}
+
+	snap1.Close()
+	if err := db.IndexScan(snap1, "color", nil, nil, nil); err != ErrSnapshotClosed {
+		t.Errorf("Expected ErrSnapshotClosed, got=%v", err)
+	}
+}
+
+func TestTrimToSnapshot(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	items := func(snap *Snapshot) string {
+		var keys []string
+		itr := snap.NewIterator()
+		defer itr.Close()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			keys = append(keys, string(itr.Get()))
+		}
+		return strings.Join(keys, ",")
+	}
+
+	w := db.NewWriter()
+	for _, k := range []string{"a", "b", "c"} {
+		w.Put([]byte(k))
+	}
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+
+	w.Delete([]byte("b"))
+	w.Put([]byte("d"))
+	snap2, _ := db.NewSnapshot()
+	snap2.Close()
+
+	w.Delete([]byte("c"))
+	w.Put([]byte("e"))
+	snap3, _ := db.NewSnapshot()
+
+	w.Delete([]byte("a"))
+	w.Put([]byte("f"))
+
+	// Discard the pending writes
+	if err := db.TrimToSnapshot(snap3); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	if got := items(snap3); got != "a,d,e" || db.VersionCount([]byte("f")) != 0 {
+		t.Errorf("Expected pending writes to be discarded, got=%s", got)
+	}
+
+	if err := db.TrimToSnapshot(snap1); err != ErrNewerSnapshotOpen {
+		t.Errorf("Expected ErrNewerSnapshotOpen, got=%v", err)
+	}
+
+	snap3.Close()
+	if err := db.TrimToSnapshot(snap3); err != ErrSnapshotClosed {
+		t.Errorf("Expected ErrSnapshotClosed, got=%v", err)
+	}
+
+	if err := db.TrimToSnapshot(snap1); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if got := items(snap1); got != "a,b,c" {
+		t.Errorf("Expected snapshot to be unchanged, got=%s", got)
+	}
+
+	if db.ItemsCount() != 3 {
+		t.Errorf("Expected 3 items, got=%d", db.ItemsCount())
+	}
+
+	for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		exp := 0
+		if k <= "c" {
+			exp = 1
+		}
+
+		if n := db.VersionCount([]byte(k)); n != exp {
+			t.Errorf("Expected %d versions of %s, got=%d", exp, k, n)
+		}
+	}
+
+	w.Put([]byte("g"))
+	w.Delete([]byte("a"))
+	snap4, _ := db.NewSnapshot()
+	if snap4.sn != snap1.sn+1 {
+		t.Errorf("Expected snapshot number %d, got=%d", snap1.sn+1, snap4.sn)
+	}
+
+	if got := items(snap4); got != "b,c,g" {
+		t.Errorf("Expected b,c,g got=%s", got)
+	}
+
+	snap4.Close()
+	snap1.Close()
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if n := db.DeadSnapshotsCount(); n != 0 {
+		t.Errorf("Expected no dead snapshots, got=%d", n)
+	}
+
+	if n := db.VersionCount([]byte("a")); n != 0 {
+		t.Errorf("Expected a to be collected, got=%d versions", n)
+	}
+}
+
+func TestTrimToSnapshotIndexes(t *testing.T) {
+	conf := testConf
+	conf.AddIndex("first", func(itm *Item) []byte { return itm.Bytes()[:1] })
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	scan := func(snap *Snapshot) string {
+		var entries []string
+		db.IndexScan(snap, "first", nil, nil, func(ikey, data []byte) bool {
+			entries = append(entries, string(data))
+			return true
+		})
+		return strings.Join(entries, ",")
+	}
+
+	w := db.NewWriter()
+	w.Put([]byte("a1"))
+	w.Put([]byte("b1"))
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+
+	w.Delete([]byte("a1"))
+	w.Put([]byte("c1"))
+	snap2, _ := db.NewSnapshot()
+	snap2.Close()
+
+	// A newer snapshot of the index prevents the index from being rewound
+	isnap, _ := db.indexes[0].db.NewSnapshot()
+	if err := db.TrimToSnapshot(snap1); err != ErrNewerSnapshotOpen {
+		t.Errorf("Expected ErrNewerSnapshotOpen, got=%v", err)
+	}
+
+	if n := db.VersionCount([]byte("c1")); n != 1 {
+		t.Errorf("Expected the store to be unchanged, got=%d versions of c1", n)
+	}
+
+	isnap.Close()
+	if err := db.TrimToSnapshot(snap1); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	snap3, _ := db.NewSnapshot()
+	defer snap3.Close()
+	if got := scan(snap3); got != "a1,b1" {
+		t.Errorf("Expected a1,b1 got=%s", got)
+	}
+
+	if n := db.VersionCount([]byte("c1")); n != 0 {
+		t.Errorf("Expected c1 to be discarded, got=%d versions", n)
+	}
+}
+
+// Lookups of a key with many retained versions cost the same as the lookups
+// of a key with a single version
+func BenchmarkGetVersions(b *testing.B) {
+	for _, versions := range []int{1, 10000} {
+		db := NewWithConfig(testConf)
+		w := db.NewWriter()
+		for i := 0; i < 1000; i++ {
+			w.Put([]byte(fmt.Sprintf("%010d", i)))
+		}
+
+		key := []byte(fmt.Sprintf("%010d", 500))
+		var snaps []*Snapshot
+		for i := 1; i < versions; i++ {
+			w.Delete(key)
+			w.Put(key)
+			snap, _ := w.NewSnapshot()
+			snaps = append(snaps, snap)
+		}
+		latest, _ := w.NewSnapshot()
+		snaps = append(snaps, latest)
+
+		b.Run(fmt.Sprintf("GetNode/Versions%d", versions), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if w.GetNode(key) == nil {
+					b.Fatalf("Expected %s to be found", key)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("SeekExact/Versions%d", versions), func(b *testing.B) {
+			itr := latest.NewIterator()
+			defer itr.Close()
+			for i := 0; i < b.N; i++ {
+				if !itr.SeekExact(key) {
+					b.Fatalf("Expected %s to be found", key)
+				}
+			}
+		})
+
+		for _, snap := range snaps {
+			snap.Close()
+		}
+		db.Close()
+	}
+}
+
+func TestOperationStatus(t *testing.T) {
+	const n = 100000
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	conf := testConf
+	conf.SetStoreProgressCallback(nil, 100)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+
+	// Pause the operation midway until its status has been observed
+	run := func(typ OperationType, op func(callb ItemCallback) error) {
+		var count int64
+		var once sync.Once
+		reached := make(chan struct{})
+		release := make(chan struct{})
+		callb := func(*ItemEntry) {
+			if atomic.AddInt64(&count, 1) == n/2 {
+				once.Do(func() {
+					close(reached)
+					<-release
+				})
+			}
+		}
+
+		errch := make(chan error, 1)
+		go func() { errch <- op(callb) }()
+
+		go func() {
+			defer close(release)
+			<-reached
+			status := db.OperationStatus()
+			if len(status) != 1 || status[0].Type != typ {
+				t.Errorf("Expected a running %v, got=%v", typ, status)
+				return
+			}
+
+			if status[0].Items <= 0 || status[0].Bytes <= 0 || status[0].StartTime.IsZero() {
+				t.Errorf("Expected progress of %v, got=%+v", typ, status[0])
+			}
+		}()
+
+		if err := <-errch; err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+
+		if status := db.OperationStatus(); len(status) != 0 {
+			t.Errorf("Expected idle instance after %v, got=%v", typ, status)
+		}
+	}
+
+	run(OpStoreToDisk, func(callb ItemCallback) error {
+		return db.StoreToDisk("db.dump", snap, 4, callb)
+	})
+
+	run(OpLoadFromDisk, func(callb ItemCallback) error {
+		snap, err := db.LoadFromDisk("db.dump", 4, callb)
+		if err == nil {
+			snap.Close()
+		}
+		return err
+	})
+}
+
+func TestLoadProgressPeriod(t *testing.T) {
+	const n = 99999
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	db.Close()
+
+	// A file is reported as loaded before its last batch is published
+	var calls int
+	conf := testConf
+	conf.SetStoreProgressCallback(nil, 100)
+	conf.SetLoadProgressCallback(func(itemsLoaded int64, shardsLoaded int) {
+		calls++
+		status := db.OperationStatus()
+		if len(status) != 1 || status[0].Items < itemsLoaded-100 {
+			t.Errorf("Expected progress of %d items published, got=%+v", itemsLoaded, status)
+		}
+	})
+	db = NewWithConfig(conf)
+	defer db.Close()
+
+	snap, err := db.LoadFromDisk("db.dump", 1, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	snap.Close()
+
+	if calls == 0 {
+		t.Errorf("Expected load progress calls")
+	}
+}
+
+func TestGetAsOf(t *testing.T) {
+	conf := testConf
+	conf.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(bytes.SplitN(a, []byte(":"), 2)[0], bytes.SplitN(b, []byte(":"), 2)[0])
+	})
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	w.Put([]byte("a:0"))
+	w.Put([]byte("k:v1"))
+	w.Put([]byte("z:0"))
+	snap1, _ := db.NewSnapshot()
+
+	w.Delete([]byte("k:"))
+	w.Put([]byte("k:v2"))
+	snap2, _ := db.NewSnapshot()
+
+	w.Delete([]byte("k:"))
+	snap3, _ := db.NewSnapshot()
+
+	w.Put([]byte("k:v3"))
+	snap4, _ := db.NewSnapshot()
+	defer snap4.Close()
+
+	getAsOf := func(sn uint32) string {
+		if itm := db.GetAsOf([]byte("k:"), sn); itm != nil {
+			return string(itm.Bytes())
+		}
+		return "nil"
+	}
+
+	for _, tc := range []struct {
+		sn  uint32
+		exp string
+	}{
+		{0, "nil"},
+		{snap1.sn, "k:v1"},
+		{snap2.sn, "k:v2"},
+		{snap3.sn, "nil"},
+		{snap4.sn, "k:v3"},
+		{db.getCurrSn(), "k:v3"},
+		{math.MaxUint32, "k:v3"},
+	} {
+		if got := getAsOf(tc.sn); got != tc.exp {
+			t.Errorf("Expected %s as of %d, got=%s", tc.exp, tc.sn, got)
+		}
+	}
+
+	if itm := db.GetAsOf([]byte("b:"), snap4.sn); itm != nil {
+		t.Errorf("Expected missing key, got=%s", itm.Bytes())
+	}
+
+	snap1.Close()
+	snap2.Close()
+	snap3.Close()
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if got := getAsOf(snap1.sn); got != "nil" {
+		t.Errorf("Expected collected version, got=%s", got)
+	}
+
+	if got := getAsOf(snap4.sn); got != "k:v3" {
+		t.Errorf("Expected k:v3, got=%s", got)
+	}
+}
+
+func TestSkipIdenticalPuts(t *testing.T) {
+	conf := testConf
+	conf.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(bytes.SplitN(a, []byte(":"), 2)[0], bytes.SplitN(b, []byte(":"), 2)[0])
+	})
+	conf.SetSkipIdenticalPuts(true)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	n1 := w.Put2([]byte("k:v1"))
+	if inserted, n2, _ := w.PutStatus([]byte("k:v1")); inserted || n2 != n1 {
+		t.Errorf("Expected identical put in the same snapshot number to be skipped")
+	}
+
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 0; i < 10; i++ {
+		if n := w.Put2([]byte("k:v1")); n != n1 {
+			t.Errorf("Expected existing node to be returned")
+		}
+
+		// Replays of a backup do not replace the identical item
+		if n := w.putOverlay([]byte("k:v1")); n != n1 {
+			t.Errorf("Expected existing node to be retained")
+		}
+	}
+
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+
+	if n := db.VersionCount([]byte("k:")); n != 1 {
+		t.Errorf("Expected 1 version, got=%d", n)
+	}
+
+	if db.ItemsCount() != 1 || snap2.Count() != 1 {
+		t.Errorf("Expected 1 item, got=%d", db.ItemsCount())
+	}
+
+	// A different value with the same key is replaced by putOverlay
+	n3 := w.putOverlay([]byte("k:v2"))
+	if n3 == nil || n3 == n1 {
+		t.Errorf("Expected a new version for a different value")
+	}
+
+	snap3, _ := db.NewSnapshot()
+	defer snap3.Close()
+
+	if n := db.VersionCount([]byte("k:")); n != 2 {
+		t.Errorf("Expected 2 versions, got=%d", n)
+	}
+
+	if db.ItemsCount() != 1 {
+		t.Errorf("Expected 1 item, got=%d", db.ItemsCount())
+	}
+}
+
+func TestStoreAccess(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		w.Put([]byte(fmt.Sprintf("%03d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	for i := 0; i < 100; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%03d", i)))
+		w.Put([]byte(fmt.Sprintf("%03d", i)))
+	}
+
+	// Count the versions of the keys in [050, 060) using the skiplist
+	store := db.Store()
+	buf := store.MakeBuf()
+	defer store.FreeBuf(buf)
+	itr := store.NewIterator(db.IterCompare(), buf)
+	defer itr.Close()
+
+	var versions, visible int
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		itm := (*Item)(itr.Get())
+		if k := string(itm.Bytes()); k < "050" {
+			continue
+		} else if k >= "060" {
+			break
+		}
+
+		versions++
+		if itm.BornSn() <= snap.sn && (itm.DeadSn() == 0 || itm.DeadSn() > snap.sn) {
+			visible++
+		}
+	}
+
+	if versions != 15 || visible != 10 {
+		t.Errorf("Expected 15 versions and 10 visible items, got=%d, %d", versions, visible)
+	}
+
+	a, b := db.newItem([]byte("a"), false), db.newItem([]byte("a"), false)
+	b.bornSn = 1
+	if db.IterCompare()(unsafe.Pointer(a), unsafe.Pointer(b)) != 0 ||
+		db.InsertCompare()(unsafe.Pointer(a), unsafe.Pointer(b)) >= 0 {
+		t.Errorf("Expected versions to be ordered only by the insert comparator")
+	}
+}
+
+func TestExpectedItemCount(t *testing.T) {
+	const n = 10000
+	conf := DefaultConfig()
+	conf.SetExpectedItemCount(n)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%0*d", 1+i%20, i)))
+	}
+	snap1, _ := db.NewSnapshot()
+
+	// Every other item is replaced by a different version
+	for i := 0; i < n; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%0*d", 1+i%20, i)))
+		w.Put([]byte(fmt.Sprintf("%0*d", 1+i%20, i)))
+	}
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+	snap1.Close()
+	db.Compact()
+
+	count := 0
+	itr := snap2.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		itm := (*Item)(itr.GetNode().Item())
+		if uintptr(unsafe.Pointer(itm))%8 != 0 {
+			t.Fatalf("Expected aligned item, got=%p", itm)
+		}
+
+		var i int
+		fmt.Sscanf(string(itm.Bytes()), "%d", &i)
+		if exp := fmt.Sprintf("%0*d", 1+i%20, i); string(itm.Bytes()) != exp {
+			t.Errorf("Expected %s, got=%s", exp, itm.Bytes())
+		}
+		count++
+	}
+
+	if count != n || db.ItemsCount() != n {
+		t.Errorf("Expected %d items, got=%d, %d", n, count, db.ItemsCount())
+	}
+}
+
+func BenchmarkBulkInsert(b *testing.B) {
+	for _, hint := range []int{0, 1000000} {
+		b.Run(fmt.Sprintf("ExpectedItemCount%d", hint), func(b *testing.B) {
+			conf := DefaultConfig()
+			conf.SetExpectedItemCount(hint)
+			db := NewWithConfig(conf)
+			defer db.Close()
+
+			w := db.NewWriter()
+			var key [8]byte
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				binary.BigEndian.PutUint64(key[:], uint64(i))
+				w.Put(key[:])
+			}
+		})
+	}
+}
+
+func TestApproxCount(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	rnd := rand.New(rand.NewSource(0))
+	var wg sync.WaitGroup
+	var snaps []*Snapshot
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(w *Writer, seed int64) {
+				defer wg.Done()
+				rnd := rand.New(rand.NewSource(seed))
+				for j := 0; j < 5000; j++ {
+					k := []byte(fmt.Sprintf("%06d", rnd.Intn(20000)))
+					if rnd.Intn(3) == 0 {
+						w.Delete(k)
+					} else {
+						w.Put(k)
+					}
+				}
+			}(db.NewWriter(), rnd.Int63())
+		}
+		wg.Wait()
+
+		snap, _ := db.NewSnapshot()
+		snaps = append(snaps, snap)
+	}
+
+	for _, snap := range snaps {
+		if exp, got := int64(CountItems(snap)), db.ApproxCount(snap); got != exp {
+			t.Errorf("Expected %d items in snapshot %d, got=%d", exp, snap.sn, got)
+		}
+		snap.Close()
+	}
+}
+
+func TestIteratorDistinctKeys(t *testing.T) {
+	const keys = 50
+	conf := testConf
+	conf.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(bytes.SplitN(a, []byte(":"), 2)[0], bytes.SplitN(b, []byte(":"), 2)[0])
+	})
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	rnd := rand.New(rand.NewSource(0))
+	w := db.NewWriter()
+	values := make(map[int]int)
+	var snaps []*Snapshot
+	var expected []map[int]int
+	for round := 0; round < 100; round++ {
+		for i := 0; i < keys/2; i++ {
+			k := rnd.Intn(keys)
+			w.Delete([]byte(fmt.Sprintf("%03d:", k)))
+			if rnd.Intn(4) == 0 {
+				delete(values, k)
+				continue
+			}
+
+			values[k] = round
+			w.Put([]byte(fmt.Sprintf("%03d:%d", k, round)))
+		}
+
+		snap, _ := db.NewSnapshot()
+		snaps = append(snaps, snap)
+		exp := make(map[int]int)
+		for k, v := range values {
+			exp[k] = v
+		}
+		expected = append(expected, exp)
+	}
+
+	for i, snap := range snaps {
+		for _, rate := range []int{0, 1, 3} {
+			itr := snap.NewIterator()
+			itr.SetRefreshRate(rate)
+			last := -1
+			count := 0
+			for itr.SeekFirst(); itr.Valid(); itr.Next() {
+				var k, v int
+				fmt.Sscanf(string(itr.Get()), "%d:%d", &k, &v)
+				if k <= last {
+					t.Fatalf("Expected distinct keys in order, got=%d after %d", k, last)
+				}
+
+				if exp, ok := expected[i][k]; !ok || exp != v {
+					t.Fatalf("Expected %d:%d in snapshot %d, got=%d:%d", k, exp, i, k, v)
+				}
+				last = k
+				count++
+			}
+			itr.Close()
+
+			if count != len(expected[i]) {
+				t.Errorf("Expected %d keys in snapshot %d, got=%d", len(expected[i]), i, count)
+			}
+		}
+	}
+
+	for _, snap := range snaps {
+		snap.Close()
+	}
+}
+
+func TestSnapshotIsLive(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	w.Put([]byte("key-1"))
+	snap, _ := w.NewSnapshot()
+	if !snap.IsLive() {
+		t.Errorf("Expected a new snapshot to be live")
+	}
+
+	snap.Open()
+	snap.Close()
+	if !snap.IsLive() {
+		t.Errorf("Expected the snapshot to be live while a reference is held")
+	}
+
+	snap.Close()
+	if snap.IsLive() {
+		t.Errorf("Expected the snapshot to be destroyed after the last close")
+	}
+
+	if snap.Open() {
+		t.Errorf("Expected open to fail once the snapshot is not live")
+	}
+}
+
+func TestValueEqual(t *testing.T) {
+	// Items are key:value@timestamp and the timestamp is not part of the value
+	field := func(bs []byte, sep string) []byte {
+		return bytes.SplitN(bs, []byte(sep), 2)[0]
+	}
+
+	conf := testConf
+	conf.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(field(a, ":"), field(b, ":"))
+	})
+	conf.SetValueEqual(func(this, that *Item) bool {
+		return bytes.Equal(field(this.Bytes(), "@"), field(that.Bytes(), "@"))
+	})
+	conf.SetSkipIdenticalPuts(true)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	n1 := w.Put2([]byte("k:v1@1"))
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+
+	if n := w.putOverlay([]byte("k:v1@2")); n != n1 {
+		t.Errorf("Expected item with the same value to be retained")
+	}
+
+	if n := w.putOverlay([]byte("k:v2@3")); n == nil || n == n1 {
+		t.Errorf("Expected a new version for a different value")
+	}
+
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+
+	if n := db.VersionCount([]byte("k:")); n != 2 {
+		t.Errorf("Expected 2 versions, got=%d", n)
+	}
+
+	itr := snap2.NewIterator()
+	defer itr.Close()
+	if !itr.SeekExact([]byte("k:")) || string(itr.Get()) != "k:v2@3" {
+		t.Errorf("Expected k:v2@3 as the latest item")
+	}
+}
+
+func TestStoreToDiskMemoryBound(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	// The items are allocated by the memory manager. Hence, the heap
+	// allocations only include the memory used by the backup.
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	const itemSize = 32 * 1024
+	w := db.NewWriter()
+	value := bytes.Repeat([]byte("x"), itemSize)
+	for i := 0; i < 1000; i++ {
+		w.Put(append([]byte(fmt.Sprintf("%06d", i)), value...))
+	}
+	snap, _ := db.NewSnapshot()
+
+	// The visitor does not read ahead while a callback is blocked
+	var visited int64
+	resume := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- db.Visitor(snap, func(itm *Item, shard int) error {
+			if atomic.AddInt64(&visited, 1) == 1 {
+				<-resume
+			}
+			return nil
+		}, 4, 1)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&visited); n != 1 {
+		t.Errorf("Expected visitor to wait for the callback, got=%d items", n)
+	}
+	close(resume)
+
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got=%v", err)
+	}
+
+	if n := atomic.LoadInt64(&visited); n != 1000 {
+		t.Errorf("Expected 1000 items, got=%d", n)
+	}
+
+	// StoreToDisk closes the snapshot
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	runtime.ReadMemStats(&after)
+
+	// The backup needs at most a buffer per shard, while the items hold 32MB
+	limit := uint64(8 * DiskBlockSize)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > limit {
+		t.Errorf("Expected at most %d bytes allocated by backup, got=%d", limit, alloc)
+	}
+}
+
+func TestSortedByValueIterator(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	// Items are key:value with a numeric value. Items without a value are
+	// excluded from the iteration.
+	extract := func(itm *Item) []byte {
+		parts := strings.SplitN(string(itm.Bytes()), ":", 2)
+		if len(parts) < 2 {
+			return nil
+		}
+
+		var v uint64
+		fmt.Sscanf(parts[1], "%d", &v)
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, v)
+		return key
+	}
+
+	rnd := rand.New(rand.NewSource(0))
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("k%04d:%d", i, rnd.Intn(200))))
+	}
+	w.Put([]byte("novalue"))
+	snap, _ := db.NewSnapshot()
+
+	it, err := db.SortedByValueIterator(snap, extract)
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	defer it.Close()
+
+	// The iterator remains valid after the snapshot is closed by the caller
+	snap.Close()
+
+	count := 0
+	var lastValue uint64
+	var lastKey string
+	for it.SeekFirst(); it.Valid(); it.Next() {
+		parts := strings.SplitN(string(it.Get()), ":", 2)
+		v := binary.BigEndian.Uint64(it.Key())
+		if fmt.Sprint(v) != parts[1] {
+			t.Errorf("Expected extracted key %s, got=%d", parts[1], v)
+		}
+
+		if v < lastValue || (v == lastValue && parts[0] <= lastKey) {
+			t.Errorf("Expected %s after %d:%s", it.Get(), lastValue, lastKey)
+		}
+		lastValue, lastKey = v, parts[0]
+		count++
+	}
+
+	if count != 1000 {
+		t.Errorf("Expected 1000 items, got=%d", count)
+	}
+
+	it.Close()
+	if it.SeekFirst(); it.Valid() {
+		t.Errorf("Expected closed iterator to be invalid")
+	}
+
+	if _, err := db.SortedByValueIterator(snap, extract); err != ErrSnapshotClosed {
+		t.Errorf("Expected ErrSnapshotClosed, got=%v", err)
+	}
+}
+
+func TestCustomAllocator(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("Memory management is supported only on amd64")
+	}
+
+	var allocs, frees int64
+	conf := DefaultConfig()
+	conf.UseMemoryMgmt(func(sz int) unsafe.Pointer {
+		atomic.AddInt64(&allocs, 1)
+		return mm.Malloc(sz)
+	}, func(p unsafe.Pointer) {
+		atomic.AddInt64(&frees, 1)
+		mm.Free(p)
+	})
+
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%05d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+
+	// Every item and its skiplist node are allocated
+	if n := atomic.LoadInt64(&allocs); n < 2000 {
+		t.Errorf("Expected at least 2000 allocations, got=%d", n)
+	}
+
+	for i := 0; i < 500; i++ {
+		w.Delete([]byte(fmt.Sprintf("%05d", i)))
+	}
+	snap2, _ := db.NewSnapshot()
+	snap.Close()
+	snap2.Close()
+	db.Compact()
+
+	// The nodes are freed once their accessor sessions have been released
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&frees) < 1000 && time.Now().Before(deadline) {
+		snap3, _ := db.NewSnapshot()
+		snap3.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt64(&frees); n < 1000 {
+		t.Errorf("Expected the deleted items and nodes to be freed, got=%d frees", n)
+	}
+
+	snap, _ = db.NewSnapshot()
+	VerifyCount(snap, 500, t)
+	snap.Close()
+	db.Close()
+
+	if a, f := atomic.LoadInt64(&allocs), atomic.LoadInt64(&frees); a != f {
+		t.Errorf("Expected all %d allocations to be freed after close, got=%d", a, f)
+	}
+}
+
+func TestTryPut(t *testing.T) {
+	conf := testConf
+	conf.SetMemoryQuota(256 * 1024)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	var err error
+	var n int
+	for ; n < 100000; n++ {
+		var inserted bool
+		if inserted, err = w.TryPut([]byte(fmt.Sprintf("item-%06d", n))); !inserted {
+			break
+		}
+	}
+
+	if err != ErrQuotaExceeded || n == 0 {
+		t.Fatalf("Expected ErrQuotaExceeded after some items, got=%v after %d items", err, n)
+	}
+
+	if mem := db.MemoryInUse(); mem > 256*1024 {
+		t.Errorf("Expected memory within the quota, got=%d", mem)
+	}
+
+	// An item which fits exactly is added while a larger item is rejected
+	maxNode := int64(skiplist.NodeSize(db.store.MaxLevel))
+	db.memQuota = db.MemoryInUse() + int64(itemHeaderSize) + 10 + maxNode
+	mem := db.MemoryInUse()
+	if inserted, err := w.TryPut([]byte("large-item1")); inserted || err != ErrQuotaExceeded {
+		t.Errorf("Expected ErrQuotaExceeded for a larger item, got=%v", err)
+	}
+
+	if db.MemoryInUse() != mem || w.GetNode([]byte("large-item1")) != nil {
+		t.Errorf("Expected the store to remain unchanged")
+	}
+
+	if inserted, err := w.TryPut([]byte("small-item")); !inserted || err != nil {
+		t.Errorf("Expected the item to fit in the quota, got=%v", err)
+	}
+
+	if mem := db.MemoryInUse(); mem > db.memQuota {
+		t.Errorf("Expected memory within the quota, got=%d", mem)
+	}
+
+	// Other writes are not limited
+	w.Put([]byte("large-item1"))
+	snap, _ := db.NewSnapshot()
+	VerifyCount(snap, n+2, t)
+	snap.Close()
+}
+
+func TestCurrentSn(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10; i++ {
+		sn := db.CurrentSn()
+		w.Put([]byte(fmt.Sprintf("key-%d", i)))
+		if itm := db.GetAsOf([]byte(fmt.Sprintf("key-%d", i)), sn); itm == nil || itm.bornSn != sn {
+			t.Errorf("Expected the latest write to be born at %d", sn)
+		}
+
+		snap, _ := db.NewSnapshot()
+		if snap.sn != sn {
+			t.Errorf("Expected snapshot number %d, got=%d", sn, snap.sn)
+		}
+		snap.Close()
+
+		if next := db.CurrentSn(); next != sn+1 {
+			t.Errorf("Expected current sn %d after snapshot, got=%d", sn+1, next)
+		}
+	}
+}
+
+func TestScheduledCheckpoint(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	db.syncPath = func(string) error { return nil }
+
+	// Leftovers of a failed backup are removed
+	stale := filepath.Join("db.dump", checkpointPrefix+"20000101T000000.000000000Z.tmp")
+	os.MkdirAll(stale, 0755)
+
+	w := db.NewWriter()
+	var paths []string
+	for i := 0; i < 5; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+		path, err := db.ScheduledCheckpoint("db.dump", 3, 2)
+		if err != nil {
+			t.Fatalf("Expected no error, got=%v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	backups, leftovers, _ := listCheckpoints("db.dump")
+	if len(backups) != 3 || len(leftovers) != 0 {
+		t.Fatalf("Expected 3 backups and no leftovers, got=%v, %v", backups, leftovers)
+	}
+
+	for i, path := range paths[2:] {
+		if filepath.Join("db.dump", backups[i]) != path {
+			t.Errorf("Expected %s to be retained, got=%s", path, backups[i])
+		}
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap, err := db2.LoadFromDisk(paths[4], 2, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	VerifyCount(snap, 5, t)
+	snap.Close()
+
+	// The newest backup is retained even if the clock has moved back
+	future := filepath.Join("db.dump", checkpointPrefix+"21000101T000000.000000000Z")
+	os.MkdirAll(future, 0755)
+	path, err := db.ScheduledCheckpoint("db.dump", 1, 2)
+	if err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+
+	if backups, _, _ = listCheckpoints("db.dump"); len(backups) != 1 || filepath.Join("db.dump", backups[0]) != path {
+		t.Errorf("Expected only the new backup %s to be retained, got=%v", path, backups)
+	}
+
+	if path <= future {
+		t.Errorf("Expected the new backup to be named after %s, got=%s", future, path)
+	}
+}
+
+func TestKeyComparatorName(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	newDB := func(name string, reverse bool) *Nitro {
+		conf := testConf
+		if reverse {
+			conf.SetKeyComparator(func(a, b []byte) int { return bytes.Compare(b, a) })
+		}
+		conf.SetKeyComparatorName(name)
+		return NewWithConfig(conf)
+	}
+
+	db := newDB("asc", false)
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got=%v", err)
+	}
+	db.Close()
+
+	db = newDB("desc", true)
+	if _, err := db.LoadFromDisk("db.dump", 4, nil); err != ErrComparatorMismatch {
+		t.Errorf("Expected ErrComparatorMismatch, got=%v", err)
+	}
+
+	if _, err := db.MergeFromDisk("db.dump", 4, nil); err != ErrComparatorMismatch {
+		t.Errorf("Expected ErrComparatorMismatch for merge, got=%v", err)
+	}
+	db.Close()
+
+	// Instances without a comparator name do not check the backup
+	for _, name := range []string{"asc", ""} {
+		db = newDB(name, false)
+		snap, err := db.LoadFromDisk("db.dump", 4, nil)
+		if err != nil {
+			t.Fatalf("Expected no error for comparator %q, got=%v", name, err)
+		}
+
+		itr := snap.NewIterator()
+		if !itr.SeekExact([]byte(fmt.Sprintf("%010d", 500))) {
+			t.Errorf("Expected lookups to succeed for comparator %q", name)
+		}
+		itr.Close()
+		snap.Close()
+		db.Close()
+	}
+}
+
+func TestWriterPool(t *testing.T) {
+	const workers = 8
+	const n = 500
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	// Every borrowed writer should be used by a single goroutine at a time
+	var inUse sync.Map
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				w := db.GetWriter()
+				flag, _ := inUse.LoadOrStore(w, new(int32))
+				if !atomic.CompareAndSwapInt32(flag.(*int32), 0, 1) {
+					t.Errorf("Expected exclusive use of a borrowed writer")
+				}
+
+				key := []byte(fmt.Sprintf("%d-%06d", id, j))
+				w.Put(key)
+				if j%2 == 1 {
+					w.Delete(key)
+				}
+
+				atomic.StoreInt32(flag.(*int32), 0)
+				db.PutWriter(w)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if nw := db.numWriters(); nw > workers {
+		t.Errorf("Expected at most %d writers, got=%d", workers, nw)
+	}
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	VerifyCount(snap, workers*n/2, t)
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		var id, j int
+		fmt.Sscanf(string(itr.Get()), "%d-%d", &id, &j)
+		if j%2 == 1 {
+			t.Errorf("Expected deleted item %s to be absent", itr.Get())
+		}
+	}
+
+	// The stats and the count of a returned writer are published, but the
+	// count is captured only by the next snapshot
+	nodes := db.store.GetStats().NodeCount
+	w := db.GetWriter()
+	w.Put([]byte("pooled"))
+	db.PutWriter(w)
+
+	var sts skiplist.StatsReport
+	sts.Apply(&w.slSts1)
+	if w.count != 0 || sts.NodeCount != 0 {
+		t.Errorf("Expected the writer counters to be reset")
+	}
+	if after := db.store.GetStats().NodeCount; after != nodes+1 {
+		t.Errorf("Expected the writer stats to be published, got=%d nodes, before=%d", after, nodes)
+	}
+	if count := db.ItemsCount(); count != workers*n/2 {
+		t.Errorf("Expected %d items before the snapshot, got=%d", workers*n/2, count)
+	}
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+	VerifyCount(snap2, workers*n/2+1, t)
+
+	func() {
+		w := db.GetWriter()
+		w.acquire()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected panic for a writer in use")
+			}
+			w.release()
+			db.PutWriter(w)
+		}()
+		db.PutWriter(w)
+	}()
+
+	w = db.GetWriter()
+	db.PutWriter(w)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected panic for a writer returned twice")
+		}
+	}()
+	db.PutWriter(w)
+}
+
+func BenchmarkWriterPool(b *testing.B) {
+	conf := DefaultConfig()
+	conf.UseSyncGC()
+
+	b.Run("NewWriter", func(b *testing.B) {
+		db := NewWithConfig(conf)
+		defer db.Close()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w := db.NewWriter()
+			w.Put([]byte(fmt.Sprintf("%010d", i)))
+		}
+	})
+
+	b.Run("GetWriter", func(b *testing.B) {
+		db := NewWithConfig(conf)
+		defer db.Close()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w := db.GetWriter()
+			w.Put([]byte(fmt.Sprintf("%010d", i)))
+			db.PutWriter(w)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// OperationType identifies a long running operation of a Nitro instance
+type OperationType int
+
+const (
+	// OpStoreToDisk is a backup created by StoreToDisk()
+	OpStoreToDisk OperationType = iota + 1
+	// OpLoadFromDisk is a restore by LoadFromDisk()
+	OpLoadFromDisk
+)
+
+func (t OperationType) String() string {
+	switch t {
+	case OpStoreToDisk:
+		return "StoreToDisk"
+	case OpLoadFromDisk:
+		return "LoadFromDisk"
+	}
+
+	return "Unknown"
+}
+
+// OperationStatus describes the progress of a long running operation
+// The progress is published by every backup shard or restore file once every
+// progress period items. Hence, the counts may lag behind by a few items per
+// shard until the operation has finished.
+type OperationStatus struct {
+	Type      OperationType
+	StartTime time.Time
+	// Items and bytes written by a backup or read by a restore
+	Items int64
+	Bytes int64
+}
+
+type operation struct {
+	typ   OperationType
+	start time.Time
+	items int64
+	bytes int64
+}
+
+// addProgress publishes the progress of the operation and returns the totals
+func (op *operation) addProgress(items, bytes int64) (int64, int64) {
+	return atomic.AddInt64(&op.items, items), atomic.AddInt64(&op.bytes, bytes)
+}
+
+// beginOperation records a long running operation until endOperation() is
+// called
+func (m *Nitro) beginOperation(typ OperationType) *operation {
+	op := &operation{typ: typ, start: time.Now()}
+	m.opsMu.Lock()
+	m.ops = append(m.ops, op)
+	m.opsMu.Unlock()
+
+	return op
+}
+
+func (m *Nitro) endOperation(op *operation) {
+	m.opsMu.Lock()
+	defer m.opsMu.Unlock()
+
+	for i, x := range m.ops {
+		if x == op {
+			m.ops = append(m.ops[:i], m.ops[i+1:]...)
+			return
+		}
+	}
+}
+
+// OperationStatus returns the status of the StoreToDisk() and LoadFromDisk()
+// operations which are running on the Nitro instance, in the order they were
+// started. It returns an empty list if the instance is idle. It can be called
+// from any goroutine to track the operations.
+func (m *Nitro) OperationStatus() []OperationStatus {
+	m.opsMu.Lock()
+	defer m.opsMu.Unlock()
+
+	status := make([]OperationStatus, 0, len(m.ops))
+	for _, op := range m.ops {
+		status = append(status, OperationStatus{
+			Type:      op.typ,
+			StartTime: op.start,
+			Items:     atomic.LoadInt64(&op.items),
+			Bytes:     atomic.LoadInt64(&op.bytes),
+		})
+	}
+
+	return status
+}
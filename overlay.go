@@ -0,0 +1,132 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import "sort"
+
+// OverlayEntry is a pending write which has not been applied to the store
+// An entry with Deleted set is a tombstone for the item with the same key.
+type OverlayEntry struct {
+	Data    []byte
+	Deleted bool
+}
+
+// OverlayIterator iterates over the items of a snapshot merged with an
+// overlay of pending writes. The overlay entries replace the items with the
+// same keys in the snapshot and the tombstones hide them.
+type OverlayIterator struct {
+	db      *Nitro
+	iter    *Iterator
+	overlay []OverlayEntry
+	pos     int
+
+	// Whether the current item is from the overlay
+	fromOverlay bool
+	valid       bool
+}
+
+// NewOverlayIterator creates an iterator which yields the items of the
+// snapshot with the overlay applied. The overlay entries should be sorted by
+// the key comparator without duplicate keys and they should not be modified
+// while the iterator is in use. It returns nil if the snapshot has already
+// been destroyed.
+func (m *Nitro) NewOverlayIterator(snap *Snapshot, overlay []OverlayEntry) *OverlayIterator {
+	itr := m.NewIterator(snap)
+	if itr == nil {
+		return nil
+	}
+
+	return &OverlayIterator{db: m, iter: itr, overlay: overlay}
+}
+
+// settle positions the iterator at the next item from either the snapshot
+// or the overlay, skipping the shadowed snapshot items and the tombstones.
+func (it *OverlayIterator) settle() {
+	for {
+		ovValid := it.pos < len(it.overlay)
+		if it.iter.Valid() {
+			cmp := -1
+			if ovValid {
+				cmp = it.db.keyCmp(it.iter.Get(), it.overlay[it.pos].Data)
+			}
+
+			if cmp < 0 {
+				it.fromOverlay, it.valid = false, true
+				return
+			}
+
+			if cmp == 0 {
+				it.iter.Next()
+			}
+		}
+
+		if !ovValid {
+			it.valid = false
+			return
+		}
+
+		if !it.overlay[it.pos].Deleted {
+			it.fromOverlay, it.valid = true, true
+			return
+		}
+		it.pos++
+	}
+}
+
+// SeekFirst moves cursor to the beginning
+func (it *OverlayIterator) SeekFirst() {
+	it.iter.SeekFirst()
+	it.pos = 0
+	it.settle()
+}
+
+// Seek to a specified key or the next bigger one if an item with key does not
+// exist.
+func (it *OverlayIterator) Seek(bs []byte) {
+	it.iter.Seek(bs)
+	it.pos = sort.Search(len(it.overlay), func(i int) bool {
+		return it.db.keyCmp(it.overlay[i].Data, bs) >= 0
+	})
+	it.settle()
+}
+
+// Valid returns false when the iterator has reached the end.
+func (it *OverlayIterator) Valid() bool {
+	return it.valid
+}
+
+// Get returns the current item data from the iterator.
+func (it *OverlayIterator) Get() []byte {
+	if it.fromOverlay {
+		return it.overlay[it.pos].Data
+	}
+
+	return it.iter.Get()
+}
+
+// FromOverlay returns true if the current item is from the overlay
+func (it *OverlayIterator) FromOverlay() bool {
+	return it.fromOverlay
+}
+
+// Next moves iterator cursor to the next item
+func (it *OverlayIterator) Next() {
+	if it.fromOverlay {
+		it.pos++
+	} else {
+		it.iter.Next()
+	}
+	it.settle()
+}
+
+// Close executes destructor for iterator
+func (it *OverlayIterator) Close() {
+	it.iter.Close()
+}
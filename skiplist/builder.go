@@ -10,6 +10,7 @@
 package skiplist
 
 import "math/rand"
+import "sync/atomic"
 import "unsafe"
 
 // NodeCallback is used by segment builder
@@ -104,6 +105,7 @@ func (b *Builder) Assemble(segments ...*Segment) *Skiplist {
 	}
 
 	for _, seg := range segments {
+		atomic.AddInt64(&b.store.usedMemory, seg.sts.usedBytes)
 		b.store.Stats.Merge(&seg.sts)
 	}
 
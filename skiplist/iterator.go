@@ -67,6 +67,25 @@ func (it *Iterator) Seek(itm unsafe.Pointer) bool {
 	return found
 }
 
+// SeekPrevWithCmp moves iterator to the largest item which is smaller than the
+// provided item according to the comparator. It returns false and the
+// iterator becomes invalid if there is no such item.
+func (it *Iterator) SeekPrevWithCmp(itm unsafe.Pointer, cmp CompareFn) bool {
+	it.valid = true
+	it.s.findPath(itm, cmp, it.buf, &it.s.Stats)
+	prev := it.buf.preds[0]
+	if prev == it.s.head {
+		it.prev = it.s.head
+		it.curr = it.s.tail
+		return false
+	}
+
+	it.s.findPath(prev.Item(), cmp, it.buf, &it.s.Stats)
+	it.prev = it.buf.preds[0]
+	it.curr = it.buf.succs[0]
+	return true
+}
+
 // Valid returns true when iterator reaches the end
 func (it *Iterator) Valid() bool {
 	if it.valid && it.curr == it.s.tail {
@@ -45,6 +45,11 @@ func (n Node) Size() int {
 			unsafe.Sizeof(NodeRef{})))
 }
 
+// NodeSize returns memory used by a node of the given level
+func NodeSize(level int) int {
+	return Node{level: level}.Size()
+}
+
 // Item returns item held by the node
 func (n *Node) Item() unsafe.Pointer {
 	return n.itm
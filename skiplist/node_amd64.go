@@ -51,6 +51,11 @@ func (n Node) Size() int {
 	return int(nodeHdrSize + uintptr(n.level+1)*nodeRefSize)
 }
 
+// NodeSize returns memory used by a node of the given level
+func NodeSize(level int) int {
+	return Node{level: uint16(level)}.Size()
+}
+
 // Item returns item held by the node
 func (n *Node) Item() unsafe.Pointer {
 	return n.itm
@@ -12,6 +12,7 @@ package skiplist
 import (
 	"math/rand"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 )
@@ -43,6 +44,13 @@ type FreeFn func(unsafe.Pointer)
 type Config struct {
 	ItemSize ItemSizeFn
 
+	// MaxLevel limits the levels of the nodes. The MaxLevel constant is used
+	// if it is not between 1 and MaxLevel.
+	MaxLevel int
+	// Probability of a node to be promoted to the next level. 0.25 is used if
+	// it is not between 0 and 1.
+	Probability float32
+
 	UseMemoryMgmt     bool
 	Malloc            MallocFn
 	Free              FreeFn
@@ -59,6 +67,8 @@ func DefaultConfig() Config {
 	return Config{
 		ItemSize:      defaultItemSize,
 		UseMemoryMgmt: false,
+		MaxLevel:      MaxLevel,
+		Probability:   p,
 	}
 }
 
@@ -70,6 +80,9 @@ type Skiplist struct {
 	Stats   Stats
 	barrier *AccessBarrier
 
+	// Running total of memory used, including unmerged local stats
+	usedMemory int64
+
 	newNode  func(itm unsafe.Pointer, level int) *Node
 	freeNode func(*Node)
 
@@ -87,6 +100,14 @@ func NewWithConfig(cfg Config) *Skiplist {
 		cfg.UseMemoryMgmt = false
 	}
 
+	if cfg.MaxLevel < 1 || cfg.MaxLevel > MaxLevel {
+		cfg.MaxLevel = MaxLevel
+	}
+
+	if cfg.Probability <= 0 || cfg.Probability >= 1 {
+		cfg.Probability = p
+	}
+
 	s := &Skiplist{
 		Config:  cfg,
 		barrier: newAccessBarrier(cfg.UseMemoryMgmt, cfg.BarrierDestructor),
@@ -125,6 +146,13 @@ func (s *Skiplist) GetAccesBarrier() *AccessBarrier {
 	return s.barrier
 }
 
+// SetBarrierDestructor replaces the access barrier session destructor.
+// It should be called only while the skiplist is not being accessed.
+func (s *Skiplist) SetBarrierDestructor(fn BarrierSessionDestructor) {
+	s.BarrierDestructor = fn
+	s.barrier.callb = fn
+}
+
 // FreeNode deallocates the skiplist node memory
 func (s *Skiplist) FreeNode(n *Node, sts *Stats) {
 	s.freeNode(n)
@@ -137,16 +165,35 @@ type ActionBuffer struct {
 	succs []*Node
 }
 
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return &ActionBuffer{
+			preds: make([]*Node, MaxLevel+1),
+			succs: make([]*Node, MaxLevel+1),
+		}
+	},
+}
+
 // MakeBuf creates an action buffer
+// Action buffers are recycled through a pool shared by all skiplists.
 func (s *Skiplist) MakeBuf() *ActionBuffer {
-	return &ActionBuffer{
-		preds: make([]*Node, MaxLevel+1),
-		succs: make([]*Node, MaxLevel+1),
-	}
+	return bufPool.Get().(*ActionBuffer)
 }
 
 // FreeBuf frees an action buffer
+// The buffer should not be used after it has been freed.
 func (s *Skiplist) FreeBuf(b *ActionBuffer) {
+	b.Reset()
+	bufPool.Put(b)
+}
+
+// Reset drops the node references held by the buffer, so that an idle buffer
+// does not hold stale nodes
+func (b *ActionBuffer) Reset() {
+	for i := range b.preds {
+		b.preds[i] = nil
+		b.succs[i] = nil
+	}
 }
 
 // Size returns the size of a node
@@ -158,11 +205,7 @@ func (s *Skiplist) Size(n *Node) int {
 func (s *Skiplist) NewLevel(randFn func() float32) int {
 	var nextLevel int
 
-	for ; randFn() < p; nextLevel++ {
-	}
-
-	if nextLevel > MaxLevel {
-		nextLevel = MaxLevel
+	for ; nextLevel < s.MaxLevel && randFn() < s.Probability; nextLevel++ {
 	}
 
 	level := int(atomic.LoadInt32(&s.level))
@@ -180,9 +223,11 @@ func (s *Skiplist) NewLevel(randFn func() float32) int {
 func (s *Skiplist) helpDelete(level int, prev, curr, next *Node, sts *Stats) bool {
 	success := prev.dcasNext(level, curr, next, false, false)
 	if success && level == 0 {
+		sz := int64(s.Size(curr))
 		sts.AddInt64(&sts.softDeletes, -1)
 		sts.AddInt64(&sts.levelNodesCount[curr.Level()], -1)
-		sts.AddInt64(&sts.usedBytes, -int64(s.Size(curr)))
+		sts.AddInt64(&sts.usedBytes, -sz)
+		atomic.AddInt64(&s.usedMemory, -sz)
 	}
 	return success
 }
@@ -297,9 +342,11 @@ retry:
 	}
 
 finished:
+	sz := int64(s.Size(x))
 	sts.AddInt64(&sts.nodeAllocs, 1)
 	sts.AddInt64(&sts.levelNodesCount[itemLevel], 1)
-	sts.AddInt64(&sts.usedBytes, int64(s.Size(x)))
+	sts.AddInt64(&sts.usedBytes, sz)
+	atomic.AddInt64(&s.usedMemory, sz)
 	return x, true
 }
 
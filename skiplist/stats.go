@@ -138,6 +138,8 @@ func (s *Skiplist) GetStats() StatsReport {
 }
 
 // MemoryInUse returns memory used by skiplist
+// It is maintained as a running total and does not require merging
+// of partial stats.
 func (s *Skiplist) MemoryInUse() int64 {
-	return atomic.LoadInt64(&s.Stats.usedBytes)
+	return atomic.LoadInt64(&s.usedMemory)
 }
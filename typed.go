@@ -0,0 +1,104 @@
+//go:build go1.18
+// +build go1.18
+
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+// TypedDB is a Nitro instance which stores keys of type K
+// The keys are stored using their byte encoding and they are ordered using
+// the less function. All the other Nitro APIs, such as snapshots and backups,
+// can be used with the embedded instance.
+type TypedDB[K any] struct {
+	*Nitro
+
+	encode func(K) []byte
+	decode func([]byte) K
+}
+
+// TypedWriter is a Nitro writer for keys of type K
+type TypedWriter[K any] struct {
+	*Writer
+
+	db *TypedDB[K]
+}
+
+// NewTypedDB creates a Nitro instance for keys of type K with the given
+// config. The key comparator of the config is replaced by a comparator which
+// decodes the keys and orders them using less. Hence, every comparison
+// decodes both the keys. If less is nil, the encoded keys are compared
+// using the key comparator of the config, which avoids the decoding for
+// encodings which preserve the order of the keys.
+func NewTypedDB[K any](cfg Config, encode func(K) []byte, decode func([]byte) K,
+	less func(a, b K) bool) *TypedDB[K] {
+
+	if less != nil {
+		cfg.SetKeyComparator(func(a, b []byte) int {
+			x, y := decode(a), decode(b)
+			switch {
+			case less(x, y):
+				return -1
+			case less(y, x):
+				return 1
+			}
+			return 0
+		})
+	}
+
+	return &TypedDB[K]{
+		Nitro:  NewWithConfig(cfg),
+		encode: encode,
+		decode: decode,
+	}
+}
+
+// NewWriter creates a Nitro writer for keys of type K
+func (db *TypedDB[K]) NewWriter() *TypedWriter[K] {
+	return &TypedWriter[K]{Writer: db.Nitro.NewWriter(), db: db}
+}
+
+// Put adds a key. It returns an error if the encoded key is rejected.
+func (w *TypedWriter[K]) Put(k K) error {
+	return w.Writer.Put(w.db.encode(k))
+}
+
+// Delete removes a key. It returns false if the key does not exist.
+func (w *TypedWriter[K]) Delete(k K) bool {
+	return w.Writer.Delete(w.db.encode(k))
+}
+
+// Get returns the stored key which is equal to k in the snapshot
+// The stored key may differ from k if less does not compare all the fields
+// of the keys. It returns false if the key does not exist or the snapshot has
+// already been destroyed.
+func (db *TypedDB[K]) Get(snap *Snapshot, k K) (K, bool) {
+	var v K
+
+	itm := snap.Get(db.encode(k))
+	if itm == nil {
+		return v, false
+	}
+
+	return db.decode(itm.Bytes()), true
+}
+
+// Iterate invokes the callback for the keys in the snapshot in sorted order
+// until the callback returns false. ErrSnapshotClosed is returned if the
+// snapshot has already been destroyed.
+func (db *TypedDB[K]) Iterate(snap *Snapshot, fn func(k K) bool) error {
+	return snap.WithIterator(func(itr *Iterator) error {
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			if !fn(db.decode(itr.Get())) {
+				break
+			}
+		}
+		return nil
+	})
+}
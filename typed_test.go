@@ -0,0 +1,114 @@
+//go:build go1.18
+// +build go1.18
+
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestTypedDBInt(t *testing.T) {
+	encode := func(k int64) []byte {
+		bs := make([]byte, 8)
+		binary.BigEndian.PutUint64(bs, uint64(k))
+		return bs
+	}
+	decode := func(bs []byte) int64 {
+		return int64(binary.BigEndian.Uint64(bs))
+	}
+	less := func(a, b int64) bool { return a < b }
+
+	db := NewTypedDB(DefaultConfig(), encode, decode, less)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for _, k := range []int64{5, -3, 100, 0, -42} {
+		w.Put(k)
+	}
+
+	if !w.Delete(100) || w.Delete(7) {
+		t.Errorf("Unexpected delete status")
+	}
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	var keys []int64
+	db.Iterate(snap, func(k int64) bool {
+		keys = append(keys, k)
+		return true
+	})
+
+	exp := []int64{-42, -3, 0, 5}
+	if len(keys) != len(exp) {
+		t.Fatalf("Expected %v, got=%v", exp, keys)
+	}
+	for i := range exp {
+		if keys[i] != exp[i] {
+			t.Errorf("Expected %v, got=%v", exp, keys)
+		}
+	}
+
+	if k, ok := db.Get(snap, -3); !ok || k != -3 {
+		t.Errorf("Expected key -3, got=%v, %v", k, ok)
+	}
+
+	if _, ok := db.Get(snap, 100); ok {
+		t.Errorf("Expected deleted key to be missing")
+	}
+}
+
+type typedUser struct {
+	Name  string
+	Email string
+}
+
+func TestTypedDBStruct(t *testing.T) {
+	encode := func(u typedUser) []byte {
+		return []byte(u.Name + "\x00" + u.Email)
+	}
+	decode := func(bs []byte) typedUser {
+		fields := strings.SplitN(string(bs), "\x00", 2)
+		return typedUser{Name: fields[0], Email: fields[1]}
+	}
+	less := func(a, b typedUser) bool {
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	}
+
+	db := NewTypedDB(DefaultConfig(), encode, decode, less)
+	defer db.Close()
+
+	w := db.NewWriter()
+	w.Put(typedUser{"carol", "carol@example.com"})
+	w.Put(typedUser{"Alice", "alice@example.com"})
+	w.Put(typedUser{"bob", "bob@example.com"})
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	u, ok := db.Get(snap, typedUser{Name: "BOB"})
+	if !ok || u.Email != "bob@example.com" {
+		t.Errorf("Expected bob, got=%v, %v", u, ok)
+	}
+
+	var names []string
+	db.Iterate(snap, func(u typedUser) bool {
+		names = append(names, u.Name)
+		return len(names) < 2
+	})
+
+	if strings.Join(names, ",") != "Alice,bob" {
+		t.Errorf("Expected Alice,bob, got=%v", names)
+	}
+}